@@ -33,9 +33,11 @@ import (
 const (
 	DefaultIdentityURL     = "http://localhost:8030"
 	DefaultCredentialsPath = ".secret"
-	paramsEnvVar           = "SNAP_DATA"
-	paramsEnvVarOverride   = "OVERRIDE_SNAP_DATA"
-	paramsFilename         = "params"
+	// DefaultCredentialsKeyPath is the random key file that encrypts the credentials
+	DefaultCredentialsKeyPath = ".secret.key"
+	paramsEnvVar              = "SNAP_DATA"
+	paramsEnvVarOverride      = "OVERRIDE_SNAP_DATA"
+	paramsFilename            = "params"
 )
 
 // Settings defines the application configuration
@@ -0,0 +1,217 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/everactive/iot-identity/domain"
+)
+
+// bootstrapTokenFileName is the default file of the bootstrap token, in the common data directory
+const bootstrapTokenFileName = "bootstrap-token"
+
+// machineIDPath identifies a device without a serial assertion
+var machineIDPath = "/etc/machine-id"
+
+// BootstrapRequest is the request to enroll with a bootstrap token. The identity service
+// signs the certificate request, so the private key never leaves the device
+type BootstrapRequest struct {
+	Token  string `json:"token"`
+	Serial string `json:"serial"`
+	CSR    string `json:"csr"`
+}
+
+// BootstrapRenewRequest is the request to renew the certificate of a device enrolled with a bootstrap
+// token. The certificate request is signed by the key of the current certificate, which proves that
+// the device holds it
+type BootstrapRenewRequest struct {
+	Serial      string `json:"serial"`
+	Certificate string `json:"certificate"`
+	CSR         string `json:"csr"`
+}
+
+// BootstrapTokenProvider enrolls the device with a one-time bootstrap token and a key pair generated
+// on the device, e.g. for classic Ubuntu machines and dev boards without a serial vault. The token
+// is from the config or else from a file, which is removed once the credentials are stored. The key
+// pair is generated for every enrollment, and kept when the certificate is renewed
+type BootstrapTokenProvider struct {
+	Token     string
+	TokenPath string
+}
+
+// NewBootstrapTokenProvider creates the provider for enrolling with a bootstrap token. The token
+// file defaults to bootstrap-token in the common data directory
+func NewBootstrapTokenProvider(token, tokenPath string) *BootstrapTokenProvider {
+	if len(tokenPath) == 0 {
+		tokenPath = path.Join(commonDataPath(), bootstrapTokenFileName)
+	}
+	return &BootstrapTokenProvider{Token: token, TokenPath: tokenPath}
+}
+
+// Enroll sends the token and a certificate request for a new key to the identity service
+func (p *BootstrapTokenProvider) Enroll(idURL string) (*domain.Enrollment, error) {
+	token, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := machineID()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate the device key: %v", err)
+	}
+	csr, err := certificateRequest(serial, key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(&BootstrapRequest{Token: token, Serial: serial, CSR: csr})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := sendDeviceRequest(idURL, "bootstrap", data, sendJSONRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return withDeviceKey(resp.Enrollment, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// Enrolled removes the token file, as the token is used up once the credentials are stored.
+// A token in the snap config is kept, as the agent cannot change its own config
+func (p *BootstrapTokenProvider) Enrolled() {
+	if len(strings.TrimSpace(p.Token)) > 0 {
+		return
+	}
+	if err := os.Remove(p.TokenPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing the bootstrap token: %v", err)
+	}
+}
+
+// Renew requests a new certificate for the current key, as the token can only be used once. The
+// certificate request is signed by the current key, and sent with the current certificate
+func (p *BootstrapTokenProvider) Renew(idURL string, current *domain.Enrollment) (*domain.Enrollment, error) {
+	if current == nil {
+		return nil, fmt.Errorf("no credentials to renew")
+	}
+	pair, err := tls.X509KeyPair(current.Credentials.Certificate, current.Credentials.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the current credentials: %v", err)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("the current key cannot sign the certificate request")
+	}
+	serial, err := machineID()
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := certificateRequest(serial, key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(&BootstrapRenewRequest{
+		Serial:      serial,
+		Certificate: string(current.Credentials.Certificate),
+		CSR:         csr,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := sendDeviceRequest(idURL, "bootstrap/renew", data, sendJSONRequest)
+	if err != nil {
+		return nil, err
+	}
+	return withDeviceKey(resp.Enrollment, current.Credentials.PrivateKey)
+}
+
+func (p *BootstrapTokenProvider) token() (string, error) {
+	if token := strings.TrimSpace(p.Token); len(token) > 0 {
+		return token, nil
+	}
+	if len(p.TokenPath) > 0 {
+		data, err := ioutil.ReadFile(p.TokenPath)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("cannot read the bootstrap token: %v", err)
+		}
+		if token := strings.TrimSpace(string(data)); len(token) > 0 {
+			return token, nil
+		}
+	}
+	// The enrollment needs a token to be provided
+	return "", &EnrollmentError{Err: fmt.Errorf("no bootstrap token"), Permanent: true}
+}
+
+// certificateRequest creates the PEM certificate request for the key, with the serial as the common name
+func certificateRequest(serial string, key crypto.Signer) (string, error) {
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: serial}}, key)
+	if err != nil {
+		return "", fmt.Errorf("cannot create the certificate request: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})), nil
+}
+
+// withDeviceKey adds the device key to the enrollment, as the certificate is for the key on the device
+func withDeviceKey(enroll domain.Enrollment, key []byte) (*domain.Enrollment, error) {
+	enroll.Credentials.PrivateKey = key
+	if _, err := tls.X509KeyPair(enroll.Credentials.Certificate, enroll.Credentials.PrivateKey); err != nil {
+		return nil, fmt.Errorf("the enrollment certificate does not match the device key: %v", err)
+	}
+	return &enroll, nil
+}
+
+// machineID returns the machine id, which identifies the device to the identity service
+func machineID() (string, error) {
+	data, err := ioutil.ReadFile(machineIDPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the machine id: %v", err)
+	}
+	id := strings.TrimSpace(string(data))
+	if len(id) == 0 {
+		return "", fmt.Errorf("the machine id is empty")
+	}
+	return id, nil
+}
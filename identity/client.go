@@ -0,0 +1,248 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package identity
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/everactive/iot-identity/web"
+)
+
+// Defaults of the identity service client
+const (
+	defaultTimeout    = 30 * time.Second
+	defaultRetries    = 3
+	defaultRetryDelay = time.Second
+	// maxErrorBody limits the body of an error response that is kept for the error
+	maxErrorBody = 4096
+)
+
+// StatusError is the error when the identity service responds with a status other than 2xx.
+// The code and message are from the body of the response, when it has them
+type StatusError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if len(e.Code) > 0 {
+		return fmt.Sprintf("identity service responded with HTTP %d: (%s) %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("identity service responded with HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+// ResponseError is the error when the identity service responds with a body that is not JSON
+type ResponseError struct {
+	StatusCode  int
+	ContentType string
+	Err         error
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("invalid identity service response (HTTP %d, %s): %v", e.StatusCode, e.ContentType, e.Err)
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPClientConfig is the configuration of the client for the identity service. The CA file adds
+// to the system CAs, and the certificate and key authenticate the device with mutual TLS. The
+// proxy defaults to the proxy environment variables
+type HTTPClientConfig struct {
+	Timeout    time.Duration
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	Proxy      string
+	Retries    int
+	RetryDelay time.Duration
+}
+
+// httpClient sends the requests to the identity service, retrying on server errors
+type httpClient struct {
+	client     *http.Client
+	retries    int
+	retryDelay time.Duration
+}
+
+var clientLock sync.RWMutex
+var client = &httpClient{
+	client:     &http.Client{Timeout: defaultTimeout},
+	retries:    defaultRetries,
+	retryDelay: defaultRetryDelay,
+}
+
+// clientErr is the error of an invalid client config, which fails the requests until the client is
+// set up again
+var clientErr error
+
+// ConfigureHTTPClient sets up the client for the identity service. While the config is invalid,
+// e.g. because the CA file is missing, the requests fail with a permanent enrollment error, rather
+// than being sent without the configured TLS or proxy settings
+func ConfigureHTTPClient(c HTTPClientConfig) error {
+	cli, err := newHTTPClient(c)
+
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if err != nil {
+		clientErr = &EnrollmentError{Err: fmt.Errorf("invalid identity service client config: %v", err), Permanent: true}
+		return err
+	}
+	client = cli
+	clientErr = nil
+	return nil
+}
+
+func currentClient() (*httpClient, error) {
+	clientLock.RLock()
+	defer clientLock.RUnlock()
+	return client, clientErr
+}
+
+func newHTTPClient(c HTTPClientConfig) (*httpClient, error) {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.Retries < 0 {
+		c.Retries = 0
+	}
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = defaultRetryDelay
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(c.CAFile) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the identity service CA: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in the identity service CA: %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(c.CertFile) > 0 || len(c.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load the identity service client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if len(c.Proxy) > 0 {
+		u, err := url.Parse(c.Proxy)
+		if err != nil || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid identity service proxy: %s", c.Proxy)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	return &httpClient{
+		client: &http.Client{
+			Timeout: c.Timeout,
+			Transport: &http.Transport{
+				Proxy:                 proxy,
+				DialContext:           (&net.Dialer{Timeout: c.Timeout, KeepAlive: 30 * time.Second}).DialContext,
+				TLSClientConfig:       tlsConfig,
+				TLSHandshakeTimeout:   c.Timeout,
+				ResponseHeaderTimeout: c.Timeout,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+		retries:    c.Retries,
+		retryDelay: c.RetryDelay,
+	}, nil
+}
+
+// post sends the request, retrying with backoff when the identity service fails with a 5xx status
+func (c *httpClient) post(u, contentType string, data []byte) (*web.EnrollResponse, error) {
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := c.postOnce(u, contentType, data)
+
+		var statusErr *StatusError
+		if attempt >= c.retries || !errors.As(err, &statusErr) || statusErr.StatusCode < http.StatusInternalServerError {
+			return resp, err
+		}
+
+		log.Printf("Error from the identity service, retrying in %s: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (c *httpClient) postOnce(u, contentType string, data []byte) (*web.EnrollResponse, error) {
+	w, err := c.client.Post(u, contentType, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer w.Body.Close()
+
+	if w.StatusCode == http.StatusNotFound || w.StatusCode == http.StatusMethodNotAllowed {
+		return nil, fmt.Errorf("%w: %s", errEndpointNotFound, u)
+	}
+	return parseHTTPResponse(w)
+}
+
+// parseHTTPResponse decodes the enrollment from a 2xx response. Any other status is a StatusError,
+// with the code and message of the identity service when the body has them
+func parseHTTPResponse(w *http.Response) (*web.EnrollResponse, error) {
+	contentType := w.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	if w.StatusCode < 200 || w.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(http.MaxBytesReader(nil, w.Body, maxErrorBody))
+		statusErr := &StatusError{StatusCode: w.StatusCode, Message: string(bytes.TrimSpace(body))}
+		result := web.StandardResponse{}
+		if mediaType == jsonMediaType && json.Unmarshal(body, &result) == nil && len(result.Code) > 0 {
+			statusErr.Code, statusErr.Message = result.Code, result.Message
+		}
+		return nil, statusErr
+	}
+
+	if mediaType != jsonMediaType {
+		return nil, &ResponseError{StatusCode: w.StatusCode, ContentType: contentType, Err: fmt.Errorf("the content type is not %s", jsonMediaType)}
+	}
+	resp, err := parseEnrollResponse(w.Body)
+	if err != nil {
+		return nil, &ResponseError{StatusCode: w.StatusCode, ContentType: contentType, Err: err}
+	}
+	return resp, nil
+}
@@ -0,0 +1,197 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package identity
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/everactive/iot-identity/domain"
+)
+
+// Files shared with local snaps through the content interface, in the common data directory
+const (
+	sharedDirName        = "device-data"
+	sharedMetadataName   = "enrollment.json"
+	sharedDeviceDataName = "device-data.bin"
+)
+
+// DeviceData is the device data from the management service and the enrollment metadata that
+// local snaps can read. It never includes the credentials
+type DeviceData struct {
+	DeviceID         string    `json:"deviceId"`
+	OrganizationID   string    `json:"orgId"`
+	OrganizationName string    `json:"orgName,omitempty"`
+	Brand            string    `json:"brand,omitempty"`
+	Model            string    `json:"model,omitempty"`
+	Serial           string    `json:"serial,omitempty"`
+	Data             []byte    `json:"-"`
+	Updated          time.Time `json:"updated"`
+}
+
+// DeviceDataHandler is called when the device data changes
+type DeviceDataHandler func(data DeviceData)
+
+var deviceDataLock sync.RWMutex
+var deviceData *DeviceData
+var deviceDataHandlers []*DeviceDataHandler
+
+// AddDeviceDataHandler adds a handler for the changes of the device data, e.g. to publish them locally,
+// and returns the func that removes it
+func AddDeviceDataHandler(handler DeviceDataHandler) (remove func()) {
+	h := &handler
+	deviceDataLock.Lock()
+	defer deviceDataLock.Unlock()
+	deviceDataHandlers = append(deviceDataHandlers, h)
+
+	return func() {
+		deviceDataLock.Lock()
+		defer deviceDataLock.Unlock()
+		for i, registered := range deviceDataHandlers {
+			if registered == h {
+				deviceDataHandlers = append(deviceDataHandlers[:i], deviceDataHandlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// CurrentDeviceData returns the device data of the enrolled device, which is nil until it is enrolled
+func CurrentDeviceData() *DeviceData {
+	deviceDataLock.RLock()
+	defer deviceDataLock.RUnlock()
+	if deviceData == nil {
+		return nil
+	}
+	d := *deviceData
+	return &d
+}
+
+// PublishDeviceData shares the device data of the enrollment with local snaps. The files for
+// the content interface are written and the handlers are called when it changed
+func PublishDeviceData(enroll *domain.Enrollment) error {
+	data, err := base64.StdEncoding.DecodeString(enroll.DeviceData)
+	if err != nil {
+		return fmt.Errorf("cannot decode device data: %v", err)
+	}
+
+	d := DeviceData{
+		DeviceID:         enroll.ID,
+		OrganizationID:   enroll.Organization.ID,
+		OrganizationName: enroll.Organization.Name,
+		Brand:            enroll.Device.Brand,
+		Model:            enroll.Device.Model,
+		Serial:           enroll.Device.SerialNumber,
+		Data:             data,
+		Updated:          time.Now().UTC(),
+	}
+
+	deviceDataLock.Lock()
+	defer deviceDataLock.Unlock()
+	if deviceData != nil && sameDeviceData(*deviceData, d) {
+		return nil
+	}
+
+	if err := writeSharedDeviceData(d); err != nil {
+		return err
+	}
+	deviceData = &d
+
+	for _, handler := range deviceDataHandlers {
+		(*handler)(d)
+	}
+	return nil
+}
+
+func sameDeviceData(a, b DeviceData) bool {
+	return a.DeviceID == b.DeviceID &&
+		a.OrganizationID == b.OrganizationID &&
+		a.OrganizationName == b.OrganizationName &&
+		a.Brand == b.Brand &&
+		a.Model == b.Model &&
+		a.Serial == b.Serial &&
+		bytes.Equal(a.Data, b.Data)
+}
+
+// writeSharedDeviceData writes the files that the content interface shares with local snaps
+func writeSharedDeviceData(d DeviceData) error {
+	dir := path.Join(commonDataPath(), sharedDirName)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("cannot create the shared device data directory: %v", err)
+	}
+
+	metadata, err := json.MarshalIndent(&d, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path.Join(dir, sharedDeviceDataName), d.Data); err != nil {
+		return fmt.Errorf("cannot write the shared device data: %v", err)
+	}
+	if err := writeFileAtomic(path.Join(dir, sharedMetadataName), metadata); err != nil {
+		return fmt.Errorf("cannot write the shared enrollment metadata: %v", err)
+	}
+	log.Println("Shared the device data with local snaps")
+	return nil
+}
+
+// writeFileAtomic replaces a file, so readers never see a partial file
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// UpdateDeviceData replaces the device data of the enrollment, e.g. when the management service
+// updates it, and shares it with local snaps
+func (srv *Service) UpdateDeviceData(dataBase64 string) error {
+	if _, err := base64.StdEncoding.DecodeString(dataBase64); err != nil {
+		return fmt.Errorf("cannot decode device data: %v", err)
+	}
+
+	enroll, err := srv.getCredentials()
+	if err != nil {
+		return fmt.Errorf("cannot update the device data of an unenrolled device: %v", err)
+	}
+	enroll.DeviceData = dataBase64
+
+	srv.settingsLock.Lock()
+	err = srv.storeCredentials(*enroll)
+	srv.settingsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Keep the device data file of the enrollment current for the readers of the legacy location
+	if err := storeDeviceData(dataBase64); err != nil {
+		return err
+	}
+
+	return PublishDeviceData(enroll)
+}
@@ -20,11 +20,12 @@
 package identity
 
 import (
-	"bytes"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
-	"github.com/snapcore/snapd/asserts"
 	"io"
 	"io/ioutil"
 	"log"
@@ -33,6 +34,7 @@ import (
 	"os"
 	"path"
 	"sync"
+	"time"
 
 	"github.com/everactive/iot-agent/config"
 	"github.com/everactive/iot-agent/snapdapi"
@@ -42,10 +44,11 @@ import (
 
 // Default parameters
 const (
-	mediaType          = "application/x.ubuntu.assertion"
-	commonDataEnvVar   = "SNAP_COMMON"
-	overrideCommonDataEnvVar   = "OVERRIDE_SNAP_COMMON"
-	deviceDataFileName = "device-data.bin"
+	mediaType                = "application/x.ubuntu.assertion"
+	jsonMediaType            = "application/json"
+	commonDataEnvVar         = "SNAP_COMMON"
+	overrideCommonDataEnvVar = "OVERRIDE_SNAP_COMMON"
+	deviceDataFileName       = "device-data.bin"
 )
 
 // UseCase is the interface for the identity service use cases
@@ -57,11 +60,18 @@ type UseCase interface {
 type Service struct {
 	Settings *config.Settings
 	Snapd    snapdapi.SnapdClient
+	// Keys supplies the key that encrypts the stored credentials
+	Keys KeyProvider
+	// Provider requests the enrollment from the identity service
+	Provider     EnrollmentProvider
 	settingsLock sync.Mutex
 }
 
 type Identity interface {
 	CheckEnrollment() (*domain.Enrollment, error)
+	RenewCredentials() (*domain.Enrollment, error)
+	Reenroll() (*domain.Enrollment, error)
+	ApplyProvisioning(bundle *ProvisioningBundle) error
 }
 
 // NewService creates a new identity service connection
@@ -69,6 +79,8 @@ func NewService(settings *config.Settings, snapd snapdapi.SnapdClient) *Service
 	return &Service{
 		Settings: settings,
 		Snapd:    snapd,
+		Keys:     NewFileKeyProvider(config.GetPath(config.DefaultCredentialsKeyPath)),
+		Provider: NewAssertionProvider(snapd),
 	}
 }
 
@@ -80,65 +92,95 @@ func (srv *Service) CheckEnrollment() (*domain.Enrollment, error) {
 		return en, nil
 	}
 
-	// No credentials stored, so enroll the device
-	// Enroll the device with the identity service
-	return srv.enrollDevice()
-}
-
-func (srv *Service) getEncodedAssertions() ([]byte, error) {
-	// Get the model assertion
-	modelAssertions, err := srv.Snapd.Known(asserts.ModelType.Name, map[string]string{})
-	if err != nil || len(modelAssertions) == 0 {
-		log.Printf("error retrieving the model assertion: %v", err)
-		return nil, err
+	// Credentials that cannot be read back, e.g. because they were modified, encrypted with a key
+	// that was lost or are corrupt, are moved aside and the device enrolls again
+	if errors.Is(err, ErrCredentialsTampered) || errors.Is(err, errCredentialsCorrupt) {
+		log.Printf("The stored credentials are invalid, so enroll again: %v", err)
+		if err := srv.setAsideInvalidCredentials(); err != nil {
+			return nil, err
+		}
+		return srv.enrollDevice()
 	}
-	dataModel := asserts.Encode(modelAssertions[0])
 
-	// Get the serial assertion
-	serialAssertions, err := srv.Snapd.Known(asserts.SerialType.Name, map[string]string{})
-	if err != nil || len(serialAssertions) == 0 {
-		log.Printf("error retrieving the serial assertion: %v", err)
+	// Other errors, e.g. a key file that cannot be read, are retried rather than enrolling again
+	if !os.IsNotExist(err) {
 		return nil, err
 	}
-	dataSerial := asserts.Encode(serialAssertions[0])
 
-	// Bring the assertions together
-	data := append(dataModel, []byte("\n")...)
-	data = append(data, dataSerial...)
-	return data, nil
+	// No credentials stored, so enroll the device with the identity service
+	return srv.enrollDevice()
 }
 
-// enroll registers the device with the identity service
+// enrollDevice registers the device with the identity service
 func (srv *Service) enrollDevice() (*domain.Enrollment, error) {
-	// Get the model and serial assertions
-	data, err := srv.getEncodedAssertions()
-	if err != nil {
-		return nil, err
-	}
-
 	srv.settingsLock.Lock()
 	defer srv.settingsLock.Unlock()
-	// Format the URL for the identity service
-	resp, err := sendEnrollmentRequest(srv.Settings.IdentityURL, data)
+	return srv.enroll()
+}
+
+// enroll requests the enrollment and stores the credentials. The caller holds the settings lock
+func (srv *Service) enroll() (*domain.Enrollment, error) {
+	enroll, err := srv.Provider.Enroll(srv.Settings.IdentityURL)
 	if err != nil {
 		return nil, err
 	}
 
 	// Store the enrollment credentials
-	err = srv.storeCredentials(resp.Enrollment)
+	err = srv.storeCredentials(*enroll)
 	if err != nil {
 		return nil, err
 	}
+	if completer, ok := srv.Provider.(EnrollmentCompleter); ok {
+		completer.Enrolled()
+	}
 
 	// Store device data in a separate file
-	if len(resp.Enrollment.DeviceData) != 0 {
-		err = storeDeviceData(resp.Enrollment.DeviceData)
+	if len(enroll.DeviceData) != 0 {
+		err = storeDeviceData(enroll.DeviceData)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return &resp.Enrollment, err
+	return enroll, err
+}
+
+// RenewCredentials requests new credentials from the identity service with the enrollment
+// provider, and replaces the stored credentials
+func (srv *Service) RenewCredentials() (*domain.Enrollment, error) {
+	current, err := srv.getCredentials()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	srv.settingsLock.Lock()
+	defer srv.settingsLock.Unlock()
+
+	enroll, err := srv.Provider.Renew(srv.Settings.IdentityURL, current)
+	if err != nil {
+		return nil, err
+	}
+	if len(enroll.Credentials.Certificate) == 0 || len(enroll.Credentials.PrivateKey) == 0 {
+		return nil, fmt.Errorf("the renewed credentials have no certificate")
+	}
+
+	if err = srv.storeCredentials(*enroll); err != nil {
+		return nil, err
+	}
+	return enroll, nil
+}
+
+// CertificateExpiry returns when the client certificate of the enrollment expires
+func CertificateExpiry(enroll *domain.Enrollment) (time.Time, error) {
+	block, _ := pem.Decode(enroll.Credentials.Certificate)
+	if block == nil {
+		return time.Time{}, fmt.Errorf("no client certificate in the enrollment")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse the client certificate: %v", err)
+	}
+	return cert.NotAfter, nil
 }
 
 func storeDeviceData(dataBase64 string) error {
@@ -147,12 +189,7 @@ func storeDeviceData(dataBase64 string) error {
 		return fmt.Errorf("cannot decode device data: %v", err)
 	}
 
-	dataPath := os.Getenv(commonDataEnvVar)
-	if len(os.Getenv(overrideCommonDataEnvVar)) > 0 {
-		dataPath = os.Getenv(overrideCommonDataEnvVar)
-	}
-
-	err = ioutil.WriteFile(path.Join(dataPath, deviceDataFileName), data, 0600)
+	err = ioutil.WriteFile(path.Join(commonDataPath(), deviceDataFileName), data, 0600)
 	if err != nil {
 		return fmt.Errorf("cannot write device data: %v", err)
 	}
@@ -160,27 +197,93 @@ func storeDeviceData(dataBase64 string) error {
 	return nil
 }
 
+// commonDataPath returns the snap's common data directory
+func commonDataPath() string {
+	if dataPath := os.Getenv(overrideCommonDataEnvVar); len(dataPath) > 0 {
+		return dataPath
+	}
+	return os.Getenv(commonDataEnvVar)
+}
+
 func sendEnrollmentRequest(idURL string, data []byte) (*web.EnrollResponse, error) {
+	return sendDeviceRequest(idURL, "enroll", data, sendPOSTRequest)
+}
+
+func sendRenewalRequest(idURL string, data []byte) (*web.EnrollResponse, error) {
+	return sendDeviceRequest(idURL, "renew", data, sendPOSTRequest)
+}
+
+// sendDeviceRequest sends the request, e.g. the assertions, to a device endpoint of the
+// identity service, which responds with the enrollment
+func sendDeviceRequest(idURL, endpoint string, data []byte, send func(string, []byte) (*web.EnrollResponse, error)) (*web.EnrollResponse, error) {
 	// Format the URL for the identity service
 	u, err := url.Parse(idURL)
 	if err != nil {
 		return nil, err
 	}
-	u.Path = path.Join(u.Path, "v1", "device", "enroll")
+	u.Path = path.Join(u.Path, "v1", "device", endpoint)
 
 	// Send the request to get the credentials from the identity service
-	resp, err := sendPOSTRequest(u.String(), data)
+	resp, err := send(u.String(), data)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return nil, &EnrollmentError{Err: statusErr, Permanent: permanentRejection(statusErr.StatusCode, statusErr.Code)}
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	if len(resp.StandardResponse.Code) > 0 {
-		return nil, fmt.Errorf("(%s) %s", resp.StandardResponse.Code, resp.StandardResponse.Message)
+		return nil, &EnrollmentError{
+			Err:       fmt.Errorf("(%s) %s", resp.StandardResponse.Code, resp.StandardResponse.Message),
+			Permanent: permanentRejection(http.StatusOK, resp.StandardResponse.Code),
+		}
 	}
 
 	return resp, nil
 }
 
+// EnrollmentError is an enrollment request rejected by the identity service. A permanent
+// error, e.g. a device that is not registered, needs a change on the identity service
+// before enrolling can succeed
+type EnrollmentError struct {
+	Err       error
+	Permanent bool
+}
+
+func (e *EnrollmentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *EnrollmentError) Unwrap() error {
+	return e.Err
+}
+
+// IsPermanent returns whether retrying the enrollment is unlikely to succeed soon
+func IsPermanent(err error) bool {
+	var e *EnrollmentError
+	return errors.As(err, &e) && e.Permanent
+}
+
+// permanentCodes are the codes of the identity service for requests that it cannot decode,
+// which fail again when they are sent unchanged
+var permanentCodes = map[string]bool{
+	"NoData":  true,
+	"BadData": true,
+}
+
+// permanentRejection returns whether a rejection with the HTTP status and the code of the
+// identity service is unlikely to succeed when retried. The identity service rejects every
+// failed enrollment with the same code, whether the device is not registered or its database
+// is unavailable, so any other rejection is taken as temporary
+func permanentRejection(statusCode int, code string) bool {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict, http.StatusGone, http.StatusUnprocessableEntity:
+		return true
+	}
+	return permanentCodes[code]
+}
+
 func parseEnrollResponse(r io.Reader) (*web.EnrollResponse, error) {
 	// Parse the response
 	result := web.EnrollResponse{}
@@ -188,13 +291,21 @@ func parseEnrollResponse(r io.Reader) (*web.EnrollResponse, error) {
 	return &result, err
 }
 
+// errEndpointNotFound is the error when the identity service does not have the endpoint
+var errEndpointNotFound = errors.New("identity service endpoint not found")
+
 var sendPOSTRequest = func(u string, data []byte) (*web.EnrollResponse, error) {
-	// Send the request to get the credentials from the identity service
-	w, err := http.Post(u, mediaType, bytes.NewReader(data))
+	return postRequest(u, mediaType, data)
+}
+
+var sendJSONRequest = func(u string, data []byte) (*web.EnrollResponse, error) {
+	return postRequest(u, jsonMediaType, data)
+}
+
+func postRequest(u, contentType string, data []byte) (*web.EnrollResponse, error) {
+	c, err := currentClient()
 	if err != nil {
 		return nil, err
 	}
-
-	defer w.Body.Close()
-	return parseEnrollResponse(w.Body)
+	return c.post(u, contentType, data)
 }
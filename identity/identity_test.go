@@ -20,16 +20,51 @@
 package identity
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
-	"github.com/everactive/iot-agent/snapdapi"
-	"github.com/everactive/iot-identity/web"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/everactive/iot-identity/domain"
+	"github.com/everactive/iot-identity/web"
 
 	"github.com/everactive/iot-agent/config"
+	"github.com/everactive/iot-agent/snapdapi"
 )
 
+// TestMain keeps the files of the tests, e.g. the credentials key, out of the source tree
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		panic(err)
+	}
+	_ = os.MkdirAll(path.Join(dir, "data", "current"), 0700)
+	_ = os.MkdirAll(path.Join(dir, "common"), 0700)
+	os.Setenv("OVERRIDE_SNAP_DATA", path.Join(dir, "data"))
+	os.Setenv(overrideCommonDataEnvVar, path.Join(dir, "common"))
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func TestService_CheckEnrollment(t *testing.T) {
 	settings := config.ReadParameters()
 	_ = os.Remove(settings.CredentialsPath)
@@ -99,3 +134,1152 @@ func mockSendDeviceData(u string, data []byte) (*web.EnrollResponse, error) {
 func mockSendRequestError(u string, data []byte) (*web.EnrollResponse, error) {
 	return nil, fmt.Errorf("mock send request error")
 }
+
+func TestSendEnrollmentRequest_Errors(t *testing.T) {
+	defer func() { sendPOSTRequest = mockSendRequest }()
+
+	tests := []struct {
+		name      string
+		resp      string
+		sendErr   bool
+		permanent bool
+	}{
+		{"not-registered", `{"code": "EnrollDevice", "message": "the device ` + "`a/b/c`" + ` is not registered"}`, false, false},
+		{"database-error", `{"code": "EnrollDevice", "message": "error retrieving device: connection refused"}`, false, false},
+		{"no-data", `{"code": "NoData", "message": "No data supplied."}`, false, true},
+		{"bad-data", `{"code": "BadData", "message": "unexpected EOF"}`, false, true},
+		{"network-error", ``, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendPOSTRequest = func(u string, data []byte) (*web.EnrollResponse, error) {
+				if tt.sendErr {
+					return nil, fmt.Errorf("mock send request error")
+				}
+				return parseEnrollResponse(strings.NewReader(tt.resp))
+			}
+
+			_, err := sendEnrollmentRequest("https://id.example.com", nil)
+			if err == nil {
+				t.Fatal("sendEnrollmentRequest() expected an error")
+			}
+			if got := IsPermanent(err); got != tt.permanent {
+				t.Errorf("IsPermanent(%v) = %v, want %v", err, got, tt.permanent)
+			}
+		})
+	}
+}
+
+func TestSetState(t *testing.T) {
+	var events []StateEvent
+	remove := AddStateHandler(func(event StateEvent) {
+		events = append(events, event)
+	})
+
+	if CurrentState().State != StateUnenrolled {
+		t.Errorf("CurrentState() = %v, want unenrolled", CurrentState().State)
+	}
+
+	next := time.Now().Add(time.Minute)
+	SetState(StateEvent{State: StateFailed, Attempts: 2, Error: fmt.Errorf("MOCK error"), NextAttempt: next})
+	SetState(StateEvent{State: StateEnrolled, Attempts: 3})
+
+	if len(events) != 2 || events[0].State != StateFailed || !events[0].NextAttempt.Equal(next) || events[0].Timestamp.IsZero() {
+		t.Errorf("SetState() handler events = %+v", events)
+	}
+	if got := CurrentState(); got.State != StateEnrolled || got.Attempts != 3 {
+		t.Errorf("CurrentState() = %+v", got)
+	}
+
+	// A removed handler is not called, and removing it again does nothing
+	remove()
+	remove()
+	SetState(StateEvent{State: StateEnrolled, Attempts: 4})
+	if len(events) != 2 {
+		t.Errorf("SetState() handler events after remove = %+v", events)
+	}
+}
+
+// generateCredentials creates an organization root certificate, and a client certificate
+// issued by it and its key. The certificates expire at notAfter
+func generateCredentials(t *testing.T, notAfter time.Time) (rootCert, cert, key []byte) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "org"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("cannot create root certificate: %v", err)
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "abc123"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(clientKey)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertificateExpiry(t *testing.T) {
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	_, cert, _ := generateCredentials(t, notAfter)
+	enroll := &domain.Enrollment{Credentials: domain.Credentials{Certificate: cert}}
+
+	got, err := CertificateExpiry(enroll)
+	if err != nil || !got.Equal(notAfter) {
+		t.Errorf("CertificateExpiry() = %v, %v, want %v", got, err, notAfter)
+	}
+
+	if _, err := CertificateExpiry(&domain.Enrollment{}); err == nil {
+		t.Error("CertificateExpiry() expected an error without a certificate")
+	}
+}
+
+func TestService_RenewCredentials(t *testing.T) {
+	defer func() { sendPOSTRequest = mockSendRequest }()
+	settings := config.ReadParameters()
+	defer func() {
+		_ = os.Remove(settings.CredentialsPath)
+		_ = os.Remove("params")
+	}()
+
+	const renewed = `{"enrollment": {"id":"abc123","credentials":{"certificate":"Y2VydA==","privateKey":"a2V5"}}}`
+	tests := []struct {
+		name     string
+		renew    func(string) (*web.EnrollResponse, error)
+		enroll   bool
+		snapdErr bool
+		wantErr  bool
+	}{
+		{"renew", func(string) (*web.EnrollResponse, error) { return parseEnrollResponse(strings.NewReader(renewed)) }, false, false, false},
+		{"renew-not-found", func(u string) (*web.EnrollResponse, error) { return nil, fmt.Errorf("%w: %s", errEndpointNotFound, u) }, true, false, false},
+		{"renew-rejected", func(string) (*web.EnrollResponse, error) {
+			return parseEnrollResponse(strings.NewReader(`{"code": "RenewDevice", "message": "the device is disabled"}`))
+		}, false, false, true},
+		{"renew-no-certificate", func(string) (*web.EnrollResponse, error) {
+			return parseEnrollResponse(strings.NewReader(`{"enrollment": {"id":"abc123"}}`))
+		}, false, false, true},
+		{"snapd-error", nil, false, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.Remove(settings.CredentialsPath)
+			enrolled := false
+			sendPOSTRequest = func(u string, data []byte) (*web.EnrollResponse, error) {
+				if strings.HasSuffix(u, "/v1/device/enroll") {
+					enrolled = true
+					return parseEnrollResponse(strings.NewReader(renewed))
+				}
+				return tt.renew(u)
+			}
+
+			srv := NewService(settings, &snapdapi.MockClient{WithError: tt.snapdErr})
+			got, err := srv.RenewCredentials()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Service.RenewCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if enrolled != tt.enroll {
+				t.Errorf("Service.RenewCredentials() enrolled again = %v, want %v", enrolled, tt.enroll)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			stored, err := srv.getCredentials()
+			if err != nil || string(stored.Credentials.Certificate) != "cert" || got.ID != "abc123" {
+				t.Errorf("Service.RenewCredentials() stored = %+v, %v", stored, err)
+			}
+		})
+	}
+}
+
+type staticKeys []byte
+
+func (k staticKeys) Key() ([]byte, error) { return k, nil }
+
+// migratingKeys allows migrating plaintext credentials once
+type migratingKeys struct {
+	staticKeys
+	migrate bool
+}
+
+func (k *migratingKeys) MigratePlaintext() bool {
+	migrate := k.migrate
+	k.migrate = false
+	return migrate
+}
+
+func TestDecryptSecret(t *testing.T) {
+	plaintext := []byte(`{"id":"abc123"}`)
+	data, err := encryptSecret(staticKeys("device"), plaintext)
+	if err != nil {
+		t.Fatalf("encryptSecret() error = %v", err)
+	}
+	if strings.Contains(string(data), "abc123") {
+		t.Fatal("encryptSecret() the data is not encrypted")
+	}
+
+	tampered := secretFile{}
+	_ = json.Unmarshal(data, &tampered)
+	tampered.Ciphertext[0] ^= 0xff
+	tamperedData, _ := json.Marshal(&tampered)
+
+	tests := []struct {
+		name          string
+		keys          KeyProvider
+		data          []byte
+		wantEncrypted bool
+		wantErr       error
+	}{
+		{"encrypted", staticKeys("device"), data, true, nil},
+		{"plaintext", staticKeys("device"), plaintext, false, ErrCredentialsTampered},
+		{"plaintext-migration", &migratingKeys{staticKeys: staticKeys("device"), migrate: true}, plaintext, false, nil},
+		{"plaintext-migrated", &migratingKeys{staticKeys: staticKeys("device")}, plaintext, false, ErrCredentialsTampered},
+		{"tampered", staticKeys("device"), tamperedData, true, ErrCredentialsTampered},
+		{"other-device", staticKeys("other"), data, true, ErrCredentialsTampered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, encrypted, err := decryptSecret(tt.keys, tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("decryptSecret() error = %v, want %v", err, tt.wantErr)
+			}
+			if encrypted != tt.wantEncrypted {
+				t.Errorf("decryptSecret() encrypted = %v, want %v", encrypted, tt.wantEncrypted)
+			}
+			if tt.wantErr == nil && string(got) != string(plaintext) {
+				t.Errorf("decryptSecret() = %s, want %s", got, plaintext)
+			}
+		})
+	}
+}
+
+func TestService_CheckEnrollment_Secret(t *testing.T) {
+	sendPOSTRequest = mockSendRequestError
+	defer func() { sendPOSTRequest = mockSendRequest }()
+	settings := config.ReadParameters()
+	invalid := settings.CredentialsPath + ".invalid"
+	defer func() {
+		_ = os.Remove(settings.CredentialsPath)
+		_ = os.Remove(invalid)
+		_ = os.Remove("params")
+	}()
+
+	srv := NewService(settings, &snapdapi.MockClient{})
+	srv.Keys = &migratingKeys{staticKeys: staticKeys("device"), migrate: true}
+
+	// Credentials stored by an earlier version are encrypted when read
+	if err := ioutil.WriteFile(settings.CredentialsPath, []byte(`{"id":"abc123"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := srv.CheckEnrollment()
+	if err != nil || got.ID != "abc123" {
+		t.Fatalf("Service.CheckEnrollment() = %v, %v", got, err)
+	}
+
+	data, _ := ioutil.ReadFile(settings.CredentialsPath)
+	if _, encrypted, err := decryptSecret(srv.Keys, data); !encrypted || err != nil {
+		t.Fatalf("Service.CheckEnrollment() the credentials were not encrypted: %v", err)
+	}
+
+	// Credentials that fail the integrity check are moved aside and the device enrolls again
+	srv.Keys = staticKeys("other")
+	if _, err := srv.CheckEnrollment(); err == nil || !strings.Contains(err.Error(), "mock send request error") {
+		t.Errorf("Service.CheckEnrollment() error = %v, want the enrollment error", err)
+	}
+	if _, err := os.Stat(settings.CredentialsPath); !os.IsNotExist(err) {
+		t.Errorf("Service.CheckEnrollment() the invalid credentials were kept: %v", err)
+	}
+	if _, err := os.Stat(invalid); err != nil {
+		t.Errorf("Service.CheckEnrollment() the invalid credentials were not moved aside: %v", err)
+	}
+
+	// Corrupt credentials are moved aside too
+	if err := ioutil.WriteFile(settings.CredentialsPath, []byte(`{"id":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv.Keys = &migratingKeys{staticKeys: staticKeys("device"), migrate: true}
+	if _, err := srv.CheckEnrollment(); err == nil || !strings.Contains(err.Error(), "mock send request error") {
+		t.Errorf("Service.CheckEnrollment() error = %v, want the enrollment error", err)
+	}
+	if _, err := os.Stat(settings.CredentialsPath); !os.IsNotExist(err) {
+		t.Errorf("Service.CheckEnrollment() the corrupt credentials were kept: %v", err)
+	}
+}
+
+func TestService_CheckEnrollment_PlaintextWithKey(t *testing.T) {
+	sendPOSTRequest = mockSendRequestError
+	defer func() { sendPOSTRequest = mockSendRequest }()
+	settings := config.ReadParameters()
+	defer func() {
+		_ = os.Remove(settings.CredentialsPath)
+		_ = os.Remove(settings.CredentialsPath + ".invalid")
+		_ = os.Remove("params")
+	}()
+
+	// The key file exists from an earlier start, so the credentials were encrypted already
+	keyPath := path.Join(t.TempDir(), "key")
+	if _, err := NewFileKeyProvider(keyPath).Key(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewService(settings, &snapdapi.MockClient{})
+	srv.Keys = NewFileKeyProvider(keyPath)
+
+	// Plaintext credentials written next to the key are rejected
+	if err := ioutil.WriteFile(settings.CredentialsPath, []byte(`{"id":"planted"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.getCredentials(); !errors.Is(err, ErrCredentialsTampered) {
+		t.Errorf("Service.getCredentials() error = %v, want %v", err, ErrCredentialsTampered)
+	}
+	if got, err := srv.CheckEnrollment(); err == nil {
+		t.Errorf("Service.CheckEnrollment() = %v, want the enrollment error", got)
+	}
+}
+
+type failingKeys struct{}
+
+func (failingKeys) Key() ([]byte, error) { return nil, fmt.Errorf("MOCK key error") }
+
+func TestService_CheckEnrollment_KeyError(t *testing.T) {
+	sendPOSTRequest = mockSendRequestError
+	defer func() { sendPOSTRequest = mockSendRequest }()
+	settings := config.ReadParameters()
+	defer func() {
+		_ = os.Remove(settings.CredentialsPath)
+		_ = os.Remove("params")
+	}()
+
+	srv := NewService(settings, &snapdapi.MockClient{})
+	srv.Keys = staticKeys("device")
+	if err := srv.storeCredentials(domain.Enrollment{ID: "abc123"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stored credentials are kept, and the error is retried rather than enrolling again
+	srv.Keys = failingKeys{}
+	_, err := srv.CheckEnrollment()
+	if err == nil || IsPermanent(err) || !strings.Contains(err.Error(), "MOCK key error") {
+		t.Errorf("Service.CheckEnrollment() error = %v, want the key error", err)
+	}
+	if _, err := os.Stat(settings.CredentialsPath); err != nil {
+		t.Errorf("Service.CheckEnrollment() the credentials were removed: %v", err)
+	}
+}
+
+func TestFileKeyProvider_Key(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := path.Join(dir, "key")
+
+	key, err := NewFileKeyProvider(keyPath).Key()
+	if err != nil || len(key) != keySize {
+		t.Fatalf("FileKeyProvider.Key() = %x, %v", key, err)
+	}
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("FileKeyProvider.Key() key file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// The key file is read again by a new provider
+	again, err := NewFileKeyProvider(keyPath).Key()
+	if err != nil || !bytes.Equal(again, key) {
+		t.Errorf("FileKeyProvider.Key() = %x, %v, want %x", again, err, key)
+	}
+
+	// Another key file has another key
+	other, err := NewFileKeyProvider(path.Join(dir, "other")).Key()
+	if err != nil || bytes.Equal(other, key) {
+		t.Errorf("FileKeyProvider.Key() = %x, %v, want a new key", other, err)
+	}
+
+	// The key is bound to the machine id
+	defer func() { machineIDPath = "/etc/machine-id" }()
+	machineIDPath = path.Join(dir, "machine-id")
+	if err := ioutil.WriteFile(machineIDPath, []byte("0123456789abcdef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if other, err := NewFileKeyProvider(keyPath).Key(); err != nil || bytes.Equal(other, key) {
+		t.Errorf("FileKeyProvider.Key() = %x, %v, want another key for another machine id", other, err)
+	}
+
+	// An invalid key file is replaced
+	shortPath := path.Join(dir, "short")
+	if err := ioutil.WriteFile(shortPath, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileKeyProvider(shortPath).Key(); err != nil {
+		t.Errorf("FileKeyProvider.Key() error = %v", err)
+	}
+	if data, _ := ioutil.ReadFile(shortPath); len(data) != keySize {
+		t.Errorf("FileKeyProvider.Key() the invalid key file was not replaced: %x", data)
+	}
+}
+
+func TestFileKeyProvider_MigratePlaintext(t *testing.T) {
+	keyPath := path.Join(t.TempDir(), "key")
+
+	// A new key file allows the migration once
+	p := NewFileKeyProvider(keyPath)
+	if !p.MigratePlaintext() {
+		t.Error("FileKeyProvider.MigratePlaintext() = false for a new key file")
+	}
+	if p.MigratePlaintext() {
+		t.Error("FileKeyProvider.MigratePlaintext() = true after the migration")
+	}
+
+	// An existing key file does not
+	if NewFileKeyProvider(keyPath).MigratePlaintext() {
+		t.Error("FileKeyProvider.MigratePlaintext() = true for an existing key file")
+	}
+}
+
+func TestService_Reenroll(t *testing.T) {
+	defer func() { sendPOSTRequest = mockSendRequest }()
+	settings := config.ReadParameters()
+	defer func() {
+		_ = os.Remove(settings.CredentialsPath)
+		_ = os.Remove("params")
+	}()
+
+	srv := NewService(settings, &snapdapi.MockClient{})
+	srv.Keys = staticKeys("device")
+	if err := srv.storeCredentials(domain.Enrollment{ID: "old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed enrollment keeps the stored credentials
+	sendPOSTRequest = mockSendRequestError
+	if _, err := srv.Reenroll(); err == nil {
+		t.Fatal("Service.Reenroll() expected an error")
+	}
+	if got, err := srv.getCredentials(); err != nil || got.ID != "old" {
+		t.Fatalf("Service.Reenroll() the stored credentials = %v, %v, want old", got, err)
+	}
+
+	// Credentials moved aside by an enrollment that did not finish are restored
+	if err := os.Rename(settings.CredentialsPath, previousCredentialsPath(settings.CredentialsPath)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := srv.CheckEnrollment(); err != nil || got.ID != "old" {
+		t.Fatalf("Service.CheckEnrollment() = %v, %v, want old", got, err)
+	}
+
+	// A successful enrollment replaces them
+	sendPOSTRequest = mockSendRequest
+	got, err := srv.Reenroll()
+	if err != nil || got.ID != "abc123" {
+		t.Fatalf("Service.Reenroll() = %v, %v", got, err)
+	}
+	if stored, err := srv.getCredentials(); err != nil || stored.ID != "abc123" {
+		t.Errorf("Service.Reenroll() the stored credentials = %v, %v, want abc123", stored, err)
+	}
+	if _, err := os.Stat(previousCredentialsPath(settings.CredentialsPath)); !os.IsNotExist(err) {
+		t.Errorf("Service.Reenroll() the previous credentials were kept: %v", err)
+	}
+}
+
+// signRequest is an identity service that signs the certificate request of a bootstrap enrollment
+func signRequest(t *testing.T, wantToken string) func(string, []byte) (*web.EnrollResponse, error) {
+	return func(u string, data []byte) (*web.EnrollResponse, error) {
+		if !strings.HasSuffix(u, "/v1/device/bootstrap") {
+			return nil, fmt.Errorf("unexpected url: %s", u)
+		}
+		req := BootstrapRequest{}
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		if req.Token != wantToken {
+			return nil, &StatusError{StatusCode: http.StatusForbidden, Code: "BootstrapDevice", Message: "the token is invalid"}
+		}
+		return signCertificateRequest(req.Serial, req.CSR)
+	}
+}
+
+// signRenewal is an identity service that renews the certificate of a bootstrap enrollment, when the
+// certificate request is signed by the key of the current certificate
+func signRenewal(u string, data []byte) (*web.EnrollResponse, error) {
+	if !strings.HasSuffix(u, "/v1/device/bootstrap/renew") {
+		return nil, fmt.Errorf("unexpected url: %s", u)
+	}
+	req := BootstrapRenewRequest{}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(req.Certificate))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode([]byte(req.CSR))
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil || !cert.PublicKey.(*ecdsa.PublicKey).Equal(csr.PublicKey) {
+		return nil, &StatusError{StatusCode: http.StatusForbidden, Code: "BootstrapDevice", Message: "the request is not signed by the device key"}
+	}
+	return signCertificateRequest(req.Serial, req.CSR)
+}
+
+// signCertificateRequest issues a certificate for the PEM certificate request
+func signCertificateRequest(serial, csrPEM string) (*web.EnrollResponse, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, csr.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	enroll := domain.Enrollment{ID: "abc123", Device: domain.Device{SerialNumber: serial}}
+	enroll.Credentials.Certificate = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return &web.EnrollResponse{Enrollment: enroll}, nil
+}
+
+func TestBootstrapTokenProvider_Enroll(t *testing.T) {
+	send := sendJSONRequest
+	defer func() { sendJSONRequest = send }()
+	dir := t.TempDir()
+	machineIDPath = path.Join(dir, "machine-id")
+	defer func() { machineIDPath = "/etc/machine-id" }()
+	if err := ioutil.WriteFile(machineIDPath, []byte("0123456789abcdef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tokenPath := path.Join(dir, "bootstrap-token")
+
+	tests := []struct {
+		name      string
+		token     string
+		fileToken string
+		send      func(string, []byte) (*web.EnrollResponse, error)
+		wantErr   bool
+		permanent bool
+	}{
+		{"config-token", "secret", "", signRequest(t, "secret"), false, false},
+		{"file-token", "", "secret\n", signRequest(t, "secret"), false, false},
+		{"invalid-token", "other", "", signRequest(t, "secret"), true, true},
+		{"no-token", "", "", signRequest(t, "secret"), true, true},
+		{"other-key", "secret", "", func(string, []byte) (*web.EnrollResponse, error) {
+			_, cert, _ := generateCredentials(t, time.Now().Add(time.Hour))
+			enroll := domain.Enrollment{ID: "abc123", Credentials: domain.Credentials{Certificate: cert}}
+			return &web.EnrollResponse{Enrollment: enroll}, nil
+		}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.Remove(tokenPath)
+			if len(tt.fileToken) > 0 {
+				if err := ioutil.WriteFile(tokenPath, []byte(tt.fileToken), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sendJSONRequest = tt.send
+
+			p := NewBootstrapTokenProvider(tt.token, tokenPath)
+			got, err := p.Enroll("http://localhost:8030/")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BootstrapTokenProvider.Enroll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if IsPermanent(err) != tt.permanent {
+				t.Errorf("BootstrapTokenProvider.Enroll() permanent = %v, want %v", IsPermanent(err), tt.permanent)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if _, err := tls.X509KeyPair(got.Credentials.Certificate, got.Credentials.PrivateKey); err != nil {
+				t.Errorf("BootstrapTokenProvider.Enroll() credentials: %v", err)
+			}
+			if got.Device.SerialNumber != "0123456789abcdef" {
+				t.Errorf("BootstrapTokenProvider.Enroll() serial = %s", got.Device.SerialNumber)
+			}
+			if _, err := os.Stat(tokenPath); (err == nil) != (len(tt.fileToken) > 0) {
+				t.Errorf("BootstrapTokenProvider.Enroll() the token file was changed: %v", err)
+			}
+
+			// The token file is removed once the credentials are stored
+			p.Enrolled()
+			if _, err := os.Stat(tokenPath); !os.IsNotExist(err) {
+				t.Errorf("BootstrapTokenProvider.Enrolled() the token file was not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestBootstrapTokenProvider_Renew(t *testing.T) {
+	send := sendJSONRequest
+	defer func() { sendJSONRequest = send }()
+	dir := t.TempDir()
+	machineIDPath = path.Join(dir, "machine-id")
+	defer func() { machineIDPath = "/etc/machine-id" }()
+	if err := ioutil.WriteFile(machineIDPath, []byte("0123456789abcdef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewBootstrapTokenProvider("secret", path.Join(dir, "bootstrap-token"))
+	sendJSONRequest = signRequest(t, "secret")
+	current, err := p.Enroll("http://localhost:8030/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The renewed certificate is for the current key
+	sendJSONRequest = signRenewal
+	got, err := p.Renew("http://localhost:8030/", current)
+	if err != nil {
+		t.Fatalf("BootstrapTokenProvider.Renew() error = %v", err)
+	}
+	if string(got.Credentials.PrivateKey) != string(current.Credentials.PrivateKey) {
+		t.Error("BootstrapTokenProvider.Renew() the device key changed")
+	}
+	if string(got.Credentials.Certificate) == string(current.Credentials.Certificate) {
+		t.Error("BootstrapTokenProvider.Renew() the certificate was not renewed")
+	}
+
+	// Renewing needs the current credentials
+	if _, err := p.Renew("http://localhost:8030/", nil); err == nil {
+		t.Error("BootstrapTokenProvider.Renew() expected an error without credentials")
+	}
+	other := *current
+	_, other.Credentials.Certificate, _ = generateCredentials(t, time.Now().Add(time.Hour))
+	if _, err := p.Renew("http://localhost:8030/", &other); err == nil {
+		t.Error("BootstrapTokenProvider.Renew() expected an error for a certificate of another key")
+	}
+}
+
+func TestService_CheckEnrollment_BootstrapToken(t *testing.T) {
+	send := sendJSONRequest
+	defer func() { sendJSONRequest = send }()
+	dir := t.TempDir()
+	machineIDPath = path.Join(dir, "machine-id")
+	defer func() { machineIDPath = "/etc/machine-id" }()
+	if err := ioutil.WriteFile(machineIDPath, []byte("0123456789abcdef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tokenPath := path.Join(dir, "bootstrap-token")
+	if err := ioutil.WriteFile(tokenPath, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sendJSONRequest = signRequest(t, "secret")
+
+	settings := config.ReadParameters()
+	defer func() {
+		_ = os.Remove(settings.CredentialsPath)
+		_ = os.Remove("params")
+	}()
+	srv := NewService(settings, &snapdapi.MockClient{})
+	srv.Provider = NewBootstrapTokenProvider("", tokenPath)
+
+	// The token is kept when the credentials cannot be stored
+	srv.Keys = failingKeys{}
+	if _, err := srv.CheckEnrollment(); err == nil {
+		t.Fatal("Service.CheckEnrollment() expected an error")
+	}
+	if _, err := os.Stat(tokenPath); err != nil {
+		t.Fatalf("Service.CheckEnrollment() the token file was removed: %v", err)
+	}
+
+	srv.Keys = staticKeys("device")
+	if _, err := srv.CheckEnrollment(); err != nil {
+		t.Fatalf("Service.CheckEnrollment() error = %v", err)
+	}
+	if _, err := os.Stat(tokenPath); !os.IsNotExist(err) {
+		t.Errorf("Service.CheckEnrollment() the token file was not removed: %v", err)
+	}
+}
+
+func TestHTTPClient_Post(t *testing.T) {
+	const enrolled = `{"enrollment": {"id":"abc123"}}`
+	tests := []struct {
+		name        string
+		statuses    []int
+		contentType string
+		body        string
+		wantCalls   int
+		wantStatus  int
+		wantCode    string
+		wantInvalid bool
+		wantErr     error
+	}{
+		{"ok", []int{200}, jsonMediaType, enrolled, 1, 0, "", false, nil},
+		{"retry-5xx", []int{503, 502, 200}, jsonMediaType, enrolled, 3, 0, "", false, nil},
+		{"5xx-retries-exhausted", []int{500, 500, 500}, "text/plain", "MOCK database down", 3, 500, "", false, nil},
+		{"rejected", []int{400}, "application/json; charset=UTF-8", `{"code":"EnrollDevice","message":"the device is not registered"}`, 1, 400, "EnrollDevice", false, nil},
+		{"forbidden", []int{403}, "text/html", "<html>Forbidden</html>", 1, 403, "", false, nil},
+		{"not-json", []int{200}, "text/html", "<html>Captive portal</html>", 1, 0, "", true, nil},
+		{"invalid-json", []int{200}, jsonMediaType, `{"enrollment":`, 1, 0, "", true, nil},
+		{"not-found", []int{404}, "text/plain", "404 page not found", 1, 0, "", false, errEndpointNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[calls]
+				calls++
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			c, err := newHTTPClient(HTTPClientConfig{Retries: 2, RetryDelay: time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.post(srv.URL+"/v1/device/enroll", mediaType, []byte("assertions"))
+			if calls != tt.wantCalls {
+				t.Errorf("httpClient.post() calls = %d, want %d", calls, tt.wantCalls)
+			}
+
+			var statusErr *StatusError
+			var responseErr *ResponseError
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("httpClient.post() error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantStatus > 0:
+				if !errors.As(err, &statusErr) || statusErr.StatusCode != tt.wantStatus || statusErr.Code != tt.wantCode {
+					t.Errorf("httpClient.post() error = %v, want HTTP %d (%s)", err, tt.wantStatus, tt.wantCode)
+				}
+			case tt.wantInvalid:
+				if !errors.As(err, &responseErr) {
+					t.Errorf("httpClient.post() error = %v, want an invalid response", err)
+				}
+			default:
+				if err != nil || got.Enrollment.ID != "abc123" {
+					t.Errorf("httpClient.post() = %v, %v", got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSendDeviceRequest_StatusError(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		permanent bool
+	}{
+		{"forbidden", http.StatusForbidden, `{"code":"EnrollDevice","message":"the device is not registered"}`, true},
+		{"conflict", http.StatusConflict, `{"code":"EnrollDevice","message":"the device is already enrolled"}`, true},
+		{"bad-data", http.StatusBadRequest, `{"code":"BadData","message":"unexpected EOF"}`, true},
+		{"unknown-code", http.StatusBadRequest, `{"code":"EnrollDevice","message":"the device is not registered"}`, false},
+		{"no-code", http.StatusBadRequest, `Bad Request`, false},
+		{"too-many-requests", http.StatusTooManyRequests, `{"code":"EnrollDevice","message":"slow down"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			_, err := sendDeviceRequest(srv.URL, "enroll", []byte("assertions"), func(u string, data []byte) (*web.EnrollResponse, error) {
+				return postRequest(u, mediaType, data)
+			})
+			var enrollErr *EnrollmentError
+			if !errors.As(err, &enrollErr) {
+				t.Fatalf("sendDeviceRequest() error = %v, want an enrollment error", err)
+			}
+			if IsPermanent(err) != tt.permanent {
+				t.Errorf("sendDeviceRequest() permanent = %v, want %v", IsPermanent(err), tt.permanent)
+			}
+		})
+	}
+}
+
+func TestHTTPClient_TLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", jsonMediaType)
+		_, _ = w.Write([]byte(`{"enrollment": {"id":"abc123"}}`))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	caFile := path.Join(dir, "ca.pem")
+	certFile := path.Join(dir, "client.pem")
+	keyFile := path.Join(dir, "client.key")
+	_ = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+
+	_, cert, key := generateCredentials(t, time.Now().Add(time.Hour))
+	_ = ioutil.WriteFile(certFile, cert, 0600)
+	_ = ioutil.WriteFile(keyFile, key, 0600)
+
+	tests := []struct {
+		name    string
+		config  HTTPClientConfig
+		wantErr bool
+	}{
+		{"unknown-ca", HTTPClientConfig{CertFile: certFile, KeyFile: keyFile}, true},
+		{"no-client-certificate", HTTPClientConfig{CAFile: caFile}, true},
+		{"mutual-tls", HTTPClientConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newHTTPClient(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.post(srv.URL, mediaType, []byte("assertions"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("httpClient.post() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := newHTTPClient(HTTPClientConfig{CAFile: path.Join(dir, "missing.pem")}); err == nil {
+		t.Error("newHTTPClient() expected an error for a missing CA file")
+	}
+}
+
+func TestConfigureHTTPClient(t *testing.T) {
+	defer func() { _ = ConfigureHTTPClient(HTTPClientConfig{}) }()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", jsonMediaType)
+		_, _ = w.Write([]byte(`{"enrollment": {"id":"abc123"}}`))
+	}))
+	defer srv.Close()
+
+	// An invalid config fails the requests with a permanent error
+	if err := ConfigureHTTPClient(HTTPClientConfig{CAFile: path.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Fatal("ConfigureHTTPClient() expected an error for a missing CA file")
+	}
+	if _, err := postRequest(srv.URL, mediaType, []byte("assertions")); err == nil || !IsPermanent(err) {
+		t.Errorf("postRequest() error = %v, want a permanent error", err)
+	}
+
+	// A valid config sends the requests again
+	if err := ConfigureHTTPClient(HTTPClientConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := postRequest(srv.URL, mediaType, []byte("assertions")); err != nil || got.Enrollment.ID != "abc123" {
+		t.Errorf("postRequest() = %v, %v", got, err)
+	}
+}
+
+func TestHTTPClient_Proxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Header().Set("Content-Type", jsonMediaType)
+		_, _ = w.Write([]byte(`{"enrollment": {"id":"abc123"}}`))
+	}))
+	defer proxy.Close()
+
+	c, err := newHTTPClient(HTTPClientConfig{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.post("http://identity.example.com/v1/device/enroll", mediaType, []byte("assertions"))
+	if err != nil || got.Enrollment.ID != "abc123" {
+		t.Fatalf("httpClient.post() = %v, %v", got, err)
+	}
+	if proxied != "http://identity.example.com/v1/device/enroll" {
+		t.Errorf("httpClient.post() proxied %s", proxied)
+	}
+
+	if _, err := newHTTPClient(HTTPClientConfig{Proxy: "not a url"}); err == nil {
+		t.Error("newHTTPClient() expected an error for an invalid proxy")
+	}
+}
+
+func TestPublishDeviceData(t *testing.T) {
+	defer os.Setenv(overrideCommonDataEnvVar, os.Getenv(overrideCommonDataEnvVar))
+	dir := t.TempDir()
+	os.Setenv(overrideCommonDataEnvVar, dir)
+
+	var published []DeviceData
+	remove := AddDeviceDataHandler(func(d DeviceData) { published = append(published, d) })
+	defer remove()
+
+	enroll := &domain.Enrollment{ID: "abc123", Organization: domain.Organization{ID: "org1", RootCert: []byte("MOCK root")}, DeviceData: "SGVsbG8="}
+	enroll.Credentials = domain.Credentials{Certificate: []byte("MOCK certificate"), PrivateKey: []byte("MOCK key")}
+
+	if err := PublishDeviceData(enroll); err != nil {
+		t.Fatalf("PublishDeviceData() error = %v", err)
+	}
+	// The same device data is not published again
+	if err := PublishDeviceData(enroll); err != nil {
+		t.Fatalf("PublishDeviceData() error = %v", err)
+	}
+	if len(published) != 1 || string(published[0].Data) != "Hello" || published[0].DeviceID != "abc123" {
+		t.Fatalf("PublishDeviceData() published %+v", published)
+	}
+	if got := CurrentDeviceData(); got == nil || got.OrganizationID != "org1" {
+		t.Errorf("CurrentDeviceData() = %+v", got)
+	}
+
+	data, _ := ioutil.ReadFile(path.Join(dir, sharedDirName, sharedDeviceDataName))
+	if string(data) != "Hello" {
+		t.Errorf("PublishDeviceData() shared device data = %s", data)
+	}
+	metadata, _ := ioutil.ReadFile(path.Join(dir, sharedDirName, sharedMetadataName))
+	if !strings.Contains(string(metadata), `"deviceId": "abc123"`) || strings.Contains(string(metadata), "MOCK") {
+		t.Errorf("PublishDeviceData() shared metadata = %s", metadata)
+	}
+
+	if err := PublishDeviceData(&domain.Enrollment{ID: "abc123", DeviceData: "not base64"}); err == nil {
+		t.Error("PublishDeviceData() expected an error for invalid device data")
+	}
+}
+
+func TestService_UpdateDeviceData(t *testing.T) {
+	defer os.Setenv(overrideCommonDataEnvVar, os.Getenv(overrideCommonDataEnvVar))
+	os.Setenv(overrideCommonDataEnvVar, t.TempDir())
+	sendPOSTRequest = mockSendDeviceData
+	defer func() { sendPOSTRequest = mockSendRequest }()
+	settings := config.ReadParameters()
+	defer func() {
+		_ = os.Remove(settings.CredentialsPath)
+		_ = os.Remove("params")
+	}()
+
+	srv := NewService(settings, &snapdapi.MockClient{})
+	srv.Keys = staticKeys("device")
+	if err := srv.UpdateDeviceData("SGVsbG8="); err == nil {
+		t.Error("Service.UpdateDeviceData() expected an error before enrolling")
+	}
+	if _, err := srv.CheckEnrollment(); err != nil {
+		t.Fatalf("Service.CheckEnrollment() error = %v", err)
+	}
+
+	if err := srv.UpdateDeviceData("not base64"); err == nil {
+		t.Error("Service.UpdateDeviceData() expected an error for invalid device data")
+	}
+	if err := srv.UpdateDeviceData("VXBkYXRlZA=="); err != nil {
+		t.Fatalf("Service.UpdateDeviceData() error = %v", err)
+	}
+
+	stored, err := srv.getCredentials()
+	if err != nil || stored.DeviceData != "VXBkYXRlZA==" {
+		t.Errorf("Service.UpdateDeviceData() stored = %+v, %v", stored, err)
+	}
+	if got := CurrentDeviceData(); got == nil || string(got.Data) != "Updated" {
+		t.Errorf("CurrentDeviceData() = %+v", got)
+	}
+	if legacy, err := ioutil.ReadFile(path.Join(commonDataPath(), deviceDataFileName)); err != nil || string(legacy) != "Updated" {
+		t.Errorf("Service.UpdateDeviceData() legacy device data = %s, %v", legacy, err)
+	}
+}
+
+// signBundle creates a provisioning bundle file signed with the key
+func signBundle(t *testing.T, key *ecdsa.PrivateKey, bundle ProvisioningBundle) []byte {
+	data, _ := json.Marshal(&bundle)
+	digest := sha256.Sum256(data)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("cannot sign the bundle: %v", err)
+	}
+	signed, _ := json.Marshal(&signedBundle{Bundle: data, Signature: signature})
+	return signed
+}
+
+func TestReadProvisioningBundle(t *testing.T) {
+	signingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rootCert, cert, key := generateCredentials(t, time.Now().Add(time.Hour))
+	otherRoot, _, _ := generateCredentials(t, time.Now().Add(time.Hour))
+
+	enrollment := func() *domain.Enrollment {
+		return &domain.Enrollment{
+			ID:           "abc123",
+			Organization: domain.Organization{ID: "org1"},
+			Device:       domain.Device{SerialNumber: "A1"},
+			Credentials:  domain.Credentials{Certificate: cert, PrivateKey: key, MQTTURL: "mqtt.example.com", MQTTPort: "8883"},
+		}
+	}
+	unbound := enrollment()
+	unbound.Device.SerialNumber = ""
+
+	tests := []struct {
+		name    string
+		key     *ecdsa.PrivateKey
+		bundle  ProvisioningBundle
+		wantErr string
+	}{
+		{"valid-url", signingKey, ProvisioningBundle{IdentityURL: "https://id.example.com"}, ""},
+		{"valid-credentials", signingKey, ProvisioningBundle{IdentityURL: "https://id.example.com", Enrollment: enrollment(), RootCert: rootCert}, ""},
+		{"invalid-signature", otherKey, ProvisioningBundle{IdentityURL: "https://id.example.com"}, "signature is invalid"},
+		{"expired", signingKey, ProvisioningBundle{IdentityURL: "https://id.example.com", Expires: time.Now().Add(-time.Minute)}, "expired"},
+		{"invalid-url", signingKey, ProvisioningBundle{IdentityURL: "id.example.com"}, "invalid identity service URL"},
+		{"no-root-cert", signingKey, ProvisioningBundle{IdentityURL: "https://id.example.com", Enrollment: enrollment()}, "no organization root certificate"},
+		{"other-root-cert", signingKey, ProvisioningBundle{IdentityURL: "https://id.example.com", Enrollment: enrollment(), RootCert: otherRoot}, "not issued by the organization"},
+		{"machine-id", signingKey, ProvisioningBundle{IdentityURL: "https://id.example.com", Enrollment: unbound, RootCert: rootCert, MachineID: "0123456789abcdef"}, ""},
+		{"unbound", signingKey, ProvisioningBundle{IdentityURL: "https://id.example.com", Enrollment: unbound, RootCert: rootCert}, "not bound to a device"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadProvisioningBundle(signBundle(t, tt.key, tt.bundle), &signingKey.PublicKey, time.Now())
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ReadProvisioningBundle() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadProvisioningBundle() error = %v", err)
+			}
+			if got.IdentityURL != tt.bundle.IdentityURL {
+				t.Errorf("ReadProvisioningBundle() identity URL = %s, want %s", got.IdentityURL, tt.bundle.IdentityURL)
+			}
+			if got.Enrollment != nil && string(got.Enrollment.Organization.RootCert) != string(rootCert) {
+				t.Error("ReadProvisioningBundle() the enrollment does not have the root certificate")
+			}
+		})
+	}
+
+	if _, err := ReadProvisioningBundle([]byte("not json"), &signingKey.PublicKey, time.Now()); err == nil {
+		t.Error("ReadProvisioningBundle() expected an error for an invalid file")
+	}
+}
+
+func TestService_ApplyProvisioning(t *testing.T) {
+	sendPOSTRequest = mockSendRequestError
+	defer func() { sendPOSTRequest = mockSendRequest }()
+	device := serialDevice
+	serialDevice = func(snapdapi.SnapdClient) (domain.Device, error) {
+		return domain.Device{Brand: "example", Model: "drone", SerialNumber: "A1"}, nil
+	}
+	defer func() { serialDevice = device }()
+	settings := config.ReadParameters()
+	params := *settings
+	defer func() {
+		_ = os.Remove(settings.CredentialsPath)
+		_ = config.StoreParameters(params)
+		_ = os.Remove("params")
+	}()
+
+	rootCert, cert, key := generateCredentials(t, time.Now().Add(time.Hour))
+	bundle := &ProvisioningBundle{
+		IdentityURL: "https://id.example.com",
+		Enrollment: &domain.Enrollment{
+			ID:           "abc123",
+			Organization: domain.Organization{ID: "org1", RootCert: rootCert},
+			Device:       domain.Device{Brand: "example", Model: "drone", SerialNumber: "A1"},
+			Credentials:  domain.Credentials{Certificate: cert, PrivateKey: key, MQTTURL: "mqtt.example.com", MQTTPort: "8883"},
+		},
+	}
+
+	srv := NewService(settings, &snapdapi.MockClient{})
+	srv.Keys = staticKeys("device")
+
+	// Credentials for another device are rejected
+	for _, other := range []domain.Device{
+		{Brand: "example", Model: "drone", SerialNumber: "B2"},
+		{Brand: "example", Model: "rover", SerialNumber: "A1"},
+	} {
+		otherBundle := *bundle
+		otherEnrollment := *bundle.Enrollment
+		otherEnrollment.Device = other
+		otherBundle.Enrollment = &otherEnrollment
+		if err := srv.ApplyProvisioning(&otherBundle); !errors.Is(err, ErrOtherDevice) {
+			t.Errorf("Service.ApplyProvisioning() error = %v, want %v", err, ErrOtherDevice)
+		}
+	}
+
+	if err := srv.ApplyProvisioning(bundle); err != nil {
+		t.Fatalf("Service.ApplyProvisioning() error = %v", err)
+	}
+
+	if got := config.ReadParameters().IdentityURL; got != bundle.IdentityURL {
+		t.Errorf("Service.ApplyProvisioning() stored identity URL = %s, want %s", got, bundle.IdentityURL)
+	}
+	if srv.Settings.IdentityURL != bundle.IdentityURL {
+		t.Errorf("Service.ApplyProvisioning() identity URL = %s, want %s", srv.Settings.IdentityURL, bundle.IdentityURL)
+	}
+
+	// The device is enrolled with the pre-issued credentials, without the identity service
+	got, err := srv.CheckEnrollment()
+	if err != nil || got.ID != "abc123" {
+		t.Fatalf("Service.CheckEnrollment() = %v, %v", got, err)
+	}
+
+	if err := srv.ApplyProvisioning(bundle); !errors.Is(err, ErrAlreadyEnrolled) {
+		t.Errorf("Service.ApplyProvisioning() error = %v, want %v", err, ErrAlreadyEnrolled)
+	}
+}
+
+func TestService_ApplyProvisioning_MachineID(t *testing.T) {
+	dir := t.TempDir()
+	machineIDPath = path.Join(dir, "machine-id")
+	defer func() { machineIDPath = "/etc/machine-id" }()
+	if err := ioutil.WriteFile(machineIDPath, []byte("0123456789abcdef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings := config.ReadParameters()
+	params := *settings
+	defer func() {
+		_ = os.Remove(settings.CredentialsPath)
+		_ = config.StoreParameters(params)
+		_ = os.Remove("params")
+	}()
+
+	rootCert, cert, key := generateCredentials(t, time.Now().Add(time.Hour))
+	bundle := &ProvisioningBundle{
+		IdentityURL: "https://id.example.com",
+		Enrollment: &domain.Enrollment{
+			ID:           "abc123",
+			Organization: domain.Organization{ID: "org1", RootCert: rootCert},
+			Credentials:  domain.Credentials{Certificate: cert, PrivateKey: key, MQTTURL: "mqtt.example.com", MQTTPort: "8883"},
+		},
+		MachineID: "fedcba9876543210",
+	}
+
+	srv := NewService(settings, &snapdapi.MockClient{})
+	srv.Keys = staticKeys("device")
+	if err := srv.ApplyProvisioning(bundle); !errors.Is(err, ErrOtherDevice) {
+		t.Errorf("Service.ApplyProvisioning() error = %v, want %v", err, ErrOtherDevice)
+	}
+
+	bundle.MachineID = "0123456789abcdef"
+	if err := srv.ApplyProvisioning(bundle); err != nil {
+		t.Errorf("Service.ApplyProvisioning() error = %v", err)
+	}
+}
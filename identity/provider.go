@@ -0,0 +1,119 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package identity
+
+import (
+	"errors"
+	"log"
+
+	"github.com/everactive/iot-identity/domain"
+	"github.com/snapcore/snapd/asserts"
+
+	"github.com/everactive/iot-agent/snapdapi"
+)
+
+// Enrollment methods
+const (
+	// EnrollmentMethodAssertion enrolls with the model and serial assertions of the device
+	EnrollmentMethodAssertion = "assertion"
+	// EnrollmentMethodBootstrapToken enrolls with a one-time token, for devices without a serial assertion
+	EnrollmentMethodBootstrapToken = "bootstrap-token"
+)
+
+// EnrollmentProvider requests the enrollment of the device from the identity service, authenticating it
+// in its own way. The returned enrollment includes the credentials for the MQTT broker. Renew receives
+// the current enrollment, if any
+type EnrollmentProvider interface {
+	Enroll(idURL string) (*domain.Enrollment, error)
+	Renew(idURL string, current *domain.Enrollment) (*domain.Enrollment, error)
+}
+
+// EnrollmentCompleter is implemented by the providers that clean up once the credentials of an
+// enrollment are stored, e.g. removing a one-time token
+type EnrollmentCompleter interface {
+	Enrolled()
+}
+
+// AssertionProvider enrolls the device with its model and serial assertions, which is the default
+type AssertionProvider struct {
+	Snapd snapdapi.SnapdClient
+}
+
+// NewAssertionProvider creates the provider for enrolling with the assertions from snapd
+func NewAssertionProvider(snapd snapdapi.SnapdClient) *AssertionProvider {
+	return &AssertionProvider{Snapd: snapd}
+}
+
+// Enroll sends the assertions to the identity service
+func (p *AssertionProvider) Enroll(idURL string) (*domain.Enrollment, error) {
+	// Get the model and serial assertions
+	data, err := p.encodedAssertions()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := sendEnrollmentRequest(idURL, data)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Enrollment, nil
+}
+
+// Renew requests new credentials with the assertions. An identity service without the
+// renewal endpoint enrolls the device again
+func (p *AssertionProvider) Renew(idURL string, _ *domain.Enrollment) (*domain.Enrollment, error) {
+	data, err := p.encodedAssertions()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := sendRenewalRequest(idURL, data)
+	if errors.Is(err, errEndpointNotFound) {
+		log.Println("The identity service cannot renew credentials, so enroll again")
+		resp, err = sendEnrollmentRequest(idURL, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Enrollment, nil
+}
+
+func (p *AssertionProvider) encodedAssertions() ([]byte, error) {
+	// Get the model assertion
+	modelAssertions, err := p.Snapd.Known(asserts.ModelType.Name, map[string]string{})
+	if err != nil || len(modelAssertions) == 0 {
+		log.Printf("error retrieving the model assertion: %v", err)
+		return nil, err
+	}
+	dataModel := asserts.Encode(modelAssertions[0])
+
+	// Get the serial assertion
+	serialAssertions, err := p.Snapd.Known(asserts.SerialType.Name, map[string]string{})
+	if err != nil || len(serialAssertions) == 0 {
+		log.Printf("error retrieving the serial assertion: %v", err)
+		return nil, err
+	}
+	dataSerial := asserts.Encode(serialAssertions[0])
+
+	// Bring the assertions together
+	data := append(dataModel, []byte("\n")...)
+	data = append(data, dataSerial...)
+	return data, nil
+}
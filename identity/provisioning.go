@@ -0,0 +1,280 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/everactive/iot-identity/domain"
+	"github.com/snapcore/snapd/asserts"
+
+	"github.com/everactive/iot-agent/config"
+	"github.com/everactive/iot-agent/snapdapi"
+)
+
+// provisioningFileName is the name of a provisioning bundle on removable media
+const provisioningFileName = "iot-agent-provisioning.json"
+
+// ErrAlreadyEnrolled is the error when a provisioning bundle is applied to a device that has credentials
+var ErrAlreadyEnrolled = errors.New("the device is already enrolled")
+
+// ErrOtherDevice is the error when the pre-issued credentials of a provisioning bundle are for another device
+var ErrOtherDevice = errors.New("the provisioning bundle is for another device")
+
+// ProvisioningBundle is the enrollment of a device that could not reach the identity service
+// when it was installed. The pre-issued credentials are optional: without them, the device
+// enrolls with the identity service in the bundle once it is connected. The credentials are
+// bound to the device by the machine id, for a device without a serial assertion, or else by
+// the serial of the enrollment
+type ProvisioningBundle struct {
+	IdentityURL string             `json:"identityUrl"`
+	Enrollment  *domain.Enrollment `json:"enrollment,omitempty"`
+	RootCert    []byte             `json:"rootCert,omitempty"`
+	Expires     time.Time          `json:"expires,omitempty"`
+	MachineID   string             `json:"machineId,omitempty"`
+}
+
+// signedBundle is the provisioning bundle file. The signature is over the bundle as it is in the file
+type signedBundle struct {
+	Bundle    []byte `json:"bundle"`
+	Signature []byte `json:"signature"`
+}
+
+// DefaultProvisioningPaths are the patterns of the provisioning bundles dropped in $SNAP_COMMON/provisioning
+// or found on mounted removable media
+func DefaultProvisioningPaths() []string {
+	return []string{
+		path.Join(commonDataPath(), "provisioning", "*.json"),
+		path.Join("/media", "*", provisioningFileName),
+		path.Join("/media", "*", "*", provisioningFileName),
+		path.Join("/run/media", "*", "*", provisioningFileName),
+	}
+}
+
+// FindProvisioningBundles returns the files that match the patterns
+func FindProvisioningBundles(patterns []string) []string {
+	var files []string
+	for _, p := range patterns {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			continue
+		}
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// ReadProvisioningKey reads the PEM public key that signs the provisioning bundles
+func ReadProvisioningKey(keyPath string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the provisioning key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM public key in the provisioning key file")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the provisioning key: %v", err)
+	}
+	return key, nil
+}
+
+// ReadProvisioningBundle verifies the signature of the bundle file with the key, and validates the bundle
+func ReadProvisioningBundle(data []byte, key crypto.PublicKey, now time.Time) (*ProvisioningBundle, error) {
+	signed := signedBundle{}
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("cannot parse the provisioning bundle: %v", err)
+	}
+	if err := verifySignature(key, signed.Bundle, signed.Signature); err != nil {
+		return nil, err
+	}
+
+	bundle := ProvisioningBundle{}
+	if err := json.Unmarshal(signed.Bundle, &bundle); err != nil {
+		return nil, fmt.Errorf("cannot parse the provisioning bundle: %v", err)
+	}
+	if err := bundle.validate(now); err != nil {
+		return nil, fmt.Errorf("invalid provisioning bundle: %v", err)
+	}
+	return &bundle, nil
+}
+
+// verifySignature checks the SHA-256 signature with an ECDSA, Ed25519 or RSA (PKCS #1 v1.5) key
+func verifySignature(key crypto.PublicKey, data, signature []byte) error {
+	digest := sha256.Sum256(data)
+
+	valid := false
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(k, digest[:], signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, data, signature)
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	default:
+		return fmt.Errorf("unsupported provisioning key type: %T", key)
+	}
+	if !valid {
+		return fmt.Errorf("the provisioning bundle signature is invalid")
+	}
+	return nil
+}
+
+// validate checks the identity service URL and that the pre-issued client certificate
+// matches its private key and is issued by the organization's root certificate
+func (b *ProvisioningBundle) validate(now time.Time) error {
+	if !b.Expires.IsZero() && now.After(b.Expires) {
+		return fmt.Errorf("the bundle expired at %s", b.Expires.Format(time.RFC3339))
+	}
+	u, err := url.Parse(b.IdentityURL)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return fmt.Errorf("invalid identity service URL: `%s`", b.IdentityURL)
+	}
+
+	if b.Enrollment == nil {
+		return nil
+	}
+	if len(b.Enrollment.ID) == 0 || len(b.Enrollment.Organization.ID) == 0 {
+		return fmt.Errorf("the enrollment has no device or organization ID")
+	}
+	if len(b.Enrollment.Credentials.MQTTURL) == 0 {
+		return fmt.Errorf("the enrollment has no MQTT broker")
+	}
+	if len(b.MachineID) == 0 && len(b.Enrollment.Device.SerialNumber) == 0 {
+		return fmt.Errorf("the enrollment is not bound to a device serial or machine id")
+	}
+	if _, err := tls.X509KeyPair(b.Enrollment.Credentials.Certificate, b.Enrollment.Credentials.PrivateKey); err != nil {
+		return fmt.Errorf("the enrollment certificate does not match its key: %v", err)
+	}
+
+	if len(b.RootCert) > 0 {
+		b.Enrollment.Organization.RootCert = b.RootCert
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b.Enrollment.Organization.RootCert) {
+		return fmt.Errorf("the enrollment has no organization root certificate")
+	}
+	block, _ := pem.Decode(b.Enrollment.Credentials.Certificate)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("cannot parse the enrollment certificate: %v", err)
+	}
+	opts := x509.VerifyOptions{Roots: roots, CurrentTime: now, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+	if _, err := cert.Verify(opts); err != nil {
+		return fmt.Errorf("the enrollment certificate is not issued by the organization: %v", err)
+	}
+	return nil
+}
+
+// ApplyProvisioning stores the identity service URL of the bundle in the parameters and the
+// pre-issued credentials, if any. A device that is enrolled already is not provisioned again,
+// and pre-issued credentials for another device are rejected
+func (srv *Service) ApplyProvisioning(bundle *ProvisioningBundle) error {
+	srv.settingsLock.Lock()
+	defer srv.settingsLock.Unlock()
+
+	if _, err := os.Stat(srv.Settings.CredentialsPath); err == nil {
+		return ErrAlreadyEnrolled
+	}
+	if bundle.Enrollment != nil {
+		if err := srv.checkBundleDevice(bundle); err != nil {
+			return err
+		}
+	}
+
+	settings := *srv.Settings
+	settings.IdentityURL = bundle.IdentityURL
+	if err := config.StoreParameters(settings); err != nil {
+		return fmt.Errorf("cannot store the identity service URL: %v", err)
+	}
+	srv.Settings.IdentityURL = bundle.IdentityURL
+
+	if bundle.Enrollment == nil {
+		return nil
+	}
+	if err := srv.storeCredentials(*bundle.Enrollment); err != nil {
+		return fmt.Errorf("cannot store the provisioned credentials: %v", err)
+	}
+	if len(bundle.Enrollment.DeviceData) != 0 {
+		return storeDeviceData(bundle.Enrollment.DeviceData)
+	}
+	return nil
+}
+
+// checkBundleDevice verifies that the pre-issued credentials are for this device: the machine id of
+// the bundle, if set, or else the serial, brand and model of the enrollment must match the device
+func (srv *Service) checkBundleDevice(bundle *ProvisioningBundle) error {
+	if len(bundle.MachineID) > 0 {
+		id, err := machineID()
+		if err != nil {
+			return err
+		}
+		if id != bundle.MachineID {
+			return fmt.Errorf("%w: machine id %s", ErrOtherDevice, bundle.MachineID)
+		}
+		return nil
+	}
+
+	device, err := serialDevice(srv.Snapd)
+	if err != nil {
+		return err
+	}
+	target := bundle.Enrollment.Device
+	if target.SerialNumber != device.SerialNumber ||
+		(len(target.Brand) > 0 && target.Brand != device.Brand) ||
+		(len(target.Model) > 0 && target.Model != device.Model) {
+		return fmt.Errorf("%w: serial %s", ErrOtherDevice, target.SerialNumber)
+	}
+	return nil
+}
+
+// serialDevice returns the brand, model and serial of the device from its serial assertion
+var serialDevice = func(snapd snapdapi.SnapdClient) (domain.Device, error) {
+	serials, err := snapd.Known(asserts.SerialType.Name, map[string]string{})
+	if err != nil {
+		return domain.Device{}, fmt.Errorf("cannot get the serial assertion of the device: %v", err)
+	}
+	if len(serials) == 0 {
+		return domain.Device{}, fmt.Errorf("cannot get the serial assertion of the device: the device has no serial")
+	}
+	return domain.Device{
+		Brand:        serials[0].HeaderString("brand-id"),
+		Model:        serials[0].HeaderString("model"),
+		SerialNumber: serials[0].HeaderString("serial"),
+	}, nil
+}
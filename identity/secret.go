@@ -0,0 +1,230 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Version of the encrypted credentials file
+const secretVersion = 1
+
+// secretInfo binds the key and the ciphertext to their use
+const secretInfo = "iot-agent credentials"
+
+// ErrCredentialsTampered is the error when the credentials file fails the integrity check,
+// e.g. because it was modified or encrypted with another key
+var ErrCredentialsTampered = errors.New("the credentials file failed the integrity check")
+
+// KeyProvider supplies the secret that the key encrypting the credentials is derived from.
+// A hardware backend, e.g. a TPM or secure element, can replace the default provider
+type KeyProvider interface {
+	Key() ([]byte, error)
+}
+
+// PlaintextMigrator is implemented by the key providers that allow reading the plaintext credentials
+// of an earlier version of the agent once, before any credentials were encrypted on the device
+type PlaintextMigrator interface {
+	MigratePlaintext() bool
+}
+
+// keySize is the size of the random key in the key file
+const keySize = 32
+
+// FileKeyProvider derives the secret from a random key file in $SNAP_DATA, which is created on
+// first use and is only readable by the agent, and the machine id, which binds it to the device
+type FileKeyProvider struct {
+	Path string
+
+	lock    sync.Mutex
+	key     []byte
+	created bool
+}
+
+// NewFileKeyProvider creates the default key provider
+func NewFileKeyProvider(path string) *FileKeyProvider {
+	return &FileKeyProvider{Path: path}
+}
+
+// Key returns the secret from the key file and the machine id, creating the key file when it does
+// not exist. A key file that is invalid, e.g. truncated, is replaced, so the stored credentials fail
+// the integrity check and the device enrolls again
+func (p *FileKeyProvider) Key() ([]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.key != nil {
+		return p.key, nil
+	}
+
+	key, err := ioutil.ReadFile(p.Path)
+	if err == nil && len(key) != keySize {
+		log.Printf("The credentials key file %s is invalid, so replace it", p.Path)
+		if err = os.Remove(p.Path); err == nil {
+			key, _, err = createKeyFile(p.Path)
+		}
+	} else if os.IsNotExist(err) {
+		key, p.created, err = createKeyFile(p.Path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the credentials key: %v", err)
+	}
+
+	id, err := machineID()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the machine id for the credentials key: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("machine-id=" + id))
+	p.key = mac.Sum(nil)
+	return p.key, nil
+}
+
+// MigratePlaintext allows reading plaintext credentials once, when the key file did not exist
+// before this start of the agent, i.e. no credentials were encrypted on the device yet
+func (p *FileKeyProvider) MigratePlaintext() bool {
+	if _, err := p.Key(); err != nil {
+		return false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	migrate := p.created
+	p.created = false
+	return migrate
+}
+
+// createKeyFile writes a new random key file. The key is written to a temporary file that is
+// linked into place, so the key file is never partially written and a key file created
+// meanwhile is kept. Created is false when the key file was created meanwhile
+func createKeyFile(keyPath string) (key []byte, created bool, err error) {
+	key = make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return nil, false, err
+	}
+	tmp := keyPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, key, 0600); err != nil {
+		return nil, false, err
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Link(tmp, keyPath); err != nil {
+		if os.IsExist(err) {
+			key, err = ioutil.ReadFile(keyPath)
+			return key, false, err
+		}
+		return nil, false, err
+	}
+	return key, true, nil
+}
+
+// secretFile is the encrypted credentials file. AES-256-GCM authenticates the
+// ciphertext, so a modified file fails to decrypt
+type secretFile struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// encryptSecret encrypts the data with a key derived from the provider's secret and a new salt
+func encryptSecret(keys KeyProvider, data []byte) ([]byte, error) {
+	s := secretFile{Version: secretVersion, Salt: make([]byte, 32)}
+	if _, err := io.ReadFull(rand.Reader, s.Salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := secretCipher(keys, s.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, s.Nonce); err != nil {
+		return nil, err
+	}
+	s.Ciphertext = aead.Seal(nil, s.Nonce, data, []byte(secretInfo))
+	return json.Marshal(&s)
+}
+
+// decryptSecret decrypts an encrypted credentials file. Encrypted is false for a file that is
+// not encrypted, i.e. one written by an earlier version of the agent, which is only accepted
+// when the key provider allows migrating it. Otherwise it fails the integrity check, so
+// plaintext credentials cannot replace the encrypted ones
+func decryptSecret(keys KeyProvider, data []byte) (plaintext []byte, encrypted bool, err error) {
+	s := secretFile{}
+	if err := json.Unmarshal(data, &s); err != nil || s.Version == 0 || s.Ciphertext == nil {
+		if migrator, ok := keys.(PlaintextMigrator); ok && migrator.MigratePlaintext() {
+			return data, false, nil
+		}
+		return nil, false, ErrCredentialsTampered
+	}
+	if s.Version != secretVersion {
+		return nil, true, fmt.Errorf("unsupported credentials file version: %d", s.Version)
+	}
+
+	aead, err := secretCipher(keys, s.Salt)
+	if err != nil {
+		return nil, true, err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return nil, true, ErrCredentialsTampered
+	}
+
+	plaintext, err = aead.Open(nil, s.Nonce, s.Ciphertext, []byte(secretInfo))
+	if err != nil {
+		return nil, true, ErrCredentialsTampered
+	}
+	return plaintext, true, nil
+}
+
+// secretCipher derives the AES-256 key from the provider's secret and the salt
+func secretCipher(keys KeyProvider, salt []byte) (cipher.AEAD, error) {
+	secret, err := keys.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(salt)
+	mac.Write([]byte(secretInfo))
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
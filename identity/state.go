@@ -0,0 +1,105 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package identity
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// EnrollmentState is the state of the enrollment with the identity service
+type EnrollmentState string
+
+// Enrollment states
+const (
+	StateUnenrolled EnrollmentState = "unenrolled"
+	StateEnrolling  EnrollmentState = "enrolling"
+	StateEnrolled   EnrollmentState = "enrolled"
+	StateFailed     EnrollmentState = "failed"
+)
+
+// StateEvent is a change of the enrollment state. A failed enrollment has the error, whether
+// it is permanent, and the time of the next attempt
+type StateEvent struct {
+	Attempts    int
+	Error       error
+	NextAttempt time.Time
+	Permanent   bool
+	State       EnrollmentState
+	Timestamp   time.Time
+}
+
+// StateHandler is called on every change of the enrollment state
+type StateHandler func(event StateEvent)
+
+var stateLock sync.RWMutex
+var stateHandlers []*StateHandler
+var currentState = StateEvent{State: StateUnenrolled}
+
+// AddStateHandler adds a handler for the enrollment state changes, e.g. to publish them locally,
+// and returns the func that removes it
+func AddStateHandler(handler StateHandler) (remove func()) {
+	h := &handler
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	stateHandlers = append(stateHandlers, h)
+
+	return func() {
+		stateLock.Lock()
+		defer stateLock.Unlock()
+		for i, registered := range stateHandlers {
+			if registered == h {
+				// The handlers are called from a copy of the slice, so it is not changed in place
+				stateHandlers = append(stateHandlers[:i:i], stateHandlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// CurrentState returns the latest enrollment state
+func CurrentState() StateEvent {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	return currentState
+}
+
+// SetState logs the enrollment state change and passes it to the handlers
+func SetState(event StateEvent) {
+	event.Timestamp = time.Now().UTC()
+	switch {
+	case event.Error != nil && event.Permanent:
+		log.Printf("Enrollment %s permanently after %d attempts, next attempt at %s: %v", event.State, event.Attempts, event.NextAttempt.Format(time.RFC3339), event.Error)
+	case event.Error != nil:
+		log.Printf("Enrollment %s after %d attempts, next attempt at %s: %v", event.State, event.Attempts, event.NextAttempt.Format(time.RFC3339), event.Error)
+	default:
+		log.Printf("Enrollment %s", event.State)
+	}
+
+	stateLock.Lock()
+	currentState = event
+	handlers := stateHandlers
+	stateLock.Unlock()
+
+	for _, handler := range handlers {
+		(*handler)(event)
+	}
+}
@@ -21,18 +21,40 @@ package identity
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/everactive/iot-identity/domain"
 	"io/ioutil"
+	"log"
+	"os"
 )
 
-// storeCredentials caches the serialized enrollment details
+// storeCredentials caches the serialized enrollment details, encrypted. The file is replaced
+// atomically, so renewed credentials never leave a partial file
 func (srv *Service) storeCredentials(enroll domain.Enrollment) error {
-	data, err := json.Marshal(&enroll)
+	plaintext, err := json.Marshal(&enroll)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	return ioutil.WriteFile(srv.Settings.CredentialsPath, data, 0600)
+	data, err := encryptSecret(srv.Keys, plaintext)
+	if err != nil {
+		return fmt.Errorf("cannot encrypt the credentials: %v", err)
+	}
+
+	tmp := srv.Settings.CredentialsPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, srv.Settings.CredentialsPath); err != nil {
+		return err
+	}
+
+	// The credentials are encrypted now, so plaintext credentials are not migrated later
+	if migrator, ok := srv.Keys.(PlaintextMigrator); ok {
+		migrator.MigratePlaintext()
+	}
+	return nil
 }
 
 // getCredentials fetches the cached enrollment details
@@ -44,11 +66,87 @@ func (srv *Service) getCredentials() (*domain.Enrollment, error) {
 
 	// Read the credentials from the filesystem
 	data, err := ioutil.ReadFile(srv.Settings.CredentialsPath)
+	if os.IsNotExist(err) && restorePreviousCredentials(srv.Settings.CredentialsPath) == nil {
+		data, err = ioutil.ReadFile(srv.Settings.CredentialsPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, encrypted, err := decryptSecret(srv.Keys, data)
 	if err != nil {
 		return nil, err
 	}
 
 	// Deserialize the credentials
-	err = json.Unmarshal(data, enroll)
-	return enroll, err
+	if err = json.Unmarshal(plaintext, enroll); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCredentialsCorrupt, err)
+	}
+
+	// Credentials stored by an earlier version of the agent are encrypted now
+	if !encrypted {
+		if err := srv.storeCredentials(*enroll); err != nil {
+			log.Printf("Error encrypting the stored credentials: %v", err)
+		} else {
+			log.Println("Encrypted the stored credentials")
+		}
+	}
+	return enroll, nil
+}
+
+// errCredentialsCorrupt is the error when the decrypted credentials cannot be parsed
+var errCredentialsCorrupt = errors.New("the credentials file is corrupt")
+
+// setAsideInvalidCredentials moves the credentials that cannot be read back aside, so the device
+// enrolls again and the file is kept to investigate
+func (srv *Service) setAsideInvalidCredentials() error {
+	srv.settingsLock.Lock()
+	defer srv.settingsLock.Unlock()
+
+	invalid := srv.Settings.CredentialsPath + ".invalid"
+	if err := os.Rename(srv.Settings.CredentialsPath, invalid); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Printf("Moved the invalid credentials to %s", invalid)
+	return nil
+}
+
+// Reenroll enrolls the device again, e.g. after the broker rejected the credentials. The stored
+// credentials are moved aside while enrolling and are only replaced when the enrollment succeeds,
+// so a failed enrollment restores them
+func (srv *Service) Reenroll() (*domain.Enrollment, error) {
+	srv.settingsLock.Lock()
+	defer srv.settingsLock.Unlock()
+
+	previous := previousCredentialsPath(srv.Settings.CredentialsPath)
+	if err := os.Rename(srv.Settings.CredentialsPath, previous); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	enroll, err := srv.enroll()
+	if err != nil {
+		if restoreErr := os.Rename(previous, srv.Settings.CredentialsPath); restoreErr != nil && !os.IsNotExist(restoreErr) {
+			log.Printf("Error restoring the stored credentials: %v", restoreErr)
+		}
+		return nil, err
+	}
+
+	_ = os.Remove(previous)
+	log.Println("Replaced the stored credentials")
+	return enroll, nil
+}
+
+// restorePreviousCredentials restores the credentials that were moved aside by an enrollment
+// that did not finish, e.g. because the agent stopped
+func restorePreviousCredentials(credentialsPath string) error {
+	err := os.Rename(previousCredentialsPath(credentialsPath), credentialsPath)
+	if err == nil {
+		log.Println("Restored the stored credentials")
+	}
+	return err
+}
+
+// previousCredentialsPath is the file holding the credentials while enrolling again
+func previousCredentialsPath(credentialsPath string) string {
+	return credentialsPath + ".previous"
 }
@@ -0,0 +1,79 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// MQTT 5 CONNACK reason codes that refuse the credentials
+const (
+	connackBadUsernameOrPassword   = 0x86
+	connackNotAuthorized           = 0x87
+	connackBanned                  = 0x8A
+	connackBadAuthenticationMethod = 0x8C
+)
+
+// ErrNotAuthorized is the error when the broker refuses the connection because of the credentials
+var ErrNotAuthorized = errors.New("the MQTT broker rejected the credentials")
+
+// The TLS alerts a broker sends when it rejects the client certificate, e.g. when it is revoked
+var authAlerts = []string{
+	"bad certificate",
+	"unsupported certificate",
+	"revoked certificate",
+	"expired certificate",
+	"unknown certificate",
+	"unknown certificate authority",
+	"certificate required",
+	"access denied",
+}
+
+// IsAuthError returns whether the broker refused the connection because of the credentials of the device,
+// either in the TLS handshake or in the CONNACK. The errors of verifying the broker certificate are not
+// included, as they are not caused by the device's credentials
+func IsAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrNotAuthorized) || errors.Is(err, packets.ErrorRefusedNotAuthorised) || errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword) {
+		return true
+	}
+
+	msg := err.Error()
+	for _, alert := range authAlerts {
+		if strings.Contains(msg, "remote error: tls: "+alert) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthReasonCode returns whether an MQTT 5 CONNACK reason code refuses the credentials
+func isAuthReasonCode(code byte) bool {
+	switch code {
+	case connackBadUsernameOrPassword, connackNotAuthorized, connackBanned, connackBadAuthenticationMethod:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+	"golang.org/x/net/proxy"
+
+	"github.com/everactive/iot-agent/pkg/config"
+	"github.com/everactive/iot-agent/snapdapi"
+)
+
+// ProxyNone disables the proxy, including the snapd system proxy settings
+const ProxyNone = "none"
+
+// dialTimeout limits connecting to the broker, including the proxy and TLS handshake
+const dialTimeout = 30 * time.Second
+
+// Dialer opens the connections to the brokers, through the proxy from the agent config
+// or the snapd system proxy settings
+type Dialer struct {
+	Snapd snapdapi.SnapdClient
+}
+
+// NewDialer creates a dialer that reads the system proxy settings with the snapd client
+func NewDialer(snapd snapdapi.SnapdClient) *Dialer {
+	return &Dialer{Snapd: snapd}
+}
+
+// openConnection opens the connection to a broker, through the proxy for the broker host
+func (d *Dialer) openConnection(e *Endpoint, tlsConfig *tls.Config) (net.Conn, error) {
+	proxyURL, err := d.brokerProxy(e.Host)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		log.Printf("Connect to the MQTT broker %s through the proxy %s", e, proxyURL.Redacted())
+	}
+	return dialBroker(e, tlsConfig, proxyURL)
+}
+
+// dialBroker opens the connection to a broker, through the proxy if there is one.
+// A WebSocket broker is upgraded over TLS, otherwise TLS runs directly on the connection
+func dialBroker(e *Endpoint, tlsConfig *tls.Config, proxyURL *url.URL) (net.Conn, error) {
+	if e.Scheme == SchemeWSS {
+		return MQTT.NewWebsocket(e.URL(), tlsConfig, dialTimeout, nil, &MQTT.WebsocketOptions{
+			Proxy: func(*http.Request) (*url.URL, error) { return proxyURL, nil },
+		})
+	}
+
+	conn, err := dialProxy(proxyURL, net.JoinHostPort(e.Host, e.Port), dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	_ = tlsConn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// dialProxy opens a TCP connection to the address, through an HTTP CONNECT or SOCKS5 proxy
+func dialProxy(proxyURL *url.URL, address string, timeout time.Duration) (net.Conn, error) {
+	if proxyURL == nil {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(proxyURL, &net.Dialer{Timeout: timeout})
+		if err != nil {
+			return nil, err
+		}
+		return dialer.Dial("tcp", address)
+	case "http", "https":
+		return dialHTTPConnect(proxyURL, address, timeout)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+}
+
+// dialHTTPConnect opens a tunnel to the address with an HTTP CONNECT request
+func dialHTTPConnect(proxyURL *url.URL, address string, timeout time.Duration) (net.Conn, error) {
+	proxyAddress := proxyURL.Host
+	if len(proxyURL.Port()) == 0 {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	conn, err := net.DialTimeout("tcp", proxyAddress, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), MinVersion: tls.VersionTLS12})
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy refused the connection to %s: %s", address, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the data the proxy sent after its response first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// brokerProxy returns the proxy to connect to a broker host, or nil to connect directly.
+// The agent config takes precedence over the snapd system proxy settings
+func (d *Dialer) brokerProxy(host string) (*url.URL, error) {
+	if configured := viper.GetString(config.MQTTProxyKey); len(configured) > 0 {
+		if configured == ProxyNone {
+			return nil, nil
+		}
+		return parseProxy(configured)
+	}
+	if d.Snapd == nil {
+		return nil, nil
+	}
+
+	conf, err := d.Snapd.Conf("system")
+	if err != nil {
+		log.Printf("Error getting the system proxy settings: %v", err)
+		return nil, nil
+	}
+	settings, _ := conf["proxy"].(map[string]interface{})
+	if noProxy, _ := settings["no-proxy"].(string); excluded(host, noProxy) {
+		return nil, nil
+	}
+	for _, key := range []string{"https", "http"} {
+		if p, _ := settings[key].(string); len(p) > 0 {
+			return parseProxy(p)
+		}
+	}
+	return nil, nil
+}
+
+// parseProxy parses a proxy URL, which is an HTTP proxy when it has no scheme
+func parseProxy(p string) (*url.URL, error) {
+	if !strings.Contains(p, "://") {
+		p = "http://" + p
+	}
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy `%s`: %v", p, err)
+	}
+	return u, nil
+}
+
+// excluded returns whether the host matches the comma-separated no-proxy list of
+// hosts and domains, e.g. "localhost,.example.com"
+func excluded(host, noProxy string) bool {
+	for _, h := range strings.Split(noProxy, ",") {
+		h = strings.TrimSpace(h)
+		switch {
+		case len(h) == 0:
+		case h == "*":
+			return true
+		case strings.HasPrefix(h, "."):
+			if strings.HasSuffix(host, h) || host == h[1:] {
+				return true
+			}
+		case host == h || strings.HasSuffix(host, "."+h):
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
+	"github.com/everactive/iot-agent/snapdapi"
+)
+
+// proxySnapd returns the snapd system proxy settings
+type proxySnapd struct {
+	snapdapi.MockClient
+	settings map[string]interface{}
+}
+
+func (c *proxySnapd) Conf(name string) (map[string]interface{}, error) {
+	return map[string]interface{}{"proxy": c.settings}, nil
+}
+
+// connectProxy is an HTTP CONNECT proxy that tunnels to any address
+func connectProxy(t *testing.T, authorization string) (*url.URL, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	requested := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				requested <- req.Host
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != authorization {
+					_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() { _, _ = io.Copy(target, br) }()
+				_, _ = io.Copy(conn, target)
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}, requested
+}
+
+// echoServer echoes the first line it receives
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			_, _ = io.WriteString(conn, line)
+			_ = conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestDialProxy_HTTPConnect(t *testing.T) {
+	target := echoServer(t)
+
+	tests := []struct {
+		name    string
+		user    *url.Userinfo
+		auth    string
+		wantErr bool
+	}{
+		{"valid", nil, "", false},
+		{"valid-auth", url.UserPassword("agent", "secret"), "Basic YWdlbnQ6c2VjcmV0", false},
+		{"invalid-auth", url.UserPassword("agent", "wrong"), "Basic YWdlbnQ6c2VjcmV0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyURL, requested := connectProxy(t, tt.auth)
+			proxyURL.User = tt.user
+
+			conn, err := dialProxy(proxyURL, target, dialTimeout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialProxy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := <-requested; got != target {
+				t.Errorf("dialProxy() requested %s, want %s", got, target)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = io.WriteString(conn, "hello\n")
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || line != "hello\n" {
+				t.Errorf("dialProxy() tunnel got %q, %v", line, err)
+			}
+		})
+	}
+}
+
+func TestDialProxy_Unsupported(t *testing.T) {
+	if _, err := dialProxy(&url.URL{Scheme: "ftp", Host: "proxy:21"}, "mqtt.example.com:8883", dialTimeout); err == nil {
+		t.Error("dialProxy() expected an error for an unsupported scheme")
+	}
+}
+
+func TestBrokerProxy(t *testing.T) {
+	defer viper.Set(config.MQTTProxyKey, "")
+
+	tests := []struct {
+		name       string
+		configured string
+		settings   map[string]interface{}
+		host       string
+		want       string
+	}{
+		{"none", "", nil, "mqtt.example.com", ""},
+		{"system-https", "", map[string]interface{}{"https": "http://proxy:3128", "http": "http://other:3128"}, "mqtt.example.com", "http://proxy:3128"},
+		{"system-http", "", map[string]interface{}{"http": "proxy:3128"}, "mqtt.example.com", "http://proxy:3128"},
+		{"system-no-proxy", "", map[string]interface{}{"https": "http://proxy:3128", "no-proxy": "localhost,.example.com"}, "mqtt.example.com", ""},
+		{"system-no-proxy-other", "", map[string]interface{}{"https": "http://proxy:3128", "no-proxy": "localhost,.example.com"}, "mqtt.example.org", "http://proxy:3128"},
+		{"config", "socks5://proxy:1080", map[string]interface{}{"https": "http://proxy:3128"}, "mqtt.example.com", "socks5://proxy:1080"},
+		{"config-none", ProxyNone, map[string]interface{}{"https": "http://proxy:3128"}, "mqtt.example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set(config.MQTTProxyKey, tt.configured)
+			d := NewDialer(&proxySnapd{settings: tt.settings})
+
+			got, err := d.brokerProxy(tt.host)
+			if err != nil {
+				t.Fatalf("brokerProxy() error = %v", err)
+			}
+			if (got == nil && len(tt.want) > 0) || (got != nil && got.String() != tt.want) {
+				t.Errorf("brokerProxy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
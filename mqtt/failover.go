@@ -0,0 +1,502 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Timings for the broker failover
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 2 * time.Minute
+	failurePenalty    = time.Minute
+	maxFailurePenalty = 10 * time.Minute
+	switchQuiesce     = 250
+)
+
+// ErrNotConnected is the error when there is no connection to a broker
+var ErrNotConnected = errors.New("not connected to an MQTT broker")
+
+// Broker URL schemes
+const (
+	SchemeSSL = "ssl"
+	SchemeWSS = "wss"
+)
+
+// defaultWebSocketPort is the port of a `wss://` broker without one
+const defaultWebSocketPort = "443"
+
+// Endpoint is a broker address
+type Endpoint struct {
+	Scheme string
+	Host   string
+	Port   string
+	// Path is the path of a WebSocket broker, e.g. /mqtt
+	Path string
+
+	failures    int
+	lastFailure time.Time
+}
+
+func (e *Endpoint) String() string {
+	if e.Scheme == SchemeWSS {
+		return e.URL()
+	}
+	return net.JoinHostPort(e.Host, e.Port)
+}
+
+// URL returns the broker URL, e.g. ssl://host:8883 or wss://host:443/mqtt
+func (e *Endpoint) URL() string {
+	scheme := e.Scheme
+	if len(scheme) == 0 {
+		scheme = SchemeSSL
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(e.Host, e.Port), e.Path)
+}
+
+// healthy is false for an endpoint that failed recently. The more consecutive
+// failures, the longer it is avoided
+func (e *Endpoint) healthy(now time.Time) bool {
+	if e.failures == 0 {
+		return true
+	}
+
+	penalty := time.Duration(e.failures) * failurePenalty
+	if penalty > maxFailurePenalty {
+		penalty = maxFailurePenalty
+	}
+	return now.Sub(e.lastFailure) > penalty
+}
+
+// ParseEndpoints parses a comma-separated list of brokers, each `host`, `host:port`
+// or a URL: `ssl://host:port` or `wss://host[:port][/path]`
+func ParseEndpoints(list, defaultPort string) []*Endpoint {
+	var endpoints []*Endpoint
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if len(address) == 0 {
+			continue
+		}
+
+		e := &Endpoint{Scheme: SchemeSSL}
+		port := defaultPort
+		if u, err := url.Parse(address); err == nil && len(u.Host) > 0 {
+			switch u.Scheme {
+			case SchemeWSS, "https":
+				e.Scheme, e.Path = SchemeWSS, u.Path
+				port = defaultWebSocketPort
+			case SchemeSSL, "tls", "mqtts":
+			default:
+				log.Printf("Ignoring the MQTT broker `%s`: unsupported scheme", address)
+				continue
+			}
+			address = u.Host
+		}
+
+		host, p, err := net.SplitHostPort(address)
+		if err != nil {
+			host, p = address, port
+		}
+		e.Host, e.Port = strings.Trim(host, "[]"), p
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
+
+// endpointClientFactory creates a client for a single connection to a broker. The client
+// must not reconnect by itself, but report a lost connection to the handler
+type endpointClientFactory func(endpoint *Endpoint, onConnectionLost MQTT.ConnectionLostHandler) MQTT.Client
+
+// subscription is a subscription to restore after connecting to a broker
+type subscription struct {
+	qos      byte
+	callback MQTT.MessageHandler
+}
+
+// failoverClient connects to an ordered list of brokers. It prefers the first healthy
+// broker, fails over when the connection is lost and fails back to a preferred broker
+// when it recovers. The subscriptions are kept across connections
+type failoverClient struct {
+	mu               sync.RWMutex
+	endpoints        []*Endpoint
+	newClient        endpointClientFactory
+	onConnect        MQTT.OnConnectHandler
+	failbackInterval time.Duration
+	maxDelay         time.Duration
+	states           *stateHandlers
+
+	current       MQTT.Client
+	endpoint      *Endpoint
+	subscriptions map[string]subscription
+	closing       bool
+	reconnecting  bool
+	stop          chan struct{}
+}
+
+func newFailoverClient(endpoints []*Endpoint, newClient endpointClientFactory, onConnect MQTT.OnConnectHandler, failbackInterval time.Duration, states *stateHandlers) *failoverClient {
+	return &failoverClient{
+		endpoints:        endpoints,
+		newClient:        newClient,
+		onConnect:        onConnect,
+		failbackInterval: failbackInterval,
+		maxDelay:         maxReconnectDelay,
+		states:           states,
+		subscriptions:    map[string]subscription{},
+	}
+}
+
+// CurrentBroker returns the address of the connected broker
+func (c *failoverClient) CurrentBroker() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.endpoint == nil || c.current == nil || !c.current.IsConnectionOpen() {
+		return ""
+	}
+	return c.endpoint.String()
+}
+
+// IsConnected returns whether the client is connected, or is reconnecting
+func (c *failoverClient) IsConnected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current != nil && c.current.IsConnectionOpen() || c.reconnecting
+}
+
+// IsConnectionOpen returns whether the client has a live connection to a broker
+func (c *failoverClient) IsConnectionOpen() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current != nil && c.current.IsConnectionOpen()
+}
+
+// Connect connects to the preferred broker that is available
+func (c *failoverClient) Connect() MQTT.Token {
+	c.mu.Lock()
+	c.closing = false
+	if c.stop == nil {
+		c.stop = make(chan struct{})
+		go c.failback(c.stop)
+	}
+	c.mu.Unlock()
+
+	return runToken(c.connect)
+}
+
+// connect tries the brokers in order of preference until one accepts the connection
+func (c *failoverClient) connect() error {
+	var err error
+	for _, e := range c.preferred() {
+		if err = c.connectTo(e); err == nil {
+			return nil
+		}
+		log.Printf("Error connecting to the MQTT broker %s: %v", e, err)
+	}
+	return err
+}
+
+// connectTo connects to a broker and makes it the current connection
+func (c *failoverClient) connectTo(e *Endpoint) error {
+	cli := c.newClient(e, c.connectionLost)
+	if token := cli.Connect(); token.Wait() && token.Error() != nil {
+		c.failed(e)
+		if IsAuthError(token.Error()) {
+			c.states.changed(StateAuthFailed, e.String(), token.Error())
+		}
+		return token.Error()
+	}
+
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		cli.Disconnect(0)
+		return ErrNotConnected
+	}
+	previous := c.current
+	c.current = cli
+	c.endpoint = e
+	e.failures = 0
+	subscriptions := map[string]subscription{}
+	for topic, s := range c.subscriptions {
+		subscriptions[topic] = s
+	}
+	c.mu.Unlock()
+
+	c.states.changed(StateConnected, e.String(), nil)
+
+	// The connection replaces any connection to a less preferred broker
+	if previous != nil {
+		previous.Disconnect(switchQuiesce)
+	}
+
+	// The session can be new, e.g. on another broker, so the subscriptions are restored
+	for topic, s := range subscriptions {
+		if token := cli.Subscribe(topic, s.qos, c.route(s.callback)); token.Wait() && token.Error() != nil {
+			log.Printf("Error restoring the subscription to `%s`: %v", topic, token.Error())
+		}
+	}
+
+	if c.onConnect != nil {
+		go c.onConnect(c)
+	}
+	return nil
+}
+
+// connectionLost fails over to the next broker, retrying with backoff until connected
+func (c *failoverClient) connectionLost(cli MQTT.Client, err error) {
+	c.mu.Lock()
+	if cli != c.current || c.closing || c.reconnecting {
+		// A replaced connection, or one that is already being recovered
+		c.mu.Unlock()
+		return
+	}
+	c.reconnecting = true
+	e := c.endpoint
+	c.mu.Unlock()
+
+	c.states.changed(StateConnectionLost, e.String(), err)
+	c.failed(e)
+
+	c.states.changed(StateReconnecting, e.String(), nil)
+	delay := minReconnectDelay
+	for {
+		c.mu.RLock()
+		closing := c.closing
+		c.mu.RUnlock()
+		if closing {
+			break
+		}
+
+		if err := c.connect(); err == nil {
+			break
+		}
+
+		time.Sleep(jitter(delay))
+		delay *= 2
+		if delay > c.maxDelay {
+			delay = c.maxDelay
+		}
+	}
+
+	c.mu.Lock()
+	c.reconnecting = false
+	c.mu.Unlock()
+}
+
+// failback periodically moves the connection back to a more preferred broker that has recovered
+func (c *failoverClient) failback(stop chan struct{}) {
+	if c.failbackInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.failbackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, e := range c.better() {
+			if err := c.connectTo(e); err == nil {
+				log.Printf("Failed back to the MQTT broker %s", e)
+				break
+			}
+		}
+	}
+}
+
+// preferred returns the brokers in order of preference: the healthy brokers in the
+// configured order, then the brokers that failed recently
+func (c *failoverClient) preferred() []*Endpoint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	var healthy, unhealthy []*Endpoint
+	for _, e := range c.endpoints {
+		if e.healthy(now) {
+			healthy = append(healthy, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// better returns the healthy brokers that are preferred to the connected broker
+func (c *failoverClient) better() []*Endpoint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.current == nil || !c.current.IsConnectionOpen() || c.reconnecting {
+		return nil
+	}
+
+	now := time.Now()
+	var better []*Endpoint
+	for _, e := range c.endpoints {
+		if e == c.endpoint {
+			break
+		}
+		if e.healthy(now) {
+			better = append(better, e)
+		}
+	}
+	return better
+}
+
+func (c *failoverClient) failed(e *Endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.failures++
+	e.lastFailure = time.Now()
+}
+
+// Disconnect closes the connection and stops failing over
+func (c *failoverClient) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	cli := c.current
+	e := c.endpoint
+	c.closing = true
+	c.current = nil
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.mu.Unlock()
+
+	if cli != nil {
+		cli.Disconnect(quiesce)
+		c.states.changed(StateDisconnected, e.String(), nil)
+	}
+}
+
+// jitter randomizes a reconnect delay to between half and all of it, so that devices
+// that lost the broker at the same time do not all reconnect at the same time
+func jitter(delay time.Duration) time.Duration {
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Publish publishes a message on the current connection
+func (c *failoverClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	return c.PublishWithProperties(topic, qos, retained, payload, nil)
+}
+
+// PublishWithProperties publishes a message on the current connection, with the MQTT 5 properties if supported
+func (c *failoverClient) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *MessageProperties) MQTT.Token {
+	cli, err := c.client()
+	if err != nil {
+		return runToken(func() error { return err })
+	}
+	return Publish(cli, topic, qos, retained, payload, props)
+}
+
+// Subscribe subscribes to a topic, and restores the subscription after a reconnect
+func (c *failoverClient) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple subscribes to the topics, and restores the subscriptions after a reconnect
+func (c *failoverClient) SubscribeMultiple(filters map[string]byte, callback MQTT.MessageHandler) MQTT.Token {
+	c.mu.Lock()
+	for topic, qos := range filters {
+		c.subscriptions[topic] = subscription{qos: qos, callback: callback}
+	}
+	c.mu.Unlock()
+
+	cli, err := c.client()
+	if err != nil {
+		return runToken(func() error { return err })
+	}
+	return cli.SubscribeMultiple(filters, c.route(callback))
+}
+
+// Unsubscribe removes the subscriptions to the topics
+func (c *failoverClient) Unsubscribe(topics ...string) MQTT.Token {
+	c.mu.Lock()
+	for _, topic := range topics {
+		delete(c.subscriptions, topic)
+	}
+	c.mu.Unlock()
+
+	cli, err := c.client()
+	if err != nil {
+		return runToken(func() error { return err })
+	}
+	return cli.Unsubscribe(topics...)
+}
+
+// AddRoute adds a handler for messages on a topic without subscribing
+func (c *failoverClient) AddRoute(topic string, callback MQTT.MessageHandler) {
+	if cli, err := c.client(); err == nil {
+		cli.AddRoute(topic, c.route(callback))
+	}
+}
+
+// OptionsReader returns the options of the current connection
+func (c *failoverClient) OptionsReader() MQTT.ClientOptionsReader {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.current == nil {
+		return MQTT.NewClient(MQTT.NewClientOptions()).OptionsReader()
+	}
+	return c.current.OptionsReader()
+}
+
+// route passes the failover client to the handler, so it replies on whichever connection is current
+func (c *failoverClient) route(callback MQTT.MessageHandler) MQTT.MessageHandler {
+	return func(_ MQTT.Client, msg MQTT.Message) {
+		callback(c, msg)
+	}
+}
+
+func (c *failoverClient) client() (MQTT.Client, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.current == nil {
+		return nil, ErrNotConnected
+	}
+	return c.current, nil
+}
+
+// brokerEndpoints returns the brokers from the local config, or else from the enrollment.
+// The enrollment broker URL can be a comma-separated list
+func brokerEndpoints(configured, mqttURL, mqttPort string) ([]*Endpoint, error) {
+	endpoints := ParseEndpoints(configured, mqttPort)
+	if len(endpoints) == 0 {
+		endpoints = ParseEndpoints(mqttURL, mqttPort)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no MQTT broker in the enrollment or config")
+	}
+	return endpoints, nil
+}
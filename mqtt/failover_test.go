@@ -0,0 +1,310 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// fakeBrokers is a set of brokers that can be taken down, with a client per connection
+type fakeBrokers struct {
+	mu      sync.Mutex
+	down    map[string]bool
+	refused map[string]error
+	clients []*fakeClient
+}
+
+func (b *fakeBrokers) newClient(e *Endpoint, onConnectionLost MQTT.ConnectionLostHandler) MQTT.Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cli := &fakeClient{MockClient: MockClient{}, brokers: b, address: e.String(), lost: onConnectionLost, subscriptions: map[string]byte{}}
+	b.clients = append(b.clients, cli)
+	return cli
+}
+
+func (b *fakeBrokers) isDown(address string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.down[address]
+}
+
+// drop takes a broker down, dropping the open connection
+func (b *fakeBrokers) drop(address string) {
+	b.mu.Lock()
+	b.down[address] = true
+	clients := append([]*fakeClient{}, b.clients...)
+	b.mu.Unlock()
+
+	for _, cli := range clients {
+		if cli.address == address && cli.IsConnectionOpen() {
+			cli.Disconnect(0)
+			cli.lost(cli, fmt.Errorf("MOCK connection lost"))
+		}
+	}
+}
+
+func (b *fakeBrokers) restore(address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.down, address)
+}
+
+type fakeClient struct {
+	MockClient
+	mu            sync.Mutex
+	brokers       *fakeBrokers
+	address       string
+	lost          MQTT.ConnectionLostHandler
+	subscriptions map[string]byte
+}
+
+func (cli *fakeClient) IsConnected() bool {
+	return cli.IsConnectionOpen()
+}
+
+func (cli *fakeClient) IsConnectionOpen() bool {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	return cli.open
+}
+
+func (cli *fakeClient) Connect() MQTT.Token {
+	if cli.brokers.isDown(cli.address) {
+		return runToken(func() error { return fmt.Errorf("MOCK broker %s down", cli.address) })
+	}
+	if err := cli.brokers.refused[cli.address]; err != nil {
+		return runToken(func() error { return err })
+	}
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	cli.open = true
+	return &MockToken{}
+}
+
+func (cli *fakeClient) Disconnect(quiesce uint) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	cli.open = false
+}
+
+func (cli *fakeClient) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	return cli.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (cli *fakeClient) SubscribeMultiple(filters map[string]byte, callback MQTT.MessageHandler) MQTT.Token {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	for topic, qos := range filters {
+		cli.subscriptions[topic] = qos
+	}
+	return &MockToken{}
+}
+
+func (cli *fakeClient) subscribed() map[string]byte {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	return cli.subscriptions
+}
+
+func waitForBroker(t *testing.T, c *failoverClient, want string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for c.CurrentBroker() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("CurrentBroker: got %s, want %s", c.CurrentBroker(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestParseEndpoints(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"single", "mqtt.example.com", []string{"mqtt.example.com:8883"}},
+		{"multiple", "mqtt1.example.com, mqtt2.example.com:1883,,", []string{"mqtt1.example.com:8883", "mqtt2.example.com:1883"}},
+		{"ipv6", "[::1]:1883", []string{"[::1]:1883"}},
+		{"ssl", "ssl://mqtt.example.com:8884", []string{"mqtt.example.com:8884"}},
+		{"websocket", "wss://mqtt.example.com/mqtt, wss://mqtt.example.com:8443", []string{"wss://mqtt.example.com:443/mqtt", "wss://mqtt.example.com:8443"}},
+		{"unsupported", "tcp://mqtt.example.com:1883", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range ParseEndpoints(tt.list, "8883") {
+				got = append(got, e.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseEndpoints: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBrokerEndpoints(t *testing.T) {
+	endpoints, err := brokerEndpoints("", "mqtt1.example.com,mqtt2.example.com", "8883")
+	if err != nil || len(endpoints) != 2 {
+		t.Errorf("brokerEndpoints: got %v, %v", endpoints, err)
+	}
+
+	endpoints, err = brokerEndpoints("local.example.com", "mqtt1.example.com", "8883")
+	if err != nil || len(endpoints) != 1 || endpoints[0].String() != "local.example.com:8883" {
+		t.Errorf("brokerEndpoints: got %v, %v", endpoints, err)
+	}
+
+	if _, err := brokerEndpoints("", "", "8883"); err == nil {
+		t.Error("brokerEndpoints: expected error, got none")
+	}
+}
+
+func TestFailoverClient(t *testing.T) {
+	brokers := &fakeBrokers{down: map[string]bool{"mqtt1:8883": true}}
+	endpoints := ParseEndpoints("mqtt1,mqtt2,mqtt3", "8883")
+
+	var statesLock sync.Mutex
+	var states []ConnectionState
+	handlers := &stateHandlers{}
+	handlers.add(func(event StateEvent) {
+		statesLock.Lock()
+		defer statesLock.Unlock()
+		states = append(states, event.State)
+	})
+
+	connects := make(chan string, 10)
+	var c *failoverClient
+	c = newFailoverClient(endpoints, brokers.newClient, func(MQTT.Client) { connects <- c.CurrentBroker() }, 10*time.Millisecond, handlers)
+	defer c.Disconnect(0)
+
+	// The first broker is down, so the client connects to the next one
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect: %v", token.Error())
+	}
+	if got := c.CurrentBroker(); got != "mqtt2:8883" {
+		t.Errorf("CurrentBroker: got %s, want mqtt2:8883", got)
+	}
+	if got := <-connects; got != "mqtt2:8883" {
+		t.Errorf("onConnect: got %s, want mqtt2:8883", got)
+	}
+
+	if token := c.Subscribe("devices/sub/a", QOSAtLeastOnce, func(MQTT.Client, MQTT.Message) {}); token.Wait() && token.Error() != nil {
+		t.Fatalf("Subscribe: %v", token.Error())
+	}
+
+	// Losing the connection fails over to the next broker, restoring the subscriptions
+	brokers.drop("mqtt2:8883")
+	waitForBroker(t, c, "mqtt3:8883")
+	<-connects
+
+	cli := c.current.(*fakeClient)
+	if got := cli.subscribed(); got["devices/sub/a"] != QOSAtLeastOnce {
+		t.Errorf("subscriptions: got %v", got)
+	}
+
+	// A preferred broker that recovers is used again, once it is considered healthy
+	brokers.restore("mqtt1:8883")
+	c.mu.Lock()
+	endpoints[0].lastFailure = time.Now().Add(-time.Hour)
+	c.mu.Unlock()
+	waitForBroker(t, c, "mqtt1:8883")
+	if cli.IsConnectionOpen() {
+		t.Error("failback: the previous connection is still open")
+	}
+	if got := c.current.(*fakeClient).subscribed(); got["devices/sub/a"] != QOSAtLeastOnce {
+		t.Errorf("subscriptions: got %v", got)
+	}
+
+	// Nothing to publish to after disconnecting
+	c.Disconnect(0)
+	statesLock.Lock()
+	want := []ConnectionState{StateConnected, StateConnectionLost, StateReconnecting, StateConnected, StateConnected, StateDisconnected}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states: got %v, want %v", states, want)
+	}
+	statesLock.Unlock()
+	if token := c.Publish("devices/pub/a", QOSAtLeastOnce, false, []byte("{}")); token.Wait() && token.Error() != ErrNotConnected {
+		t.Errorf("Publish: got %v, want %v", token.Error(), ErrNotConnected)
+	}
+}
+
+func TestFailoverClient_AuthFailed(t *testing.T) {
+	brokers := &fakeBrokers{down: map[string]bool{"mqtt1:8883": true}, refused: map[string]error{"mqtt2:8883": packets.ErrorRefusedNotAuthorised}}
+	endpoints := ParseEndpoints("mqtt1,mqtt2", "8883")
+
+	var statesLock sync.Mutex
+	var refused []StateEvent
+	handlers := &stateHandlers{}
+	handlers.add(func(event StateEvent) {
+		statesLock.Lock()
+		defer statesLock.Unlock()
+		if event.State == StateAuthFailed {
+			refused = append(refused, event)
+		}
+	})
+
+	c := newFailoverClient(endpoints, brokers.newClient, nil, 0, handlers)
+	defer c.Disconnect(0)
+	if token := c.Connect(); token.Wait() && !IsAuthError(token.Error()) {
+		t.Fatalf("Connect: got %v, want an authentication error", token.Error())
+	}
+
+	// Only the broker that refused the credentials is reported
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	if len(refused) != 1 || refused[0].Broker != "mqtt2:8883" {
+		t.Errorf("auth failures: got %+v", refused)
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"none", nil, false},
+		{"not-authorized", packets.ErrorRefusedNotAuthorised, true},
+		{"bad-password", packets.ErrorRefusedBadUsernameOrPassword, true},
+		{"v5-not-authorized", fmt.Errorf("%w, reason code 135", ErrNotAuthorized), true},
+		{"revoked-certificate", errors.New("remote error: tls: revoked certificate"), true},
+		{"bad-certificate", &net.OpError{Op: "read", Err: errors.New("remote error: tls: bad certificate")}, true},
+		{"broker-certificate", errors.New("tls: failed to verify certificate: x509: certificate signed by unknown authority"), false},
+		{"server-unavailable", packets.ErrorRefusedServerUnavailable, false},
+		{"network", errors.New("dial tcp: connection refused"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsAuthError(tt.err); got != tt.want {
+				t.Errorf("IsAuthError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
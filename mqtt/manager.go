@@ -0,0 +1,152 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"log"
+	"sync"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/everactive/iot-identity/domain"
+)
+
+// closeQuiesce is the time to complete the work in progress when a connection is closed, in milliseconds
+const closeQuiesce = 250
+
+// ClientFactory creates the MQTT client of a new connection for the enrollment
+type ClientFactory func(c *Connection, enroll *domain.Enrollment) (MQTT.Client, error)
+
+// Manager owns the MQTT connections, one for each enrollment. A connection is rebuilt
+// when the credentials of its enrollment change, e.g. after re-enrollment
+type Manager struct {
+	mu          sync.Mutex
+	newClient   ClientFactory
+	connections map[string]*managedConnection
+	meter       *Meter
+	dialer      *Dialer
+	states      stateHandlers
+}
+
+type managedConnection struct {
+	conn       *Connection
+	enrollment domain.Enrollment
+}
+
+// NewManager creates a connection manager. The clients are created by the factory,
+// which defaults to connecting to the brokers with the enrollment credentials through
+// the dialer. The data usage of all the connections is counted by one meter, as they
+// share the link
+func NewManager(newClient ClientFactory, dialer *Dialer) *Manager {
+	if newClient == nil {
+		newClient = newTLSClient
+	}
+	if dialer == nil {
+		dialer = &Dialer{}
+	}
+	return &Manager{
+		newClient:   newClient,
+		connections: map[string]*managedConnection{},
+		meter:       OpenMeter(usagePath()),
+		dialer:      dialer,
+	}
+}
+
+// Connect fetches or creates the connection for the enrollment, and connects to the broker
+func (m *Manager) Connect(enroll *domain.Enrollment) (*Connection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mc, ok := m.connections[enroll.ID]
+	if ok && !sameCredentials(&mc.enrollment, enroll) {
+		log.Printf("The credentials of %s changed, so reconnect to the MQTT broker", enroll.ID)
+		mc.conn.close()
+		delete(m.connections, enroll.ID)
+		ok = false
+	}
+
+	if !ok {
+		conn, err := newConnection(enroll, m.newClient, m.meter, m.dialer, &m.states)
+		if err != nil {
+			return nil, err
+		}
+		mc = &managedConnection{conn: conn, enrollment: *enroll}
+		m.connections[enroll.ID] = mc
+	}
+
+	if err := mc.conn.connect(); err != nil {
+		return nil, err
+	}
+	return mc.conn, nil
+}
+
+// AddStateHandler adds a handler for the state changes of the connections, e.g. to publish
+// them locally, and returns the func that removes it
+func (m *Manager) AddStateHandler(handler StateHandler) (remove func()) {
+	return m.states.add(handler)
+}
+
+// Get returns the connection for the enrollment ID, if there is one
+func (m *Manager) Get(id string) (*Connection, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mc, ok := m.connections[id]
+	if !ok {
+		return nil, false
+	}
+	return mc.conn, true
+}
+
+// Close disconnects and discards the connection for the enrollment ID, so that
+// the next Connect creates a new one
+func (m *Manager) Close(id string) {
+	m.mu.Lock()
+	mc, ok := m.connections[id]
+	delete(m.connections, id)
+	m.mu.Unlock()
+
+	if ok {
+		mc.conn.close()
+	}
+	m.meter.Save()
+}
+
+// CloseAll disconnects and discards all the connections
+func (m *Manager) CloseAll() {
+	m.mu.Lock()
+	connections := m.connections
+	m.connections = map[string]*managedConnection{}
+	m.mu.Unlock()
+
+	for _, mc := range connections {
+		mc.conn.close()
+	}
+	m.meter.Save()
+}
+
+// sameCredentials returns whether a connection for one enrollment can be used for the other
+func sameCredentials(a, b *domain.Enrollment) bool {
+	return a.Organization.ID == b.Organization.ID &&
+		bytes.Equal(a.Organization.RootCert, b.Organization.RootCert) &&
+		a.Credentials.MQTTURL == b.Credentials.MQTTURL &&
+		a.Credentials.MQTTPort == b.Credentials.MQTTPort &&
+		bytes.Equal(a.Credentials.Certificate, b.Credentials.Certificate) &&
+		bytes.Equal(a.Credentials.PrivateKey, b.Credentials.PrivateKey)
+}
@@ -0,0 +1,159 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/everactive/iot-identity/domain"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+func TestManager(t *testing.T) {
+	var clients []*MockClient
+	m := NewManager(func(c *Connection, enroll *domain.Enrollment) (MQTT.Client, error) {
+		if enroll.ID == "invalid" {
+			return nil, fmt.Errorf("MOCK error creating client")
+		}
+		cli := &MockClient{}
+		clients = append(clients, cli)
+		return cli, nil
+	}, nil)
+
+	enroll := &domain.Enrollment{ID: "a111", Organization: domain.Organization{ID: "abc"}, Credentials: domain.Credentials{Certificate: []byte("cert1")}}
+
+	conn, err := m.Connect(enroll)
+	if err != nil || !conn.Client.IsConnectionOpen() {
+		t.Fatalf("Connect() = %v, %v", conn, err)
+	}
+
+	// The connection is reused, and reconnects when the connection was lost
+	clients[0].open = false
+	again, err := m.Connect(enroll)
+	if err != nil || again != conn || len(clients) != 1 || !clients[0].open {
+		t.Errorf("Connect() same credentials = %v, %v, %d clients", again, err, len(clients))
+	}
+
+	// New credentials replace the connection
+	renewed := *enroll
+	renewed.Credentials.Certificate = []byte("cert2")
+	replaced, err := m.Connect(&renewed)
+	if err != nil || replaced == conn || len(clients) != 2 || clients[0].open {
+		t.Errorf("Connect() new credentials = %v, %v, %d clients", replaced, err, len(clients))
+	}
+
+	// Connections for other enrollments are independent
+	other, err := m.Connect(&domain.Enrollment{ID: "b222"})
+	if err != nil || other == replaced {
+		t.Errorf("Connect() other enrollment = %v, %v", other, err)
+	}
+	if got, ok := m.Get("a111"); !ok || got != replaced {
+		t.Errorf("Get() = %v, %v", got, ok)
+	}
+
+	if _, err := m.Connect(&domain.Enrollment{ID: "invalid"}); err == nil {
+		t.Error("Connect() expected an error from the client factory")
+	}
+
+	m.Close("a111")
+	if _, ok := m.Get("a111"); ok || clients[1].open {
+		t.Error("Close() should disconnect and discard the connection")
+	}
+	if _, ok := m.Get("b222"); !ok {
+		t.Error("Close() should keep the other connections")
+	}
+
+	m.CloseAll()
+	if _, ok := m.Get("b222"); ok || clients[2].open {
+		t.Error("CloseAll() should disconnect and discard all the connections")
+	}
+}
+
+func TestManager_Queues(t *testing.T) {
+	defer os.Setenv(overrideCommonDataEnvVar, os.Getenv(overrideCommonDataEnvVar))
+	os.Setenv(overrideCommonDataEnvVar, t.TempDir())
+	defer viper.Set(config.MQTTQueueMaxBytesKey, viper.Get(config.MQTTQueueMaxBytesKey))
+	viper.Set(config.MQTTQueueMaxBytesKey, 4096)
+
+	m := NewManager(func(c *Connection, enroll *domain.Enrollment) (MQTT.Client, error) {
+		return &MockClient{}, nil
+	}, nil)
+	defer m.CloseAll()
+
+	enroll := &domain.Enrollment{ID: "a111", Credentials: domain.Credentials{Certificate: []byte("cert1")}}
+	conn, err := m.Connect(enroll)
+	if err != nil {
+		t.Fatalf("Connect() = %v", err)
+	}
+	other, err := m.Connect(&domain.Enrollment{ID: "b222"})
+	if err != nil {
+		t.Fatalf("Connect() other enrollment = %v", err)
+	}
+
+	// Each enrollment has its own queue
+	if conn.queue.dir != path.Join(commonDataDir(), queueDirName, "a111") || other.queue.dir == conn.queue.dir {
+		t.Errorf("queue directories: got %s and %s", conn.queue.dir, other.queue.dir)
+	}
+
+	// The replaced connection's queue is closed, and its messages are sent by the new connection
+	if err := conn.queue.Enqueue(&QueuedMessage{Class: ClassResponse, Topic: "devices/pub/a111"}); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	renewed := *enroll
+	renewed.Credentials.Certificate = []byte("cert2")
+	replaced, err := m.Connect(&renewed)
+	if err != nil {
+		t.Fatalf("Connect() new credentials = %v", err)
+	}
+	if err := conn.queue.Enqueue(&QueuedMessage{Class: ClassResponse, Topic: "devices/pub/a111"}); err != ErrQueueClosed {
+		t.Errorf("Enqueue() replaced queue = %v, want %v", err, ErrQueueClosed)
+	}
+	if got := drainTopics(t, replaced.queue); got != "devices/pub/a111" {
+		t.Errorf("Drain() new queue = %s", got)
+	}
+}
+
+func TestManager_AddStateHandler(t *testing.T) {
+	m := NewManager(nil, nil)
+	other := NewManager(nil, nil)
+
+	var events []StateEvent
+	remove := m.AddStateHandler(func(event StateEvent) { events = append(events, event) })
+
+	// The handlers only get the state changes of the manager's connections
+	m.states.changed(StateConnected, "mqtt.example.com:8883", nil)
+	other.states.changed(StateConnected, "mqtt.example.com:8883", nil)
+	if len(events) != 1 || events[0].State != StateConnected || events[0].Broker != "mqtt.example.com:8883" {
+		t.Errorf("events: got %+v", events)
+	}
+
+	remove()
+	remove()
+	m.states.changed(StateDisconnected, "mqtt.example.com:8883", nil)
+	if len(events) != 1 {
+		t.Errorf("events after remove: got %+v", events)
+	}
+}
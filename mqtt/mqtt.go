@@ -21,11 +21,18 @@ package mqtt
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/everactive/iot-identity/domain"
-	"log"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
 )
 
 // Constants for connecting to the MQTT broker
@@ -35,100 +42,204 @@ const (
 	//QOSExactlyOnce = byte(2)
 )
 
+// MQTT protocol versions
+const (
+	ProtocolVersion311 = "3.1.1"
+	ProtocolVersion5   = "5"
+)
+
 // Connection for MQTT protocol
 type Connection struct {
 	Client         MQTT.Client
 	clientID       string
 	organisationID string
+	queue          *Queue
+	topics         *Topics
+	verifier       *certVerifier
+	meter          *Meter
+	dialer         *Dialer
+	states         *stateHandlers
+	classify       func(topic string) TrafficClass
+	drainPending   int32
 }
 
-var conn *Connection
-var client MQTT.Client
-
-// GetConnection fetches or creates an MQTT connection
-func GetConnection(enroll *domain.Enrollment) (*Connection, error) {
-	if conn == nil {
-		// Create the client
-		client, err := newClient(enroll)
-		if err != nil {
-			return nil, err
-		}
-
-		// Create a new connection
-		conn = &Connection{
-			Client:         client,
-			clientID:       enroll.ID,
-			organisationID: enroll.Organization.ID,
-		}
+// newConnection creates a connection for the enrollment, with the client from the factory.
+// The data usage of the client is counted by the meter, the client connects with the dialer
+// and its state changes are passed to the handlers
+func newConnection(enroll *domain.Enrollment, newClient ClientFactory, meter *Meter, dialer *Dialer, states *stateHandlers) (*Connection, error) {
+	c := &Connection{
+		clientID:       enroll.ID,
+		organisationID: enroll.Organization.ID,
+		queue:          newQueue(enroll.ID),
+		topics:         NewTopics(enroll),
+		meter:          meter,
+		dialer:         dialer,
+		states:         states,
 	}
 
-	// Check that we have a live connection
-	if conn.Client.IsConnectionOpen() {
-		return conn, nil
+	client, err := newClient(c, enroll)
+	if err != nil {
+		return nil, err
+	}
+	c.Client = client
+	if meter != nil {
+		c.classify = trafficClassifier(c.topics)
+		c.Client = newMeteredClient(client, meter, c.classify)
 	}
+	return c, nil
+}
 
-	// Connect to the MQTT broker
-	if token := conn.Client.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+// newTLSClient is the ClientFactory for the brokers from the enrollment, which
+// authenticates with the enrollment credentials
+func newTLSClient(c *Connection, enroll *domain.Enrollment) (MQTT.Client, error) {
+	// Generate the TLS config from the enrollment credentials
+	tlsConfig, verifier, err := newTLSConfig(enroll)
+	if err != nil {
+		return nil, err
 	}
+	c.verifier = verifier
 
-	return conn, nil
+	return newClient(enroll, c.topics.Get(TopicPresence), tlsConfig, verifier, c.dialer, c.states, c.onConnect)
 }
 
-// newClient creates a new MQTT client
-func newClient(enroll *domain.Enrollment) (MQTT.Client, error) {
-	// Return the active client, if we have one
-	if client != nil {
-		return client, nil
+// close disconnects from the MQTT broker and closes the outbound queue, so that the
+// queued messages are only sent by the connection that replaces it
+func (c *Connection) close() {
+	c.Client.Disconnect(closeQuiesce)
+	if c.queue != nil {
+		c.queue.Close()
 	}
+}
 
-	// Generate a new MQTT client
-	url := fmt.Sprintf("ssl://%s:%s", enroll.Credentials.MQTTURL, enroll.Credentials.MQTTPort)
-	log.Println("Connect to the MQTT broker", url)
+// connect connects to the MQTT broker, unless there is a live connection
+func (c *Connection) connect() error {
+	if c.Client.IsConnectionOpen() {
+		return nil
+	}
 
-	// Generate the TLS config from the enrollment credentials
-	tlsConfig, err := newTLSConfig(enroll)
+	if token := c.Client.Connect(); token.Wait() && token.Error() != nil {
+		// The client reports a failed verification as a network error, so return the real cause
+		if c.verifier != nil {
+			if err := c.verifier.lastError(); err != nil {
+				return err
+			}
+		}
+		return token.Error()
+	}
+	return nil
+}
+
+// onConnect publishes the birth message and sends the queued messages after every (re)connect
+func (c *Connection) onConnect(client MQTT.Client) {
+	publishOnline(client, c.topics.Get(TopicPresence), c.organisationID, c.clientID)
+	c.triggerDrain()
+}
+
+// newClient creates a new MQTT client, which fails over between the brokers
+func newClient(enroll *domain.Enrollment, presence Topic, tlsConfig *tls.Config, verifier *certVerifier, dialer *Dialer, states *stateHandlers, onConnect MQTT.OnConnectHandler) (MQTT.Client, error) {
+	// The brokers from the local config take precedence over the enrollment
+	endpoints, err := brokerEndpoints(viper.GetString(config.MQTTBrokersKey), enroll.Credentials.MQTTURL, enroll.Credentials.MQTTPort)
 	if err != nil {
 		return nil, err
 	}
+	log.Println("Connect to the MQTT brokers", endpoints)
+
+	// A persistent session keeps the messages for the device while it is offline
+	cleanSession := viper.GetBool(config.MQTTSessionCleanKey)
+
+	// MQTT 5 is opt-in, as older brokers only support MQTT 3.1.1. A client is created for every
+	// connection, so the last will carries the time of the connection it reports as lost
+	var newEndpointClient endpointClientFactory
+	switch version := viper.GetString(config.MQTTProtocolVersionKey); version {
+	case ProtocolVersion5:
+		log.Println("Using MQTT protocol version", version)
+		newEndpointClient = func(e *Endpoint, onConnectionLost MQTT.ConnectionLostHandler) MQTT.Client {
+			v5 := newV5Client(e, enroll.ID, endpointTLSConfig(tlsConfig, verifier, e), dialer)
+			// Presence: the broker publishes the last will if the connection drops, and
+			// the birth message replaces it on every (re)connect
+			v5.will = &paho.WillMessage{Retain: presence.Retained, QoS: presence.QoS, Topic: presence.Name, Payload: willPayload(enroll.Organization.ID, enroll.ID)}
+			v5.onConnectionLost = onConnectionLost
+			v5.cleanStart = cleanSession
+			if !cleanSession {
+				v5.sessionExpiry = uint32(viper.GetDuration(config.MQTTSessionExpiryKey).Seconds())
+			}
+			return v5
+		}
+	case ProtocolVersion311, "":
+		newEndpointClient = func(e *Endpoint, onConnectionLost MQTT.ConnectionLostHandler) MQTT.Client {
+			// Set up the MQTT client options
+			opts := MQTT.NewClientOptions()
+			opts.AddBroker(e.URL())
+			opts.SetClientID(enroll.ID)
+			// The connection is opened by the agent, to connect through a proxy
+			endpointTLS := endpointTLSConfig(tlsConfig, verifier, e)
+			opts.SetTLSConfig(endpointTLS)
+			opts.SetCustomOpenConnectionFn(func(*url.URL, MQTT.ClientOptions) (net.Conn, error) {
+				return dialer.openConnection(e, endpointTLS)
+			})
+			opts.SetBinaryWill(presence.Name, willPayload(enroll.Organization.ID, enroll.ID), presence.QoS, presence.Retained)
+			// The failover client reconnects, so it can move to another broker
+			opts.SetAutoReconnect(false)
+			opts.SetConnectionLostHandler(onConnectionLost)
+			opts.SetCleanSession(cleanSession)
+			return MQTT.NewClient(opts)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported MQTT protocol version: %s", version)
+	}
 
-	// Set up the MQTT client options
-	opts := MQTT.NewClientOptions()
-	opts.AddBroker(url)
-	opts.SetClientID(enroll.ID)
-	opts.SetTLSConfig(tlsConfig)
-	opts.AutoReconnect = true
-	//opts.SetOnConnectHandler(connectHandler)
+	fc := newFailoverClient(endpoints, newEndpointClient, onConnect, viper.GetDuration(config.MQTTFailbackIntervalKey), states)
+	if maxDelay := viper.GetDuration(config.MQTTReconnectMaxDelayKey); maxDelay >= minReconnectDelay {
+		fc.maxDelay = maxDelay
+	}
+	return fc, nil
+}
 
-	client = MQTT.NewClient(opts)
-	return client, nil
+// endpointTLSConfig sets the broker hostname to verify, unless it is overridden. It is called
+// for every connection, which starts without a verification failure
+func endpointTLSConfig(tlsConfig *tls.Config, verifier *certVerifier, e *Endpoint) *tls.Config {
+	c := tlsConfig.Clone()
+	if len(c.ServerName) == 0 {
+		c.ServerName = e.Host
+	}
+	if verifier.mode != VerifyNone {
+		verifier.reset()
+		c.VerifyConnection = verifier.verifyConnection(c.ServerName)
+	}
+	return c
 }
 
 // newTLSConfig sets up the certificates from the enrollment record
-func newTLSConfig(enroll *domain.Enrollment) (*tls.Config, error) {
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(enroll.Organization.RootCert)
-
+func newTLSConfig(enroll *domain.Enrollment) (*tls.Config, *certVerifier, error) {
 	// Import client certificate/key pair
 	cert, err := tls.X509KeyPair(enroll.Credentials.Certificate, enroll.Credentials.PrivateKey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	mode := viper.GetString(config.MQTTTLSVerifyKey)
+	if len(mode) == 0 {
+		mode = VerifyHostname
+	}
+
+	verifier, err := newCertVerifier(mode, enroll.Organization.RootCert, strings.Split(viper.GetString(config.MQTTTLSPinsKey), ","))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if mode == VerifyNone {
+		log.Println("WARNING: the MQTT broker certificate is not verified (mqtt.tls.verify=none)")
 	}
 
-	// Create tls.Config with desired TLS properties
 	return &tls.Config{
-		// RootCAs = certs used to verify server cert.
-		RootCAs: certPool,
-		// ClientAuth = whether to request cert from server.
-		// Since the server is set up for SSL, this happens
-		// anyways.
-		ClientAuth: tls.NoClientCert,
-		// ClientCAs = certs used to validate client cert.
-		ClientCAs: nil,
-		// InsecureSkipVerify = verify that cert contents
-		// match server. IP matches what is in cert etc.
-		InsecureSkipVerify: true,
+		// The broker hostname can be overridden, e.g. when the broker is addressed by IP.
+		// Otherwise, it is set for each broker
+		ServerName: viper.GetString(config.MQTTTLSServerNameKey),
+		MinVersion: tls.VersionTLS12,
 		// Certificates = list of certs client sends to server.
 		Certificates: []tls.Certificate{cert},
-	}, nil
+		// This only disables the built-in verification. The verifier replaces it, as it
+		// supports pinning and keeps the cause of a failure
+		InsecureSkipVerify: true,
+	}, verifier, nil
 }
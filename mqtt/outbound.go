@@ -0,0 +1,188 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+const (
+	commonDataEnvVar         = "SNAP_COMMON"
+	overrideCommonDataEnvVar = "OVERRIDE_SNAP_COMMON"
+	queueDirName             = "queue"
+	drainTimeout             = 30 * time.Second
+)
+
+// Publish publishes a message. The message is queued on disk before returning, and sent
+// at once when the broker is reachable or else after reconnecting
+func (c *Connection) Publish(class MessageClass, topic string, qos byte, retained bool, payload []byte, props *MessageProperties) {
+	// Over the data budget, the telemetry is sent less often
+	if class == ClassTelemetry && c.classify != nil && !c.meter.allowTelemetry(c.classify(topic)) {
+		log.Printf("Data budget exceeded, skipping the message to `%s`", topic)
+		return
+	}
+
+	if c.queue == nil {
+		Publish(c.Client, topic, qos, retained, payload, props)
+		return
+	}
+
+	msg := &QueuedMessage{
+		Class:      class,
+		Payload:    payload,
+		Properties: props,
+		QoS:        qos,
+		Retained:   retained,
+		Topic:      topic,
+	}
+
+	// Every message goes through the queue, which is drained in order, so a message that
+	// fails to publish is never overtaken by a later message on the same topic
+	c.enqueue(msg)
+	if c.Client.IsConnectionOpen() {
+		c.triggerDrain()
+	}
+}
+
+// QueueStats returns the state of the outbound queue, or nil when there is no queue
+func (c *Connection) QueueStats() *QueueStats {
+	if c.queue == nil {
+		return nil
+	}
+	stats := c.queue.Stats()
+	return &stats
+}
+
+// Usage returns the data usage, or nil when it is not metered
+func (c *Connection) Usage() *UsageStats {
+	return c.meter.Stats()
+}
+
+// Meter returns the data usage meter, which is nil when the data usage is not metered
+func (c *Connection) Meter() *Meter {
+	return c.meter
+}
+
+// Broker returns the address of the connected broker, if the client supports failover
+func (c *Connection) Broker() string {
+	if b, ok := c.Client.(interface{ CurrentBroker() string }); ok {
+		return b.CurrentBroker()
+	}
+	return ""
+}
+
+func (c *Connection) enqueue(msg *QueuedMessage) {
+	if err := c.queue.Enqueue(msg); err != nil {
+		log.Printf("Error queueing the message to `%s`: %v", msg.Topic, err)
+	}
+}
+
+// triggerDrain drains the queue in the background, unless a drain is pending already. The
+// pending drain is cleared before draining, so it sends the messages queued meanwhile
+func (c *Connection) triggerDrain() {
+	if !atomic.CompareAndSwapInt32(&c.drainPending, 0, 1) {
+		return
+	}
+	go func() {
+		atomic.StoreInt32(&c.drainPending, 0)
+		c.drain()
+	}()
+}
+
+// drain sends the queued messages
+func (c *Connection) drain() {
+	if c.queue == nil {
+		return
+	}
+
+	err := c.queue.Drain(func(msg *QueuedMessage) error {
+		props := msg.Properties
+		if props != nil && props.MessageExpiry > 0 {
+			// The time in the queue counts towards the expiry of the message
+			remaining := props.MessageExpiry - time.Since(msg.Enqueued)
+			if remaining < time.Second {
+				return nil
+			}
+			p := *props
+			p.MessageExpiry = remaining
+			props = &p
+		}
+
+		token := Publish(c.Client, msg.Topic, msg.QoS, msg.Retained, msg.Payload, props)
+		if !token.WaitTimeout(drainTimeout) {
+			return fmt.Errorf("timed out publishing to `%s`", msg.Topic)
+		}
+		return c.publishError(token.Error())
+	})
+	if err != nil {
+		log.Printf("Error sending the queued messages: %v", err)
+	}
+}
+
+// publishError classifies the error of a queued message. A message that fails while the connection
+// is open was rejected by the broker, e.g. because its payload is too large or the topic is refused,
+// and would block the queue if it was retried. Otherwise it is sent again after reconnecting
+func (c *Connection) publishError(err error) error {
+	if err == nil || !c.Client.IsConnectionOpen() ||
+		errors.Is(err, MQTT.ErrNotConnected) || errors.Is(err, ErrNotConnected) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrPublishRejected, err)
+}
+
+// newQueue opens the outbound queue of the enrollment. The queue is disabled when it has no size limit
+func newQueue(id string) *Queue {
+	maxBytes := viper.GetInt64(config.MQTTQueueMaxBytesKey)
+	if maxBytes <= 0 {
+		return nil
+	}
+
+	q, err := NewQueue(queueDir(id), maxBytes, viper.GetDuration(config.MQTTQueueMaxAgeKey))
+	if err != nil {
+		log.Printf("Error opening the outbound queue, messages will not be queued: %v", err)
+		return nil
+	}
+	return q
+}
+
+// queueDir is the directory of the queue of the enrollment, so the messages of one
+// enrollment are never sent with the credentials of another
+func queueDir(id string) string {
+	return path.Join(commonDataDir(), queueDirName, id)
+}
+
+// commonDataDir is the directory for the data of the agent, which is kept across snap revisions
+func commonDataDir() string {
+	if len(os.Getenv(overrideCommonDataEnvVar)) > 0 {
+		return os.Getenv(overrideCommonDataEnvVar)
+	}
+	return os.Getenv(commonDataEnvVar)
+}
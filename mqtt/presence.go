@@ -0,0 +1,91 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/shirou/gopsutil/host"
+)
+
+// Presence statuses of a device
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// Presence is the retained message that reports whether a device is connected to the broker.
+// The broker publishes an offline message that is not clean, the last will, when the
+// connection drops without a disconnect
+type Presence struct {
+	BootTime  *time.Time `json:"bootTime,omitempty"`
+	Clean     bool       `json:"clean"`
+	DeviceId  string     `json:"deviceId"`
+	OrgId     string     `json:"orgId"`
+	Status    string     `json:"status"`
+	Timestamp time.Time  `json:"timestamp"`
+	Version   string     `json:"version,omitempty"`
+}
+
+// PublishPresence publishes the presence status of the device, which is retained by default
+func PublishPresence(client MQTT.Client, topic Topic, orgID, clientID, status string) MQTT.Token {
+	return client.Publish(topic.Name, topic.QoS, topic.Retained, presencePayload(orgID, clientID, status, true))
+}
+
+// presencePayload serializes the presence message, including the agent version and boot time when online
+func presencePayload(orgID, clientID, status string, clean bool) []byte {
+	presence := Presence{
+		Clean:     clean,
+		DeviceId:  clientID,
+		OrgId:     orgID,
+		Status:    status,
+		Timestamp: time.Now().UTC(),
+	}
+
+	if status == PresenceOnline {
+		presence.Version = os.Getenv("SNAP_VERSION")
+		if boot, err := host.BootTime(); err == nil {
+			bootTime := time.Unix(int64(boot), 0).UTC()
+			presence.BootTime = &bootTime
+		}
+	}
+
+	// The struct always serializes
+	data, _ := json.Marshal(&presence)
+	return data
+}
+
+// willPayload is the offline message the broker publishes when the connection is lost. It is
+// set when connecting, so its timestamp is when the lost connection was opened
+func willPayload(orgID, clientID string) []byte {
+	return presencePayload(orgID, clientID, PresenceOffline, false)
+}
+
+// publishOnline publishes the birth message after every (re)connect
+func publishOnline(client MQTT.Client, topic Topic, orgID, clientID string) {
+	token := PublishPresence(client, topic, orgID, clientID, PresenceOnline)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Error publishing the online presence message: %v", token.Error())
+	}
+}
@@ -0,0 +1,86 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MessageProperties are the MQTT 5 properties of a message. They are not
+// available on an MQTT 3.1.1 connection
+type MessageProperties struct {
+	ContentType     string
+	CorrelationData []byte
+	MessageExpiry   time.Duration
+	ResponseTopic   string
+	UserProperties  map[string]string
+}
+
+// PropertiesMessage is a received message that has MQTT 5 properties
+type PropertiesMessage interface {
+	MQTT.Message
+	Properties() *MessageProperties
+}
+
+// PropertiesPublisher is a client that can publish messages with MQTT 5 properties
+type PropertiesPublisher interface {
+	PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *MessageProperties) MQTT.Token
+}
+
+// GetProperties returns the MQTT 5 properties of a message, or nil for an MQTT 3.1.1 message
+func GetProperties(msg MQTT.Message) *MessageProperties {
+	if m, ok := msg.(PropertiesMessage); ok {
+		return m.Properties()
+	}
+	return nil
+}
+
+// Publish publishes a message with the MQTT 5 properties, when the client supports them.
+// Otherwise, the properties are dropped and the message is published as normal
+func Publish(client MQTT.Client, topic string, qos byte, retained bool, payload interface{}, props *MessageProperties) MQTT.Token {
+	if p, ok := client.(PropertiesPublisher); ok && props != nil {
+		return p.PublishWithProperties(topic, qos, retained, payload, props)
+	}
+	return client.Publish(topic, qos, retained, payload)
+}
+
+// publishProperties converts the properties to the paho MQTT 5 format
+func (props *MessageProperties) publishProperties() *paho.PublishProperties {
+	if props == nil {
+		return nil
+	}
+
+	p := &paho.PublishProperties{
+		ContentType:     props.ContentType,
+		CorrelationData: props.CorrelationData,
+		ResponseTopic:   props.ResponseTopic,
+	}
+	if props.MessageExpiry > 0 {
+		expiry := uint32(props.MessageExpiry / time.Second)
+		p.MessageExpiry = &expiry
+	}
+	for k, v := range props.UserProperties {
+		p.User.Add(k, v)
+	}
+	return p
+}
@@ -0,0 +1,337 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MessageClass is the kind of an outgoing message, which sets its priority in the outbound queue
+type MessageClass int
+
+// Message classes, in order of increasing priority
+const (
+	ClassTelemetry MessageClass = iota
+	ClassResponse
+)
+
+const queueFileExt = ".msg"
+
+// ErrQueueClosed is the error when a message is queued after the connection was closed
+var ErrQueueClosed = fmt.Errorf("the outbound queue is closed")
+
+// ErrPublishRejected is the error when the broker rejects a queued message, which is dropped
+// rather than retried, as it would block the messages behind it
+var ErrPublishRejected = errors.New("the broker rejected the message")
+
+// QueueStats is the state of the outbound queue
+type QueueStats struct {
+	Bytes    int64  `json:"bytes"`
+	Depth    int    `json:"depth"`
+	Dropped  uint64 `json:"dropped"`
+	Expired  uint64 `json:"expired"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// QueuedMessage is a message waiting in the outbound queue
+type QueuedMessage struct {
+	Class      MessageClass       `json:"class"`
+	Enqueued   time.Time          `json:"enqueued"`
+	Payload    []byte             `json:"payload"`
+	Properties *MessageProperties `json:"properties,omitempty"`
+	QoS        byte               `json:"qos"`
+	Retained   bool               `json:"retained"`
+	Topic      string             `json:"topic"`
+}
+
+// queueEntry is the index entry of a queued message. The message itself stays on disk
+type queueEntry struct {
+	seq      uint64
+	class    MessageClass
+	enqueued time.Time
+	size     int64
+}
+
+// Queue is an on-disk store-and-forward queue for outgoing messages, bounded by size and age.
+// Each message is a file, named so that the queue can be indexed without reading the messages
+type Queue struct {
+	mu       sync.Mutex
+	drainMu  sync.Mutex
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	seq      uint64
+	entries  []*queueEntry
+	bytes    int64
+	dropped  uint64
+	expired  uint64
+	rejected uint64
+	closed   bool
+}
+
+// NewQueue opens the queue in the directory, creating it if needed
+func NewQueue(dir string, maxBytes int64, maxAge time.Duration) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create the queue directory: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the queue directory: %v", err)
+	}
+
+	q := &Queue{dir: dir, maxBytes: maxBytes, maxAge: maxAge}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		e, err := parseQueueFilename(f.Name())
+		if err != nil {
+			// Leftovers, such as a partially written message, are removed
+			_ = os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		e.size = f.Size()
+		q.entries = append(q.entries, e)
+		q.bytes += e.size
+		if e.seq > q.seq {
+			q.seq = e.seq
+		}
+	}
+	sort.Slice(q.entries, func(i, j int) bool { return q.entries[i].seq < q.entries[j].seq })
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune(time.Now())
+	return q, nil
+}
+
+// Enqueue stores a message, dropping the oldest lower priority messages to stay within the size limit
+func (q *Queue) Enqueue(msg *QueuedMessage) error {
+	if msg.Enqueued.IsZero() {
+		msg.Enqueued = time.Now()
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	q.seq++
+	e := &queueEntry{seq: q.seq, class: msg.Class, enqueued: msg.Enqueued, size: int64(len(data))}
+
+	// Write then rename, so a crash never leaves a partial message in the queue
+	tmp := filepath.Join(q.dir, "."+e.filename())
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write queued message: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, e.filename())); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("cannot write queued message: %v", err)
+	}
+
+	q.entries = append(q.entries, e)
+	q.bytes += e.size
+	q.prune(time.Now())
+	return nil
+}
+
+// Len returns the number of queued messages
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// Stats returns the depth of the queue and the number of messages lost
+func (q *Queue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{Bytes: q.bytes, Depth: len(q.entries), Dropped: q.dropped, Expired: q.expired, Rejected: q.rejected}
+}
+
+// Drain publishes the queued messages, highest priority first and in order within each
+// class, so the order of the messages on each topic is kept. A message that the broker
+// rejects (ErrPublishRejected) is dropped and counted. Otherwise it stops at the first
+// message that cannot be published, which stays in the queue
+func (q *Queue) Drain(publish func(*QueuedMessage) error) error {
+	// Only one drain at a time, or messages could be sent twice or out of order
+	q.drainMu.Lock()
+	defer q.drainMu.Unlock()
+
+	for {
+		e := q.next()
+		if e == nil {
+			return nil
+		}
+
+		msg, err := q.read(e)
+		if err != nil {
+			log.Printf("Error reading queued message %d, dropping it: %v", e.seq, err)
+			q.remove(e, &q.dropped)
+			continue
+		}
+
+		if err := publish(msg); err != nil {
+			if errors.Is(err, ErrPublishRejected) {
+				log.Printf("Dropping queued message %d to `%s`: %v", e.seq, msg.Topic, err)
+				q.remove(e, &q.rejected)
+				continue
+			}
+			return err
+		}
+		q.remove(e, nil)
+	}
+}
+
+// Close stops queueing and draining messages. The queued messages stay on disk, to be
+// sent by the next queue opened in the directory
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	// Wait for a drain in progress, which stops after the message it is publishing
+	q.drainMu.Lock()
+	defer q.drainMu.Unlock()
+}
+
+// next returns the oldest unexpired message of the highest priority class
+func (q *Queue) next() *queueEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+
+	q.prune(time.Now())
+
+	var next *queueEntry
+	for _, e := range q.entries {
+		if next == nil || e.class > next.class {
+			next = e
+		}
+	}
+	return next
+}
+
+func (q *Queue) read(e *queueEntry) (*QueuedMessage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, e.filename()))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &QueuedMessage{}
+	err = json.Unmarshal(data, msg)
+	return msg, err
+}
+
+func (q *Queue) remove(e *queueEntry, counter *uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.removeLocked(e, counter)
+}
+
+// removeLocked deletes a message, counting it if it was lost. The lock must be held
+func (q *Queue) removeLocked(e *queueEntry, counter *uint64) {
+	for i, entry := range q.entries {
+		if entry == e {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			q.bytes -= e.size
+			break
+		}
+	}
+
+	if err := os.Remove(filepath.Join(q.dir, e.filename())); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing queued message %d: %v", e.seq, err)
+	}
+	if counter != nil {
+		*counter++
+	}
+}
+
+// prune removes the expired messages, then the oldest messages of the lowest priority
+// class until the queue is within its size limit. The lock must be held
+func (q *Queue) prune(now time.Time) {
+	for _, e := range append([]*queueEntry{}, q.entries...) {
+		if q.maxAge > 0 && now.Sub(e.enqueued) > q.maxAge {
+			q.removeLocked(e, &q.expired)
+		}
+	}
+
+	for q.maxBytes > 0 && q.bytes > q.maxBytes && len(q.entries) > 0 {
+		drop := q.entries[0]
+		for _, e := range q.entries {
+			if e.class < drop.class {
+				drop = e
+			}
+		}
+		log.Printf("Outbound queue full, dropping message %d", drop.seq)
+		q.removeLocked(drop, &q.dropped)
+	}
+}
+
+// filename encodes the index entry: <sequence>-<class>-<enqueued unix nanoseconds>.msg
+func (e *queueEntry) filename() string {
+	return fmt.Sprintf("%020d-%d-%d%s", e.seq, e.class, e.enqueued.UnixNano(), queueFileExt)
+}
+
+func parseQueueFilename(name string) (*queueEntry, error) {
+	if !strings.HasSuffix(name, queueFileExt) {
+		return nil, fmt.Errorf("not a queued message: %s", name)
+	}
+
+	parts := strings.Split(strings.TrimSuffix(name, queueFileExt), "-")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a queued message: %s", name)
+	}
+
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("not a queued message: %s", name)
+	}
+	class, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("not a queued message: %s", name)
+	}
+	enqueued, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("not a queued message: %s", name)
+	}
+
+	return &queueEntry{seq: seq, class: MessageClass(class), enqueued: time.Unix(0, enqueued)}, nil
+}
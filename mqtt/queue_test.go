@@ -0,0 +1,244 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func tempQueueDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatalf("cannot create queue directory: %v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func drainTopics(t *testing.T, q *Queue) string {
+	var topics []string
+	err := q.Drain(func(msg *QueuedMessage) error {
+		topics = append(topics, msg.Topic)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	return strings.Join(topics, ",")
+}
+
+func TestQueue_Drain(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []*QueuedMessage
+		maxBytes int64
+		maxAge   time.Duration
+		want     string
+		dropped  uint64
+		expired  uint64
+	}{
+		{"empty", nil, 1024, time.Hour, "", 0, 0},
+		{"priority", []*QueuedMessage{
+			{Class: ClassTelemetry, Topic: "health1"},
+			{Class: ClassResponse, Topic: "pub1"},
+			{Class: ClassTelemetry, Topic: "health2"},
+			{Class: ClassResponse, Topic: "pub2"},
+		}, 4096, time.Hour, "pub1,pub2,health1,health2", 0, 0},
+		{"full", []*QueuedMessage{
+			{Class: ClassResponse, Topic: "pub1", Payload: make([]byte, 100)},
+			{Class: ClassTelemetry, Topic: "health1", Payload: make([]byte, 100)},
+			{Class: ClassTelemetry, Topic: "health2", Payload: make([]byte, 100)},
+		}, 700, time.Hour, "pub1,health2", 1, 0},
+		{"expired", []*QueuedMessage{
+			{Class: ClassResponse, Topic: "pub1", Enqueued: time.Now().Add(-2 * time.Hour)},
+			{Class: ClassTelemetry, Topic: "health1"},
+		}, 4096, time.Hour, "health1", 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewQueue(tempQueueDir(t), tt.maxBytes, tt.maxAge)
+			if err != nil {
+				t.Fatalf("NewQueue: %v", err)
+			}
+			for _, msg := range tt.messages {
+				if err := q.Enqueue(msg); err != nil {
+					t.Fatalf("Enqueue: %v", err)
+				}
+			}
+
+			if got := drainTopics(t, q); got != tt.want {
+				t.Errorf("Drain: got %s, want %s", got, tt.want)
+			}
+
+			stats := q.Stats()
+			if stats.Depth != 0 || stats.Bytes != 0 {
+				t.Errorf("Stats: queue not empty: %+v", stats)
+			}
+			if stats.Dropped != tt.dropped || stats.Expired != tt.expired {
+				t.Errorf("Stats: got %d dropped, %d expired, want %d, %d", stats.Dropped, stats.Expired, tt.dropped, tt.expired)
+			}
+		})
+	}
+}
+
+func TestQueue_Persistence(t *testing.T) {
+	dir := tempQueueDir(t)
+	q, err := NewQueue(dir, 4096, time.Hour)
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := q.Enqueue(&QueuedMessage{Class: ClassTelemetry, Topic: fmt.Sprintf("health%d", i)}); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+
+	// The first message fails, so it stays at the head of the queue
+	err = q.Drain(func(msg *QueuedMessage) error {
+		return fmt.Errorf("MOCK publish error")
+	})
+	if err == nil {
+		t.Error("Drain: expected error, got none")
+	}
+
+	// A partially written message is discarded on restart
+	if err := ioutil.WriteFile(dir+"/.00000000000000000004-0-0.msg", []byte("{"), 0600); err != nil {
+		t.Fatalf("cannot write partial message: %v", err)
+	}
+
+	reopened, err := NewQueue(dir, 4096, time.Hour)
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	if reopened.Len() != 3 {
+		t.Errorf("Len: got %d, want 3", reopened.Len())
+	}
+	if err := reopened.Enqueue(&QueuedMessage{Class: ClassTelemetry, Topic: "health4"}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if got := drainTopics(t, reopened); got != "health1,health2,health3,health4" {
+		t.Errorf("Drain: got %s", got)
+	}
+}
+
+func TestQueue_DrainRejected(t *testing.T) {
+	q, err := NewQueue(tempQueueDir(t), 4096, time.Hour)
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := q.Enqueue(&QueuedMessage{Class: ClassTelemetry, Topic: fmt.Sprintf("health%d", i)}); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+
+	// A rejected message is dropped, and the messages behind it are sent
+	var sent []string
+	err = q.Drain(func(msg *QueuedMessage) error {
+		if msg.Topic == "health2" {
+			return fmt.Errorf("%w: MOCK payload too large", ErrPublishRejected)
+		}
+		sent = append(sent, msg.Topic)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Drain: %v", err)
+	}
+	if got := strings.Join(sent, ","); got != "health1,health3" {
+		t.Errorf("Drain: got %s, want health1,health3", got)
+	}
+	if stats := q.Stats(); stats.Depth != 0 || stats.Rejected != 1 {
+		t.Errorf("Stats: got %+v, want an empty queue with 1 rejected", stats)
+	}
+}
+
+func TestQueue_Close(t *testing.T) {
+	dir := tempQueueDir(t)
+	q, err := NewQueue(dir, 4096, time.Hour)
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	if err := q.Enqueue(&QueuedMessage{Class: ClassTelemetry, Topic: "health1"}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	// A closed queue neither takes nor sends messages
+	q.Close()
+	if err := q.Enqueue(&QueuedMessage{Class: ClassTelemetry, Topic: "health2"}); err != ErrQueueClosed {
+		t.Errorf("Enqueue: got %v, want %v", err, ErrQueueClosed)
+	}
+	if got := drainTopics(t, q); got != "" {
+		t.Errorf("Drain: got %s, want no messages", got)
+	}
+
+	// ...which are sent by the next queue in the directory
+	reopened, err := NewQueue(dir, 4096, time.Hour)
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	if got := drainTopics(t, reopened); got != "health1" {
+		t.Errorf("Drain: got %s", got)
+	}
+}
+
+func TestConnection_Publish(t *testing.T) {
+	q, err := NewQueue(tempQueueDir(t), 4096, time.Hour)
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	client := &MockClient{}
+	c := &Connection{Client: client, queue: q}
+
+	// Messages are queued while the broker is unreachable
+	c.Publish(ClassTelemetry, "health", QOSAtMostOnce, false, []byte("{}"), nil)
+	c.Publish(ClassResponse, "pub", QOSAtLeastOnce, false, []byte("{}"), nil)
+	if stats := c.QueueStats(); stats.Depth != 2 {
+		t.Errorf("QueueStats: got depth %d, want 2", stats.Depth)
+	}
+
+	// ...and sent after reconnecting
+	client.Connect()
+	c.drain()
+	if stats := c.QueueStats(); stats.Depth != 0 {
+		t.Errorf("QueueStats: got depth %d, want 0", stats.Depth)
+	}
+
+	// While connected, the message is queued before returning and sent by a single drain
+	atomic.StoreInt32(&c.drainPending, 1)
+	c.Publish(ClassTelemetry, "health", QOSAtMostOnce, false, []byte("{}"), nil)
+	if stats := c.QueueStats(); stats.Depth != 1 {
+		t.Errorf("QueueStats: got depth %d, want 1 with a pending drain", stats.Depth)
+	}
+	atomic.StoreInt32(&c.drainPending, 0)
+	c.drain()
+	if stats := c.QueueStats(); stats.Depth != 0 {
+		t.Errorf("QueueStats: got depth %d, want 0", stats.Depth)
+	}
+
+	if (&Connection{Client: client}).QueueStats() != nil {
+		t.Error("QueueStats: expected no stats without a queue")
+	}
+}
@@ -0,0 +1,95 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// ConnectionState is the state of the connection to the MQTT broker
+type ConnectionState string
+
+// Connection states
+const (
+	StateConnected      ConnectionState = "connected"
+	StateConnectionLost ConnectionState = "connection-lost"
+	StateReconnecting   ConnectionState = "reconnecting"
+	StateDisconnected   ConnectionState = "disconnected"
+	// StateAuthFailed is a connection attempt that the broker refused because of the credentials
+	StateAuthFailed ConnectionState = "auth-failed"
+)
+
+// StateEvent is a change of the state of the connection to the MQTT broker
+type StateEvent struct {
+	Broker    string
+	Error     error
+	State     ConnectionState
+	Timestamp time.Time
+}
+
+// StateHandler is called on every change of the connection state
+type StateHandler func(event StateEvent)
+
+// stateHandlers are the handlers of the connection state changes of the connections of a manager
+type stateHandlers struct {
+	mu       sync.RWMutex
+	handlers []*StateHandler
+}
+
+// add adds a handler, and returns the func that removes it
+func (s *stateHandlers) add(handler StateHandler) (remove func()) {
+	h := &handler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers = append(s.handlers, h)
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, registered := range s.handlers {
+			if registered == h {
+				s.handlers = append(s.handlers[:i:i], s.handlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// changed logs the connection state change and passes it to the handlers
+func (s *stateHandlers) changed(state ConnectionState, broker string, err error) {
+	event := StateEvent{Broker: broker, Error: err, State: state, Timestamp: time.Now().UTC()}
+	if err != nil {
+		log.Printf("MQTT connection %s (broker %s): %v", state, broker, err)
+	} else {
+		log.Printf("MQTT connection %s (broker %s)", state, broker)
+	}
+	if s == nil {
+		return
+	}
+
+	s.mu.RLock()
+	handlers := s.handlers
+	s.mu.RUnlock()
+	for _, handler := range handlers {
+		(*handler)(event)
+	}
+}
@@ -93,6 +93,13 @@ func (t *MockToken) WaitTimeout(time.Duration) bool {
 	return true
 }
 
+// Done mocks the token completion
+func (t *MockToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
 // Error mocks a token error check
 func (t *MockToken) Error() error {
 	return nil
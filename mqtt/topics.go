@@ -0,0 +1,132 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/everactive/iot-identity/domain"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+// MessageType is the kind of a message, which has its own topic and delivery settings
+type MessageType string
+
+// Message types
+const (
+	TopicActions      MessageType = "actions"
+	TopicResponses    MessageType = "responses"
+	TopicHealth       MessageType = "health"
+	TopicMetrics      MessageType = "metrics"
+	TopicInventory    MessageType = "inventory"
+	TopicLogs         MessageType = "logs"
+	TopicPresence     MessageType = "presence"
+	TopicTransfer     MessageType = "transfer"
+	TopicTransferAcks MessageType = "transfer-acks"
+)
+
+// Topic is the topic and delivery settings for a message type
+type Topic struct {
+	Name     string
+	QoS      byte
+	Retained bool
+}
+
+// DefaultTopics are the topic templates and delivery settings used unless configured
+var DefaultTopics = map[MessageType]Topic{
+	TopicActions:      {Name: "devices/sub/{device}", QoS: QOSAtLeastOnce},
+	TopicResponses:    {Name: "devices/pub/{device}", QoS: QOSAtLeastOnce},
+	TopicHealth:       {Name: "devices/health/{device}", QoS: QOSAtMostOnce},
+	TopicMetrics:      {Name: "metrics/{org}", QoS: QOSAtMostOnce},
+	TopicInventory:    {Name: "devices/inventory/{device}", QoS: QOSAtLeastOnce},
+	TopicLogs:         {Name: "devices/logs/{device}", QoS: QOSAtLeastOnce},
+	TopicPresence:     {Name: "devices/presence/{device}", QoS: QOSAtLeastOnce, Retained: true},
+	TopicTransfer:     {Name: "devices/transfer/{device}", QoS: QOSAtLeastOnce},
+	TopicTransferAcks: {Name: "devices/transfer-ack/{device}", QoS: QOSAtLeastOnce},
+}
+
+// Topics resolves the topic templates for a device. The templates can use the
+// placeholders {org}, {device}, {brand}, {model} and {serial}
+type Topics struct {
+	placeholders *strings.Replacer
+}
+
+// NewTopics creates the topics for the enrolled device
+func NewTopics(enroll *domain.Enrollment) *Topics {
+	return &Topics{
+		placeholders: strings.NewReplacer(
+			"{org}", enroll.Organization.ID,
+			"{device}", enroll.ID,
+			"{brand}", enroll.Device.Brand,
+			"{model}", enroll.Device.Model,
+			"{serial}", enroll.Device.SerialNumber,
+		),
+	}
+}
+
+// Get returns the topic and delivery settings for a message type, from the agent config or the defaults
+func (t *Topics) Get(messageType MessageType) Topic {
+	topic := DefaultTopics[messageType]
+
+	if name := viper.GetString(config.MQTTTopicKeyPrefix + string(messageType)); len(name) > 0 {
+		topic.Name = name
+	}
+	if qos, err := topicQoS(viper.GetString(config.MQTTQoSKeyPrefix + string(messageType))); err != nil {
+		log.Printf("Invalid MQTT QoS for %s messages, using %d: %v", messageType, topic.QoS, err)
+	} else if qos != nil {
+		topic.QoS = *qos
+	}
+	if retained := viper.GetString(config.MQTTRetainKeyPrefix + string(messageType)); len(retained) > 0 {
+		topic.Retained = viper.GetBool(config.MQTTRetainKeyPrefix + string(messageType))
+	}
+
+	topic.Name = t.placeholders.Replace(topic.Name)
+	return topic
+}
+
+// ResponseTopicAllowed returns whether the response topic requested by an MQTT 5 action is
+// the device's responses topic or below it, so an action cannot direct the response to the
+// topics of other devices or message types
+func (t *Topics) ResponseTopicAllowed(topic string) bool {
+	if strings.ContainsAny(topic, "+#") {
+		return false
+	}
+	responses := t.Get(TopicResponses).Name
+	return topic == responses || strings.HasPrefix(topic, responses+"/")
+}
+
+// topicQoS parses a configured QoS, which is nil when not configured
+func topicQoS(value string) (*byte, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	qos, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || qos > 2 {
+		return nil, fmt.Errorf("QoS must be 0, 1 or 2: %s", value)
+	}
+	b := byte(qos)
+	return &b, nil
+}
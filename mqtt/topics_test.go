@@ -0,0 +1,95 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/everactive/iot-identity/domain"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+func TestTopics_Get(t *testing.T) {
+	enroll := &domain.Enrollment{
+		ID:           "a111",
+		Device:       domain.Device{Brand: "example", Model: "drone-1000", SerialNumber: "DR1000A111"},
+		Organization: domain.Organization{ID: "abc"},
+	}
+
+	tests := []struct {
+		name        string
+		messageType MessageType
+		config      map[string]string
+		want        Topic
+	}{
+		{"default-actions", TopicActions, nil, Topic{Name: "devices/sub/a111", QoS: QOSAtLeastOnce}},
+		{"default-metrics", TopicMetrics, nil, Topic{Name: "metrics/abc", QoS: QOSAtMostOnce}},
+		{"default-presence", TopicPresence, nil, Topic{Name: "devices/presence/a111", QoS: QOSAtLeastOnce, Retained: true}},
+		{"template", TopicHealth, map[string]string{
+			config.MQTTTopicKeyPrefix + "health": "fleet/{org}/{brand}/{model}/{serial}/health",
+		}, Topic{Name: "fleet/abc/example/drone-1000/DR1000A111/health", QoS: QOSAtMostOnce}},
+		{"delivery", TopicInventory, map[string]string{
+			config.MQTTQoSKeyPrefix + "inventory":    "0",
+			config.MQTTRetainKeyPrefix + "inventory": "true",
+		}, Topic{Name: "devices/inventory/a111", QoS: QOSAtMostOnce, Retained: true}},
+		{"invalid-qos", TopicLogs, map[string]string{
+			config.MQTTQoSKeyPrefix + "logs": "3",
+		}, Topic{Name: "devices/logs/a111", QoS: QOSAtLeastOnce}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.config {
+				viper.Set(k, v)
+			}
+			defer func() {
+				for k := range tt.config {
+					viper.Set(k, "")
+				}
+			}()
+
+			if got := NewTopics(enroll).Get(tt.messageType); got != tt.want {
+				t.Errorf("Get: got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopics_ResponseTopicAllowed(t *testing.T) {
+	topics := NewTopics(&domain.Enrollment{ID: "a111", Organization: domain.Organization{ID: "abc"}})
+
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{"devices/pub/a111", true},
+		{"devices/pub/a111/req1", true},
+		{"devices/pub/a1112", false},
+		{"devices/pub/b222", false},
+		{"metrics/abc", false},
+		{"devices/pub/a111/#", false},
+	}
+	for _, tt := range tests {
+		if got := topics.ResponseTopicAllowed(tt.topic); got != tt.want {
+			t.Errorf("ResponseTopicAllowed(%s) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+// Statuses of a transfer acknowledgement
+const (
+	TransferAcked    = "ack"
+	TransferComplete = "complete"
+	TransferAbort    = "abort"
+)
+
+// TransferChunk is a sequenced part of a payload sent over MQTT. Each chunk has the
+// checksum of its data and the digest of the whole payload, both SHA-256
+type TransferChunk struct {
+	Checksum string `json:"checksum"`
+	Chunks   int    `json:"chunks"`
+	Data     []byte `json:"data"`
+	Digest   string `json:"digest"`
+	Id       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Offset   int64  `json:"offset"`
+	Sequence int    `json:"sequence"`
+	Size     int64  `json:"size"`
+}
+
+// TransferAck acknowledges the chunks of a transfer. Next is the number of chunks
+// received in sequence, so the sender resumes from there. A transfer is complete
+// when the receiver has verified the digest of the whole payload
+type TransferAck struct {
+	Id      string `json:"id"`
+	Message string `json:"message,omitempty"`
+	Next    int    `json:"next"`
+	Status  string `json:"status"`
+}
+
+// Transfers sends large payloads over MQTT in chunks. Up to a window of chunks are
+// unacknowledged at a time, and the sender goes back to the first unacknowledged chunk
+// when the acknowledgements stop
+type Transfers struct {
+	mu         sync.Mutex
+	client     MQTT.Client
+	chunks     Topic
+	acks       Topic
+	chunkSize  int64
+	window     int
+	ackTimeout time.Duration
+	maxRetries int
+	active     map[string]chan *TransferAck
+	subscribed bool
+}
+
+// NewTransfers creates the sender of chunked transfers, with the settings from the agent config
+func NewTransfers(client MQTT.Client, chunks, acks Topic) *Transfers {
+	t := &Transfers{
+		client:     client,
+		chunks:     chunks,
+		acks:       acks,
+		chunkSize:  viper.GetInt64(config.MQTTTransferChunkSizeKey),
+		window:     viper.GetInt(config.MQTTTransferWindowKey),
+		ackTimeout: viper.GetDuration(config.MQTTTransferAckTimeoutKey),
+		maxRetries: viper.GetInt(config.MQTTTransferRetriesKey),
+		active:     map[string]chan *TransferAck{},
+	}
+	if t.chunkSize <= 0 {
+		t.chunkSize = int64(config.DefaultConfig[config.MQTTTransferChunkSizeKey].(int))
+	}
+	if t.window <= 0 {
+		t.window = 1
+	}
+	if t.ackTimeout <= 0 {
+		t.ackTimeout = config.DefaultConfig[config.MQTTTransferAckTimeoutKey].(time.Duration)
+	}
+	return t
+}
+
+// Send transfers the payload and returns when the receiver has verified it
+func (t *Transfers) Send(id, name string, r io.ReaderAt, size int64) error {
+	digest, err := payloadDigest(r, size)
+	if err != nil {
+		return fmt.Errorf("cannot read the transfer payload: %v", err)
+	}
+
+	acks, err := t.register(id)
+	if err != nil {
+		return err
+	}
+	defer t.unregister(id)
+
+	chunks := int((size + t.chunkSize - 1) / t.chunkSize)
+	if chunks == 0 {
+		// An empty payload is still sent, so the receiver gets the digest
+		chunks = 1
+	}
+
+	acked, next, retries := 0, 0, 0
+	for {
+		// Fill the window
+		for ; next < chunks && next < acked+t.window; next++ {
+			if err := t.publish(r, size, id, name, digest, next, chunks); err != nil {
+				log.Printf("Error sending chunk %d of transfer %s: %v", next, id, err)
+				break
+			}
+		}
+
+		select {
+		case ack := <-acks:
+			switch ack.Status {
+			case TransferComplete:
+				return nil
+			case TransferAbort:
+				return fmt.Errorf("transfer aborted by the receiver: %s", ack.Message)
+			}
+
+			n := ack.Next
+			if n < 0 || n > chunks {
+				continue
+			}
+			if n > acked {
+				acked = n
+				retries = 0
+			}
+			// A gap, e.g. a chunk that failed its checksum, is sent again
+			if n < next {
+				next = n
+			}
+		case <-time.After(t.ackTimeout):
+			retries++
+			if retries > t.maxRetries {
+				return fmt.Errorf("transfer %s timed out after %d of %d chunks", id, acked, chunks)
+			}
+			// Resume from the first unacknowledged chunk. Once all the chunks are acknowledged,
+			// the last chunk is sent again to ask for the verification
+			next = acked
+			if next == chunks {
+				next = chunks - 1
+			}
+		}
+	}
+}
+
+// publish sends a chunk of the payload
+func (t *Transfers) publish(r io.ReaderAt, size int64, id, name, digest string, sequence, chunks int) error {
+	offset := int64(sequence) * t.chunkSize
+	length := t.chunkSize
+	if offset+length > size {
+		length = size - offset
+	}
+
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, offset); err != nil && err != io.EOF {
+		return err
+	}
+	sum := sha256.Sum256(data)
+
+	payload, err := json.Marshal(&TransferChunk{
+		Checksum: hex.EncodeToString(sum[:]),
+		Chunks:   chunks,
+		Data:     data,
+		Digest:   digest,
+		Id:       id,
+		Name:     name,
+		Offset:   offset,
+		Sequence: sequence,
+		Size:     size,
+	})
+	if err != nil {
+		return err
+	}
+
+	token := t.client.Publish(t.chunks.Name, t.chunks.QoS, t.chunks.Retained, payload)
+	if !token.WaitTimeout(t.ackTimeout) {
+		return fmt.Errorf("timed out publishing")
+	}
+	return token.Error()
+}
+
+// register starts receiving the acknowledgements for a transfer, subscribing to them on first use
+func (t *Transfers) register(id string) (chan *TransferAck, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.active[id]; ok {
+		return nil, fmt.Errorf("transfer %s is already in progress", id)
+	}
+
+	if !t.subscribed {
+		token := t.client.Subscribe(t.acks.Name, t.acks.QoS, t.handleAck)
+		if token.Wait() && token.Error() != nil {
+			return nil, fmt.Errorf("error subscribing to topic `%s`: %v", t.acks.Name, token.Error())
+		}
+		t.subscribed = true
+	}
+
+	acks := make(chan *TransferAck, t.window+1)
+	t.active[id] = acks
+	return acks, nil
+}
+
+func (t *Transfers) unregister(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.active, id)
+}
+
+// handleAck passes an acknowledgement to its transfer. It never blocks, as
+// a later acknowledgement supersedes a dropped one
+func (t *Transfers) handleAck(_ MQTT.Client, msg MQTT.Message) {
+	ack := &TransferAck{}
+	if err := json.Unmarshal(msg.Payload(), ack); err != nil {
+		log.Printf("Error decoding the transfer acknowledgement: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	acks, ok := t.active[ack.Id]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case acks <- ack:
+	default:
+	}
+}
+
+// payloadDigest is the hex SHA-256 digest of the whole payload
+func payloadDigest(r io.ReaderAt, size int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,147 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// transferReceiver is a client that receives the chunks and acknowledges them like the cloud
+type transferReceiver struct {
+	MockClient
+	mu       sync.Mutex
+	ack      MQTT.MessageHandler
+	received [][]byte
+	drop     map[int]bool
+	corrupt  bool
+	abort    bool
+	sent     int
+}
+
+func (r *transferReceiver) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ack = callback
+	return &MockToken{}
+}
+
+func (r *transferReceiver) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	chunk := &TransferChunk{}
+	_ = json.Unmarshal(payload.([]byte), chunk)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent++
+	if r.received == nil {
+		r.received = make([][]byte, chunk.Chunks)
+	}
+
+	// A dropped chunk is lost the first time only
+	if r.drop[chunk.Sequence] {
+		delete(r.drop, chunk.Sequence)
+		return &MockToken{}
+	}
+
+	status := TransferAcked
+	sum := sha256.Sum256(chunk.Data)
+	if hex.EncodeToString(sum[:]) == chunk.Checksum {
+		r.received[chunk.Sequence] = chunk.Data
+	}
+
+	next := 0
+	for next < len(r.received) && r.received[next] != nil {
+		next++
+	}
+	if next == chunk.Chunks {
+		digest := sha256.Sum256(bytes.Join(r.received, nil))
+		if hex.EncodeToString(digest[:]) == chunk.Digest && !r.corrupt {
+			status = TransferComplete
+		} else {
+			status = TransferAbort
+		}
+	}
+	if r.abort {
+		status = TransferAbort
+	}
+
+	ack, _ := json.Marshal(&TransferAck{Id: chunk.Id, Next: next, Status: status})
+	go r.ack(r, &MockMessage{ack})
+	return &MockToken{}
+}
+
+func TestTransfers_Send(t *testing.T) {
+	payload := strings.Repeat("0123456789", 100)
+
+	tests := []struct {
+		name     string
+		payload  string
+		drop     map[int]bool
+		corrupt  bool
+		abort    bool
+		wantErr  bool
+		minSends int
+	}{
+		{"single", "abc", nil, false, false, false, 1},
+		{"empty", "", nil, false, false, false, 1},
+		{"chunked", payload, nil, false, false, false, 10},
+		{"resend", payload, map[int]bool{2: true, 7: true}, false, false, false, 12},
+		{"digest-mismatch", payload, nil, true, false, true, 10},
+		{"aborted", payload, nil, false, true, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := &transferReceiver{drop: tt.drop, corrupt: tt.corrupt, abort: tt.abort}
+			transfers := NewTransfers(receiver, DefaultTopics[TopicTransfer], DefaultTopics[TopicTransferAcks])
+			transfers.chunkSize = 100
+			transfers.window = 4
+			transfers.ackTimeout = 50 * time.Millisecond
+
+			err := transfers.Send("abc123", "logs", strings.NewReader(tt.payload), int64(len(tt.payload)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send: error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if receiver.sent < tt.minSends {
+				t.Errorf("Send: sent %d chunks, want at least %d", receiver.sent, tt.minSends)
+			}
+			if !tt.wantErr && string(bytes.Join(receiver.received, nil)) != tt.payload {
+				t.Errorf("Send: received payload does not match")
+			}
+		})
+	}
+}
+
+func TestTransfers_Timeout(t *testing.T) {
+	transfers := NewTransfers(&MockClient{}, DefaultTopics[TopicTransfer], DefaultTopics[TopicTransferAcks])
+	transfers.ackTimeout = 10 * time.Millisecond
+	transfers.maxRetries = 2
+
+	if err := transfers.Send("abc123", "logs", strings.NewReader("abc"), 3); err == nil {
+		t.Error("Send: expected timeout error, got none")
+	}
+}
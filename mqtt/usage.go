@@ -0,0 +1,414 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+// TrafficClass groups the data usage of the device
+type TrafficClass string
+
+// Traffic classes
+const (
+	TrafficActions   TrafficClass = "actions"
+	TrafficResponses TrafficClass = "responses"
+	TrafficHealth    TrafficClass = "health"
+	TrafficMetrics   TrafficClass = "metrics"
+	TrafficUploads   TrafficClass = "uploads"
+)
+
+// trafficClasses is the traffic class of each message type
+var trafficClasses = map[MessageType]TrafficClass{
+	TopicActions:      TrafficActions,
+	TopicResponses:    TrafficResponses,
+	TopicHealth:       TrafficHealth,
+	TopicPresence:     TrafficHealth,
+	TopicMetrics:      TrafficMetrics,
+	TopicInventory:    TrafficMetrics,
+	TopicLogs:         TrafficUploads,
+	TopicTransfer:     TrafficUploads,
+	TopicTransferAcks: TrafficUploads,
+}
+
+// Direction is whether the data was received or sent
+type Direction int
+
+// Directions of the data
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+const (
+	usageFileName = "usage.json"
+	// usageSaveInterval limits how often the counters are written to disk
+	usageSaveInterval = time.Minute
+	dayFormat         = "2006-01-02"
+	monthFormat       = "2006-01"
+)
+
+// budgetCheckInterval is how often a deferred upload checks whether it is within the budget
+var budgetCheckInterval = time.Minute
+
+// Counter is the number of bytes received and sent
+type Counter struct {
+	In  int64 `json:"in"`
+	Out int64 `json:"out"`
+}
+
+// Usage is the data usage over a period, e.g. a day
+type Usage struct {
+	Period  string                    `json:"period"`
+	Classes map[TrafficClass]*Counter `json:"classes"`
+	// Budget is the limit of the total bytes for the period, 0 when unlimited
+	Budget int64 `json:"budget,omitempty"`
+}
+
+// Total returns the bytes received and sent in the period
+func (u *Usage) Total() int64 {
+	var total int64
+	for _, c := range u.Classes {
+		total += c.In + c.Out
+	}
+	return total
+}
+
+func (u *Usage) exceeded() bool {
+	return u.Budget > 0 && u.Total() >= u.Budget
+}
+
+// reset starts a new period, unless it is the current one
+func (u *Usage) reset(period string) {
+	if u.Period != period || u.Classes == nil {
+		u.Period = period
+		u.Classes = map[TrafficClass]*Counter{}
+	}
+}
+
+// UsageStats is the data usage of the current day and month, which is reported in the health message
+type UsageStats struct {
+	Daily    Usage `json:"daily"`
+	Monthly  Usage `json:"monthly"`
+	Exceeded bool  `json:"exceeded,omitempty"`
+}
+
+// Meter counts the data usage per traffic class, and keeps the counters across restarts.
+// When the daily or monthly budget is exceeded, telemetry is throttled and uploads wait
+type Meter struct {
+	mu            sync.Mutex
+	path          string
+	usage         UsageStats
+	dirty         bool
+	lastSave      time.Time
+	lastTelemetry map[TrafficClass]time.Time
+	now           func() time.Time
+}
+
+// OpenMeter loads the counters from the file, starting from zero when there is none
+func OpenMeter(filePath string) *Meter {
+	m := &Meter{path: filePath, lastTelemetry: map[TrafficClass]time.Time{}, now: time.Now}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err == nil {
+		err = json.Unmarshal(data, &m.usage)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error reading the data usage, starting from zero: %v", err)
+		m.usage = UsageStats{}
+	}
+	return m
+}
+
+// Count adds the bytes to the counters of the traffic class
+func (m *Meter) Count(class TrafficClass, direction Direction, bytes int64) {
+	if m == nil || bytes <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rollover()
+	for _, u := range []*Usage{&m.usage.Daily, &m.usage.Monthly} {
+		c, ok := u.Classes[class]
+		if !ok {
+			c = &Counter{}
+			u.Classes[class] = c
+		}
+		if direction == Inbound {
+			c.In += bytes
+		} else {
+			c.Out += bytes
+		}
+	}
+
+	m.dirty = true
+	if m.now().Sub(m.lastSave) >= usageSaveInterval {
+		m.save()
+	}
+}
+
+// Stats returns the data usage of the current day and month, with the budgets
+func (m *Meter) Stats() *UsageStats {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rollover()
+
+	stats := UsageStats{Daily: copyUsage(m.usage.Daily), Monthly: copyUsage(m.usage.Monthly)}
+	stats.Daily.Budget, stats.Monthly.Budget = budgets()
+	stats.Exceeded = stats.Daily.exceeded() || stats.Monthly.exceeded()
+	return &stats
+}
+
+// Exceeded returns whether the daily or monthly budget is used up
+func (m *Meter) Exceeded() bool {
+	stats := m.Stats()
+	return stats != nil && stats.Exceeded
+}
+
+// WaitForBudget blocks until the data usage is within the budgets, e.g. on the next day,
+// or returns the error of the context when it is done first
+func (m *Meter) WaitForBudget(ctx context.Context) error {
+	for m.Exceeded() {
+		timer := time.NewTimer(budgetCheckInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// Save writes the counters to disk, if they changed
+func (m *Meter) Save() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.save()
+}
+
+// allowTelemetry throttles the telemetry of a traffic class to one message per
+// degraded interval when the budget is exceeded
+func (m *Meter) allowTelemetry(class TrafficClass) bool {
+	if m == nil {
+		return true
+	}
+
+	exceeded := m.Exceeded()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if exceeded && now.Sub(m.lastTelemetry[class]) < viper.GetDuration(config.UsageDegradedIntervalKey) {
+		return false
+	}
+	m.lastTelemetry[class] = now
+	return true
+}
+
+// rollover starts new periods when the day or month changes
+func (m *Meter) rollover() {
+	now := m.now()
+	m.usage.Daily.reset(now.Format(dayFormat))
+	m.usage.Monthly.reset(now.Format(monthFormat))
+}
+
+func (m *Meter) save() {
+	if !m.dirty || len(m.path) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(&m.usage)
+	if err != nil {
+		log.Printf("Error serializing the data usage: %v", err)
+		return
+	}
+
+	// Replace the file atomically, so a crash cannot leave a partial file
+	tmp := m.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+		err = os.Rename(tmp, m.path)
+	}
+	if err != nil {
+		log.Printf("Error saving the data usage: %v", err)
+		return
+	}
+	m.dirty = false
+	m.lastSave = m.now()
+}
+
+func copyUsage(u Usage) Usage {
+	c := Usage{Period: u.Period, Classes: map[TrafficClass]*Counter{}}
+	for class, counter := range u.Classes {
+		cc := *counter
+		c.Classes[class] = &cc
+	}
+	return c
+}
+
+// budgets returns the daily and monthly budgets in bytes, e.g. from "100MB"
+func budgets() (int64, int64) {
+	return int64(viper.GetSizeInBytes(config.UsageBudgetDailyKey)), int64(viper.GetSizeInBytes(config.UsageBudgetMonthlyKey))
+}
+
+func usagePath() string {
+	return path.Join(commonDataDir(), usageFileName)
+}
+
+// trafficClassifier returns the traffic class of the topics of a device. Any other
+// topic, e.g. a response topic requested by an action, is a response
+func trafficClassifier(topics *Topics) func(topic string) TrafficClass {
+	classes := map[string]TrafficClass{}
+	for messageType, class := range trafficClasses {
+		classes[topics.Get(messageType).Name] = class
+	}
+	return func(topic string) TrafficClass {
+		if class, ok := classes[topic]; ok {
+			return class
+		}
+		return TrafficResponses
+	}
+}
+
+// meteredClient counts the data of the messages sent and received by the client.
+// The size of a message is its topic and payload
+type meteredClient struct {
+	MQTT.Client
+	meter    *Meter
+	classify func(topic string) TrafficClass
+}
+
+func newMeteredClient(client MQTT.Client, meter *Meter, classify func(topic string) TrafficClass) *meteredClient {
+	return &meteredClient{Client: client, meter: meter, classify: classify}
+}
+
+// Publish publishes a message, counting it once it is sent
+func (c *meteredClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	return c.count(topic, payload, c.Client.Publish(topic, qos, retained, payload))
+}
+
+// PublishWithProperties publishes a message with the MQTT 5 properties, counting it once it is sent
+func (c *meteredClient) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *MessageProperties) MQTT.Token {
+	return c.count(topic, payload, Publish(c.Client, topic, qos, retained, payload, props))
+}
+
+// Subscribe subscribes to a topic, counting the received messages
+func (c *meteredClient) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	return c.Client.Subscribe(topic, qos, c.route(callback))
+}
+
+// SubscribeMultiple subscribes to the topics, counting the received messages
+func (c *meteredClient) SubscribeMultiple(filters map[string]byte, callback MQTT.MessageHandler) MQTT.Token {
+	return c.Client.SubscribeMultiple(filters, c.route(callback))
+}
+
+// AddRoute adds a handler for messages on a topic, counting the received messages
+func (c *meteredClient) AddRoute(topic string, callback MQTT.MessageHandler) {
+	c.Client.AddRoute(topic, c.route(callback))
+}
+
+// CurrentBroker returns the connected broker of a failover client
+func (c *meteredClient) CurrentBroker() string {
+	if b, ok := c.Client.(interface{ CurrentBroker() string }); ok {
+		return b.CurrentBroker()
+	}
+	return ""
+}
+
+func (c *meteredClient) route(callback MQTT.MessageHandler) MQTT.MessageHandler {
+	if callback == nil {
+		return nil
+	}
+	return func(client MQTT.Client, msg MQTT.Message) {
+		c.meter.Count(c.classify(msg.Topic()), Inbound, int64(len(msg.Topic())+len(msg.Payload())))
+		callback(client, msg)
+	}
+}
+
+// count counts the message when its token succeeds, so a message that fails and is
+// sent again from the queue is counted once
+func (c *meteredClient) count(topic string, payload interface{}, token MQTT.Token) MQTT.Token {
+	data, err := payloadBytes(payload)
+	if err != nil {
+		return token
+	}
+
+	counted := &countedToken{Token: token}
+	counted.count = func() {
+		c.meter.Count(c.classify(topic), Outbound, int64(len(topic)+len(data)))
+	}
+	// The message is counted even when the caller does not wait for the token
+	go func() {
+		<-token.Done()
+		counted.completed()
+	}()
+	return counted
+}
+
+// countedToken counts a message once its publish succeeds
+type countedToken struct {
+	MQTT.Token
+	once  sync.Once
+	count func()
+}
+
+// Wait waits for the publish and counts the message, so it is counted when Wait returns
+func (t *countedToken) Wait() bool {
+	done := t.Token.Wait()
+	if done {
+		t.completed()
+	}
+	return done
+}
+
+// WaitTimeout waits for the publish up to the timeout, and counts the message when it completed
+func (t *countedToken) WaitTimeout(timeout time.Duration) bool {
+	done := t.Token.WaitTimeout(timeout)
+	if done {
+		t.completed()
+	}
+	return done
+}
+
+func (t *countedToken) completed() {
+	if t.Token.Error() == nil {
+		t.once.Do(t.count)
+	}
+}
@@ -0,0 +1,215 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/everactive/iot-identity/domain"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+func TestMeter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatalf("cannot create directory: %v", err)
+	}
+	filePath := path.Join(dir, usageFileName)
+
+	now := time.Date(2021, 6, 30, 12, 0, 0, 0, time.UTC)
+	m := OpenMeter(filePath)
+	m.now = func() time.Time { return now }
+
+	m.Count(TrafficActions, Inbound, 100)
+	m.Count(TrafficResponses, Outbound, 200)
+	m.Count(TrafficResponses, Outbound, 50)
+
+	stats := m.Stats()
+	if stats.Daily.Period != "2021-06-30" || stats.Monthly.Period != "2021-06" {
+		t.Errorf("Stats() periods = %s, %s", stats.Daily.Period, stats.Monthly.Period)
+	}
+	if c := stats.Daily.Classes[TrafficResponses]; c.Out != 250 || c.In != 0 {
+		t.Errorf("Stats() responses = %+v", c)
+	}
+	if total := stats.Monthly.Total(); total != 350 {
+		t.Errorf("Stats() monthly total = %d", total)
+	}
+
+	// The counters are kept across restarts
+	m.Save()
+	reopened := OpenMeter(filePath)
+	reopened.now = m.now
+	if total := reopened.Stats().Daily.Total(); total != 350 {
+		t.Errorf("OpenMeter() daily total = %d", total)
+	}
+
+	// A new day resets the daily counters, but not the monthly
+	now = now.Add(24 * time.Hour)
+	stats = reopened.Stats()
+	if stats.Daily.Total() != 0 || stats.Daily.Period != "2021-07-01" || stats.Monthly.Total() != 0 {
+		t.Errorf("Stats() next day and month = %+v", stats)
+	}
+	now = now.Add(24 * time.Hour)
+	reopened.Count(TrafficHealth, Outbound, 10)
+	now = now.Add(24 * time.Hour)
+	if stats = reopened.Stats(); stats.Daily.Total() != 0 || stats.Monthly.Total() != 10 {
+		t.Errorf("Stats() next day = %+v", stats)
+	}
+
+	var nilMeter *Meter
+	nilMeter.Count(TrafficHealth, Outbound, 10)
+	if nilMeter.Stats() != nil || nilMeter.Exceeded() || !nilMeter.allowTelemetry(TrafficHealth) {
+		t.Error("a nil meter should not count or limit")
+	}
+}
+
+func TestMeter_Budget(t *testing.T) {
+	defer viper.Set(config.UsageBudgetDailyKey, "")
+	defer viper.Set(config.UsageBudgetMonthlyKey, "")
+	viper.Set(config.UsageDegradedIntervalKey, time.Hour)
+
+	now := time.Date(2021, 6, 30, 12, 0, 0, 0, time.UTC)
+	m := OpenMeter("")
+	m.now = func() time.Time { return now }
+
+	viper.Set(config.UsageBudgetDailyKey, "1KB")
+	viper.Set(config.UsageBudgetMonthlyKey, "1MB")
+	m.Count(TrafficMetrics, Outbound, 1000)
+	if m.Exceeded() {
+		t.Error("Exceeded() within the budget")
+	}
+	if !m.allowTelemetry(TrafficMetrics) || !m.allowTelemetry(TrafficMetrics) {
+		t.Error("allowTelemetry() should not throttle within the budget")
+	}
+
+	m.Count(TrafficMetrics, Outbound, 24)
+	stats := m.Stats()
+	if !stats.Exceeded || stats.Daily.Budget != 1024 || stats.Monthly.Budget != 1024*1024 {
+		t.Errorf("Stats() over the daily budget = %+v", stats)
+	}
+
+	// Over the budget, telemetry is sent once per degraded interval
+	now = now.Add(time.Hour)
+	if !m.allowTelemetry(TrafficMetrics) {
+		t.Error("allowTelemetry() should allow the first message of the interval")
+	}
+	if m.allowTelemetry(TrafficMetrics) {
+		t.Error("allowTelemetry() should throttle over the budget")
+	}
+	if !m.allowTelemetry(TrafficHealth) {
+		t.Error("allowTelemetry() should throttle each traffic class separately")
+	}
+
+	// Waiting for the budget stops when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.WaitForBudget(ctx); err != context.Canceled {
+		t.Errorf("WaitForBudget() = %v, want %v", err, context.Canceled)
+	}
+
+	// The next day is within the budget again
+	now = now.Add(24 * time.Hour)
+	if err := m.WaitForBudget(context.Background()); err != nil {
+		t.Errorf("WaitForBudget() = %v", err)
+	}
+	if m.Exceeded() {
+		t.Error("Exceeded() on the next day")
+	}
+}
+
+func TestMeteredClient(t *testing.T) {
+	enroll := &domain.Enrollment{ID: "a111", Organization: domain.Organization{ID: "abc"}}
+	topics := NewTopics(enroll)
+	m := OpenMeter("")
+	client := &routingClient{}
+	c := newMeteredClient(client, m, trafficClassifier(topics))
+
+	health := topics.Get(TopicHealth).Name
+	c.Publish(health, QOSAtMostOnce, false, []byte("1234")).Wait()
+	Publish(c, "custom/response", QOSAtLeastOnce, false, "123456", &MessageProperties{ContentType: "application/json"}).Wait()
+
+	// A message that fails is not counted
+	client.err = fmt.Errorf("MOCK publish error")
+	c.Publish(health, QOSAtMostOnce, false, []byte("5678")).Wait()
+
+	actions := topics.Get(TopicActions).Name
+	received := false
+	c.Subscribe(actions, QOSAtLeastOnce, func(MQTT.Client, MQTT.Message) { received = true })
+	client.callback(client, &topicMessage{topic: actions, payload: []byte("12")})
+
+	stats := m.Stats()
+	if got := stats.Daily.Classes[TrafficHealth].Out; got != int64(len(health)+4) {
+		t.Errorf("health bytes out = %d", got)
+	}
+	if got := stats.Daily.Classes[TrafficResponses].Out; got != int64(len("custom/response")+6) {
+		t.Errorf("responses bytes out = %d", got)
+	}
+	if got := stats.Daily.Classes[TrafficActions].In; !received || got != int64(len(actions)+2) {
+		t.Errorf("actions bytes in = %d, received %v", got, received)
+	}
+}
+
+// routingClient keeps the subscription callback
+type routingClient struct {
+	MockClient
+	callback MQTT.MessageHandler
+	err      error
+}
+
+func (cli *routingClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	return &errorToken{err: cli.err}
+}
+
+// errorToken is a completed token with an error
+type errorToken struct {
+	MockToken
+	err error
+}
+
+func (t *errorToken) Error() error {
+	return t.err
+}
+
+func (cli *routingClient) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	cli.callback = callback
+	return &MockToken{}
+}
+
+type topicMessage struct {
+	MockMessage
+	topic   string
+	payload []byte
+}
+
+func (m *topicMessage) Topic() string {
+	return m.topic
+}
+
+func (m *topicMessage) Payload() []byte {
+	return m.payload
+}
@@ -0,0 +1,405 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// Timings for the MQTT 5 connection
+const (
+	v5KeepAlive      = 30
+	v5ConnectTimeout = 30 * time.Second
+)
+
+// v5Client is an MQTT 5 client that implements the paho MQTT 3.1.1 client
+// interface, so that the rest of the agent is independent of the protocol version.
+// Like an MQTT 3.1.1 client without auto-reconnect, it reports a lost connection
+// and leaves reconnecting to the failover client
+type v5Client struct {
+	mu        sync.RWMutex
+	cli       *paho.Client
+	router    *paho.StandardRouter
+	endpoint  *Endpoint
+	clientID  string
+	tlsConfig *tls.Config
+	connected bool
+
+	// keepAlive is the interval of the pings to the broker, in seconds
+	keepAlive uint16
+	// open opens the connection to the broker, e.g. through a proxy
+	open func(e *Endpoint, tlsConfig *tls.Config) (net.Conn, error)
+
+	// will is published by the broker when the connection is lost
+	will *paho.WillMessage
+	// cleanStart discards the session on connect. Otherwise, the broker keeps the session
+	// for sessionExpiry seconds after the connection is lost
+	cleanStart    bool
+	sessionExpiry uint32
+	// onConnectionLost is called when the connection drops, like the MQTT 3.1.1 ConnectionLostHandler
+	onConnectionLost MQTT.ConnectionLostHandler
+}
+
+func newV5Client(endpoint *Endpoint, clientID string, tlsConfig *tls.Config, dialer *Dialer) *v5Client {
+	return &v5Client{
+		router:     paho.NewStandardRouter(),
+		cleanStart: true,
+		keepAlive:  v5KeepAlive,
+		endpoint:   endpoint,
+		clientID:   clientID,
+		tlsConfig:  tlsConfig,
+		open:       dialer.openConnection,
+	}
+}
+
+// IsConnected returns whether the client is connected to the broker
+func (c *v5Client) IsConnected() bool {
+	return c.IsConnectionOpen()
+}
+
+// IsConnectionOpen returns whether the client has a live connection to the broker
+func (c *v5Client) IsConnectionOpen() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
+// Connect connects to the broker
+func (c *v5Client) Connect() MQTT.Token {
+	return runToken(c.connect)
+}
+
+func (c *v5Client) connect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), v5ConnectTimeout)
+	defer cancel()
+
+	conn, err := c.open(c.endpoint, c.tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	cli := paho.NewClient(paho.ClientConfig{
+		ClientID:           c.clientID,
+		Conn:               conn,
+		Router:             c.router,
+		OnServerDisconnect: c.onServerDisconnect,
+		OnClientError:      c.onClientError,
+	})
+
+	ca, err := cli.Connect(ctx, &paho.Connect{
+		ClientID:    c.clientID,
+		KeepAlive:   c.keepAlive,
+		CleanStart:  c.cleanStart,
+		WillMessage: c.will,
+		Properties:  &paho.ConnectProperties{SessionExpiryInterval: &c.sessionExpiry},
+	})
+	if err != nil {
+		if ca != nil && isAuthReasonCode(ca.ReasonCode) {
+			return fmt.Errorf("%w, reason code %d (%s): %v", ErrNotAuthorized, ca.ReasonCode, (&packets.Connack{ReasonCode: ca.ReasonCode}).Reason(), err)
+		}
+		if ca != nil {
+			return fmt.Errorf("connection refused by broker, reason code %d (%s): %v", ca.ReasonCode, (&packets.Connack{ReasonCode: ca.ReasonCode}).Reason(), err)
+		}
+		return err
+	}
+
+	c.mu.Lock()
+	c.cli = cli
+	c.connected = true
+	c.mu.Unlock()
+	return nil
+}
+
+// onServerDisconnect reports the reason the broker closed the connection
+func (c *v5Client) onServerDisconnect(d *paho.Disconnect) {
+	reason := d.Packet().Reason()
+	if d.Properties != nil && len(d.Properties.ReasonString) > 0 {
+		reason = d.Properties.ReasonString
+	}
+	c.connectionLost(fmt.Errorf("disconnected by the broker, reason code %d: %s", d.ReasonCode, reason))
+}
+
+// onClientError reports a lost connection, e.g. a network error
+func (c *v5Client) onClientError(err error) {
+	c.connectionLost(err)
+}
+
+func (c *v5Client) connectionLost(err error) {
+	c.mu.Lock()
+	if !c.connected {
+		c.mu.Unlock()
+		return
+	}
+	c.connected = false
+	c.mu.Unlock()
+
+	if c.onConnectionLost != nil {
+		go c.onConnectionLost(c, err)
+	}
+}
+
+// Disconnect closes the connection with a normal disconnection reason code
+func (c *v5Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	cli := c.cli
+	c.connected = false
+	c.mu.Unlock()
+
+	if cli == nil {
+		return
+	}
+
+	time.Sleep(time.Duration(quiesce) * time.Millisecond)
+	if err := cli.Disconnect(&paho.Disconnect{ReasonCode: packets.DisconnectNormalDisconnection}); err != nil {
+		log.Printf("Error disconnecting from the MQTT broker: %v", err)
+	}
+}
+
+// Publish publishes a message without properties
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	return c.PublishWithProperties(topic, qos, retained, payload, nil)
+}
+
+// PublishWithProperties publishes a message with the MQTT 5 properties
+func (c *v5Client) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *MessageProperties) MQTT.Token {
+	return runToken(func() error {
+		data, err := payloadBytes(payload)
+		if err != nil {
+			return err
+		}
+
+		cli, err := c.client()
+		if err != nil {
+			return err
+		}
+
+		_, err = cli.Publish(context.Background(), &paho.Publish{
+			QoS:        qos,
+			Retain:     retained,
+			Topic:      topic,
+			Properties: props.publishProperties(),
+			Payload:    data,
+		})
+		return err
+	})
+}
+
+// Subscribe subscribes to a single topic
+func (c *v5Client) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple subscribes to the topics
+func (c *v5Client) SubscribeMultiple(filters map[string]byte, callback MQTT.MessageHandler) MQTT.Token {
+	return runToken(func() error {
+		cli, err := c.client()
+		if err != nil {
+			return err
+		}
+
+		subscriptions := map[string]paho.SubscribeOptions{}
+		for topic, qos := range filters {
+			c.AddRoute(topic, callback)
+			subscriptions[topic] = paho.SubscribeOptions{QoS: qos}
+		}
+
+		_, err = cli.Subscribe(context.Background(), &paho.Subscribe{Subscriptions: subscriptions})
+		return err
+	})
+}
+
+// Unsubscribe removes the subscriptions to the topics
+func (c *v5Client) Unsubscribe(topics ...string) MQTT.Token {
+	return runToken(func() error {
+		for _, topic := range topics {
+			c.router.UnregisterHandler(topic)
+		}
+
+		cli, err := c.client()
+		if err != nil {
+			return err
+		}
+		_, err = cli.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+// AddRoute adds a handler for messages on a topic without subscribing,
+// replacing any existing handler for the topic
+func (c *v5Client) AddRoute(topic string, callback MQTT.MessageHandler) {
+	c.router.UnregisterHandler(topic)
+	c.router.RegisterHandler(topic, func(p *paho.Publish) {
+		callback(c, &v5Message{publish: p})
+	})
+}
+
+// OptionsReader returns the options of the connection
+func (c *v5Client) OptionsReader() MQTT.ClientOptionsReader {
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(c.endpoint.URL())
+	opts.SetClientID(c.clientID)
+	opts.SetTLSConfig(c.tlsConfig)
+	return MQTT.NewClient(opts).OptionsReader()
+}
+
+func (c *v5Client) client() (*paho.Client, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.connected || c.cli == nil {
+		return nil, fmt.Errorf("not connected to the MQTT broker")
+	}
+	return c.cli, nil
+}
+
+// payloadBytes converts the payload types accepted by the MQTT 3.1.1 client
+func payloadBytes(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case []byte:
+		return p, nil
+	case string:
+		return []byte(p), nil
+	case bytes.Buffer:
+		return p.Bytes(), nil
+	case *bytes.Buffer:
+		return p.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown payload type %T", payload)
+	}
+}
+
+// v5Message is a received MQTT 5 message
+type v5Message struct {
+	publish *paho.Publish
+}
+
+// Duplicate is always false, as MQTT 5 does not expose the flag
+func (m *v5Message) Duplicate() bool {
+	return false
+}
+
+// Qos returns the QoS of the message
+func (m *v5Message) Qos() byte {
+	return m.publish.QoS
+}
+
+// Retained returns whether the message was retained by the broker
+func (m *v5Message) Retained() bool {
+	return m.publish.Retain
+}
+
+// Topic returns the topic of the message
+func (m *v5Message) Topic() string {
+	return m.publish.Topic
+}
+
+// MessageID returns the packet ID of the message
+func (m *v5Message) MessageID() uint16 {
+	return m.publish.PacketID
+}
+
+// Payload returns the message content
+func (m *v5Message) Payload() []byte {
+	return m.publish.Payload
+}
+
+// Ack does nothing, as the client acknowledges messages automatically
+func (m *v5Message) Ack() {
+}
+
+// Properties returns the MQTT 5 properties of the message
+func (m *v5Message) Properties() *MessageProperties {
+	props := &MessageProperties{}
+	p := m.publish.Properties
+	if p == nil {
+		return props
+	}
+
+	props.ContentType = p.ContentType
+	props.CorrelationData = p.CorrelationData
+	props.ResponseTopic = p.ResponseTopic
+	if p.MessageExpiry != nil {
+		props.MessageExpiry = time.Duration(*p.MessageExpiry) * time.Second
+	}
+	if len(p.User) > 0 {
+		props.UserProperties = map[string]string{}
+		for _, u := range p.User {
+			props.UserProperties[u.Key] = u.Value
+		}
+	}
+	return props
+}
+
+// v5Token tracks the completion of an MQTT 5 operation
+type v5Token struct {
+	done chan struct{}
+	err  error
+}
+
+// runToken runs the operation in the background, like the MQTT 3.1.1 client
+func runToken(operation func() error) *v5Token {
+	t := &v5Token{done: make(chan struct{})}
+	go func() {
+		t.err = operation()
+		close(t.done)
+	}()
+	return t
+}
+
+// Wait waits for the operation to complete
+func (t *v5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+// WaitTimeout waits for the operation to complete or the timeout to expire
+func (t *v5Token) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// Done returns a channel that is closed when the operation completes
+func (t *v5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+// Error returns the error of a completed operation
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,375 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/everactive/iot-identity/domain"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+// fakeV5Broker is an MQTT 5 broker on the other end of a pipe, which acknowledges
+// the packets from the client and records them
+type fakeV5Broker struct {
+	mu       sync.Mutex
+	reason   byte
+	conn     net.Conn
+	received chan *packets.ControlPacket
+}
+
+func newFakeV5Broker() *fakeV5Broker {
+	return &fakeV5Broker{received: make(chan *packets.ControlPacket, 20)}
+}
+
+// open is the connection function of the client, which connects it to the broker
+func (b *fakeV5Broker) open(*Endpoint, *tls.Config) (net.Conn, error) {
+	client, server := net.Pipe()
+	b.mu.Lock()
+	b.conn = server
+	b.mu.Unlock()
+	go b.serve(server)
+	return client, nil
+}
+
+func (b *fakeV5Broker) serve(conn net.Conn) {
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		var ack *packets.ControlPacket
+		switch c := p.Content.(type) {
+		case *packets.Connect:
+			ack = packets.NewControlPacket(packets.CONNACK)
+			ack.Content.(*packets.Connack).ReasonCode = b.reason
+		case *packets.Subscribe:
+			ack = packets.NewControlPacket(packets.SUBACK)
+			ack.Content.(*packets.Suback).PacketID = c.PacketID
+			for _, s := range c.Subscriptions {
+				ack.Content.(*packets.Suback).Reasons = append(ack.Content.(*packets.Suback).Reasons, s.QoS)
+			}
+		case *packets.Unsubscribe:
+			ack = packets.NewControlPacket(packets.UNSUBACK)
+			ack.Content.(*packets.Unsuback).PacketID = c.PacketID
+			ack.Content.(*packets.Unsuback).Reasons = make([]byte, len(c.Topics))
+		case *packets.Publish:
+			if c.QoS == 1 {
+				ack = packets.NewControlPacket(packets.PUBACK)
+				ack.Content.(*packets.Puback).PacketID = c.PacketID
+			}
+		case *packets.Pingreq:
+			ack = packets.NewControlPacket(packets.PINGRESP)
+		}
+		b.received <- p
+		if ack != nil {
+			if _, err := ack.WriteTo(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// send publishes a message to the client
+func (b *fakeV5Broker) send(t *testing.T, publish *packets.Publish) {
+	p := packets.NewControlPacket(packets.PUBLISH)
+	p.Content = publish
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := p.WriteTo(b.conn); err != nil {
+		t.Fatalf("cannot send the message: %v", err)
+	}
+}
+
+// disconnect sends a DISCONNECT with the reason code and closes the connection
+func (b *fakeV5Broker) disconnect(reason byte) {
+	p := packets.NewControlPacket(packets.DISCONNECT)
+	p.Content.(*packets.Disconnect).ReasonCode = reason
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, _ = p.WriteTo(b.conn)
+	_ = b.conn.Close()
+}
+
+// next returns the next packet of the type from the client
+func (b *fakeV5Broker) next(t *testing.T, packetType byte) *packets.ControlPacket {
+	for {
+		select {
+		case p := <-b.received:
+			if p.Type == packetType {
+				return p
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s packet from the client", packets.NewControlPacket(packetType).PacketType())
+			return nil
+		}
+	}
+}
+
+func newTestV5Client(broker *fakeV5Broker) *v5Client {
+	c := newV5Client(&Endpoint{Scheme: SchemeSSL, Host: "mqtt.example.com", Port: "8883"}, "a111", &tls.Config{}, &Dialer{})
+	c.open = broker.open
+	c.keepAlive = 1
+	return c
+}
+
+func TestV5Client_Connect(t *testing.T) {
+	broker := newFakeV5Broker()
+	c := newTestV5Client(broker)
+	c.will = &paho.WillMessage{Topic: "devices/presence/a111", QoS: 1, Retain: true, Payload: []byte("offline")}
+	c.cleanStart = false
+	c.sessionExpiry = 3600
+
+	if token := c.Connect(); !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+		t.Fatalf("Connect() error = %v", token.Error())
+	}
+	if !c.IsConnected() {
+		t.Error("IsConnected() = false after connecting")
+	}
+
+	connect := broker.next(t, packets.CONNECT).Content.(*packets.Connect)
+	if connect.ClientID != "a111" || connect.CleanStart {
+		t.Errorf("CONNECT client ID = %s, clean start = %v", connect.ClientID, connect.CleanStart)
+	}
+	if connect.WillTopic != "devices/presence/a111" || string(connect.WillMessage) != "offline" || !connect.WillRetain {
+		t.Errorf("CONNECT will = %s %s", connect.WillTopic, connect.WillMessage)
+	}
+	if connect.Properties.SessionExpiryInterval == nil || *connect.Properties.SessionExpiryInterval != 3600 {
+		t.Errorf("CONNECT session expiry = %v, want 3600", connect.Properties.SessionExpiryInterval)
+	}
+
+	c.Disconnect(0)
+	if c.IsConnected() {
+		t.Error("IsConnected() = true after disconnecting")
+	}
+	if reason := broker.next(t, packets.DISCONNECT).Content.(*packets.Disconnect).ReasonCode; reason != packets.DisconnectNormalDisconnection {
+		t.Errorf("DISCONNECT reason code = %d, want %d", reason, packets.DisconnectNormalDisconnection)
+	}
+}
+
+func TestNewClient_Will(t *testing.T) {
+	defer viper.Set(config.MQTTProtocolVersionKey, viper.Get(config.MQTTProtocolVersionKey))
+	viper.Set(config.MQTTProtocolVersionKey, ProtocolVersion5)
+
+	enroll := &domain.Enrollment{ID: "a111", Organization: domain.Organization{ID: "abc"}}
+	enroll.Credentials.MQTTURL, enroll.Credentials.MQTTPort = "mqtt.example.com", "8883"
+	client, err := newClient(enroll, NewTopics(enroll).Get(TopicPresence), &tls.Config{}, &certVerifier{mode: VerifyNone}, &Dialer{}, &stateHandlers{}, nil)
+	if err != nil {
+		t.Fatalf("newClient() error = %v", err)
+	}
+	fc := client.(*failoverClient)
+
+	// The will of each connection has the time of the connection
+	willTime := func() time.Time {
+		var presence Presence
+		_ = json.Unmarshal(fc.newClient(fc.endpoints[0], nil).(*v5Client).will.Payload, &presence)
+		return presence.Timestamp
+	}
+	first := willTime()
+	time.Sleep(10 * time.Millisecond)
+	if second := willTime(); !second.After(first) {
+		t.Errorf("will timestamp = %s on reconnecting, want after %s", second, first)
+	}
+}
+
+func TestV5Client_Connect_Refused(t *testing.T) {
+	tests := []struct {
+		name       string
+		reason     byte
+		authFailed bool
+	}{
+		{"not-authorized", 0x87, true},
+		{"bad-credentials", 0x86, true},
+		{"server-unavailable", 0x88, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newFakeV5Broker()
+			broker.reason = tt.reason
+			c := newTestV5Client(broker)
+
+			token := c.Connect()
+			token.Wait()
+			if token.Error() == nil {
+				t.Fatal("Connect() expected an error")
+			}
+			if errors.Is(token.Error(), ErrNotAuthorized) != tt.authFailed {
+				t.Errorf("Connect() error = %v, auth failure = %v", token.Error(), tt.authFailed)
+			}
+			if c.IsConnected() {
+				t.Error("IsConnected() = true after a refused connection")
+			}
+		})
+	}
+}
+
+func TestV5Client_PublishSubscribe(t *testing.T) {
+	broker := newFakeV5Broker()
+	c := newTestV5Client(broker)
+
+	// Operations fail until the client is connected
+	if token := c.Publish("devices/pub/a111", 1, false, "early"); token.Wait() && token.Error() == nil {
+		t.Error("Publish() expected an error before connecting")
+	}
+
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect() error = %v", token.Error())
+	}
+
+	messages := make(chan MQTT.Message, 1)
+	if token := c.Subscribe("devices/sub/a111", 1, func(_ MQTT.Client, m MQTT.Message) { messages <- m }); token.Wait() && token.Error() != nil {
+		t.Fatalf("Subscribe() error = %v", token.Error())
+	}
+	if subs := broker.next(t, packets.SUBSCRIBE).Content.(*packets.Subscribe).Subscriptions; subs["devices/sub/a111"].QoS != 1 {
+		t.Errorf("SUBSCRIBE subscriptions = %v", subs)
+	}
+
+	// An incoming action is routed to the handler, with its properties
+	broker.send(t, &packets.Publish{
+		Topic:   "devices/sub/a111",
+		Payload: []byte(`{"action":"device"}`),
+		Properties: &packets.Properties{
+			ResponseTopic:   "devices/pub/a111/req1",
+			CorrelationData: []byte("req1"),
+			User:            []packets.User{{Key: "encoding", Value: "cbor"}},
+		},
+	})
+	select {
+	case m := <-messages:
+		props := GetProperties(m)
+		if string(m.Payload()) != `{"action":"device"}` || props == nil {
+			t.Fatalf("message = %s, properties = %v", m.Payload(), props)
+		}
+		if props.ResponseTopic != "devices/pub/a111/req1" || string(props.CorrelationData) != "req1" || props.UserProperties["encoding"] != "cbor" {
+			t.Errorf("message properties = %+v", props)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message for the subscription")
+	}
+
+	// A response is published with its properties
+	props := &MessageProperties{ContentType: "application/json", CorrelationData: []byte("req1"), MessageExpiry: time.Minute}
+	if token := c.PublishWithProperties("devices/pub/a111/req1", 1, false, []byte(`{"success":true}`), props); token.Wait() && token.Error() != nil {
+		t.Fatalf("PublishWithProperties() error = %v", token.Error())
+	}
+	publish := broker.next(t, packets.PUBLISH).Content.(*packets.Publish)
+	if publish.Topic != "devices/pub/a111/req1" || string(publish.Payload) != `{"success":true}` || publish.QoS != 1 {
+		t.Errorf("PUBLISH = %s %s QoS %d", publish.Topic, publish.Payload, publish.QoS)
+	}
+	if publish.Properties.ContentType != "application/json" || string(publish.Properties.CorrelationData) != "req1" ||
+		publish.Properties.MessageExpiry == nil || *publish.Properties.MessageExpiry != 60 {
+		t.Errorf("PUBLISH properties = %+v", publish.Properties)
+	}
+
+	if token := c.Unsubscribe("devices/sub/a111"); token.Wait() && token.Error() != nil {
+		t.Fatalf("Unsubscribe() error = %v", token.Error())
+	}
+	if topics := broker.next(t, packets.UNSUBSCRIBE).Content.(*packets.Unsubscribe).Topics; len(topics) != 1 || topics[0] != "devices/sub/a111" {
+		t.Errorf("UNSUBSCRIBE topics = %v", topics)
+	}
+}
+
+func TestV5Client_ConnectionLost(t *testing.T) {
+	broker := newFakeV5Broker()
+	c := newTestV5Client(broker)
+	lost := make(chan error, 1)
+	c.onConnectionLost = func(_ MQTT.Client, err error) { lost <- err }
+
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect() error = %v", token.Error())
+	}
+	messages := make(chan MQTT.Message, 1)
+	c.Subscribe("devices/sub/a111", 1, func(_ MQTT.Client, m MQTT.Message) { messages <- m }).Wait()
+
+	// The broker closing the connection is reported, with its reason
+	broker.disconnect(packets.DisconnectServerShuttingDown)
+	select {
+	case err := <-lost:
+		if err == nil {
+			t.Error("connection lost without an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the lost connection was not reported")
+	}
+	if c.IsConnected() {
+		t.Error("IsConnected() = true after the connection was lost")
+	}
+
+	// Reconnecting keeps the routes, so the failover client only needs to subscribe again
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect() error = %v", token.Error())
+	}
+	if token := c.Subscribe("devices/sub/a111", 1, func(_ MQTT.Client, m MQTT.Message) { messages <- m }); token.Wait() && token.Error() != nil {
+		t.Fatalf("Subscribe() error = %v", token.Error())
+	}
+	broker.send(t, &packets.Publish{Topic: "devices/sub/a111", Payload: []byte("again")})
+	select {
+	case m := <-messages:
+		if string(m.Payload()) != "again" {
+			t.Errorf("message = %s, want again", m.Payload())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message after reconnecting")
+	}
+}
+
+func TestRunToken(t *testing.T) {
+	release := make(chan struct{})
+	token := runToken(func() error {
+		<-release
+		return errors.New("MOCK error")
+	})
+
+	if token.WaitTimeout(10 * time.Millisecond) {
+		t.Error("WaitTimeout() = true before the operation completed")
+	}
+	if token.Error() != nil {
+		t.Errorf("Error() = %v before the operation completed", token.Error())
+	}
+
+	close(release)
+	<-token.Done()
+	if token.Error() == nil || token.Error().Error() != "MOCK error" {
+		t.Errorf("Error() = %v, want MOCK error", token.Error())
+	}
+}
+
+func TestPayloadBytes(t *testing.T) {
+	for _, payload := range []interface{}{[]byte("data"), "data"} {
+		if got, err := payloadBytes(payload); err != nil || string(got) != "data" {
+			t.Errorf("payloadBytes(%T) = %s, %v", payload, got, err)
+		}
+	}
+	if _, err := payloadBytes(42); err == nil {
+		t.Error("payloadBytes() expected an error for an unknown type")
+	}
+}
@@ -0,0 +1,185 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Broker certificate verification modes
+const (
+	// VerifyHostname verifies the certificate chain against the root certificate and the broker hostname
+	VerifyHostname = "hostname"
+	// VerifySPKI verifies the certificate chain against the root certificate and the pinned public keys
+	VerifySPKI = "spki"
+	// VerifyNone skips verification, which is only for lab setups
+	VerifyNone = "none"
+)
+
+// CertificateError is the error when the broker certificate fails verification
+type CertificateError struct {
+	Mode string
+	Err  error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("cannot verify the MQTT broker certificate (mqtt.tls.verify=%s): %v", e.Mode, e.Err)
+}
+
+// certVerifier verifies the broker certificate and keeps the last failure, as the
+// MQTT client reports a handshake failure as a generic network error
+type certVerifier struct {
+	mu    sync.Mutex
+	mode  string
+	roots *x509.CertPool
+	pins  map[string]bool
+	err   error
+}
+
+// newCertVerifier creates the verifier for the root certificate from enrollment.
+// Pinning needs explicit pins, as pinning the root's own keys adds nothing to the chain check
+func newCertVerifier(mode string, rootCert []byte, pins []string) (*certVerifier, error) {
+	v := &certVerifier{mode: mode, roots: x509.NewCertPool(), pins: map[string]bool{}}
+
+	switch mode {
+	case VerifyNone:
+		return v, nil
+	case VerifyHostname, VerifySPKI:
+	default:
+		return nil, fmt.Errorf("unsupported MQTT broker certificate verification mode: %s", mode)
+	}
+
+	roots, err := parseCertificates(rootCert)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range roots {
+		v.roots.AddCert(c)
+	}
+
+	for _, p := range pins {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			v.pins[p] = true
+		}
+	}
+	if mode == VerifySPKI && len(v.pins) == 0 {
+		return nil, fmt.Errorf("MQTT broker certificate verification mode %s needs the pinned public keys in mqtt.tls.pins", mode)
+	}
+	return v, nil
+}
+
+// verifyConnection returns the check of the certificate chain presented by a broker.
+// The server name is the broker hostname, which differs between brokers
+func (v *certVerifier) verifyConnection(serverName string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		err := v.verify(cs.PeerCertificates, serverName)
+
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		v.err = err
+		return err
+	}
+}
+
+func (v *certVerifier) verify(certs []*x509.Certificate, serverName string) error {
+	if len(certs) == 0 {
+		return &CertificateError{Mode: v.mode, Err: fmt.Errorf("no certificate presented")}
+	}
+
+	opts := x509.VerifyOptions{Roots: v.roots, Intermediates: x509.NewCertPool()}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if v.mode == VerifyHostname {
+		opts.DNSName = serverName
+	}
+
+	chains, err := certs[0].Verify(opts)
+	if err != nil {
+		return &CertificateError{Mode: v.mode, Err: err}
+	}
+
+	if v.mode == VerifySPKI {
+		for _, chain := range chains {
+			for _, c := range chain {
+				if v.pins[spkiHash(c)] {
+					return nil
+				}
+			}
+		}
+		return &CertificateError{Mode: v.mode, Err: fmt.Errorf("no certificate matches the pinned public keys")}
+	}
+	return nil
+}
+
+// reset clears the last verification failure before connecting to a broker, so the
+// failure of an earlier broker is not reported for a connection that fails otherwise
+func (v *certVerifier) reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.err = nil
+}
+
+// lastError returns and clears the last verification failure
+func (v *certVerifier) lastError() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	err := v.err
+	v.err = nil
+	return err
+}
+
+// spkiHash is the base64 SHA-256 hash of the public key of a certificate, the usual pin format
+func spkiHash(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse the root certificate: %v", err)
+		}
+		certs = append(certs, c)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no root certificate in the enrollment to verify the MQTT broker")
+	}
+	return certs, nil
+}
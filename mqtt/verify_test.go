@@ -0,0 +1,150 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func generateCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	} else {
+		template.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %v", err)
+	}
+	return c, key
+}
+
+func TestCertVerifier(t *testing.T) {
+	root, rootKey := generateCert(t, "root", nil, nil)
+	broker, _ := generateCert(t, "mqtt.example.com", root, rootKey)
+	other, otherKey := generateCert(t, "other", nil, nil)
+	rogue, _ := generateCert(t, "mqtt.example.com", other, otherKey)
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+
+	tests := []struct {
+		name       string
+		mode       string
+		rootCert   []byte
+		serverName string
+		pins       []string
+		chain      []*x509.Certificate
+		newErr     bool
+		verifyErr  bool
+	}{
+		{"hostname-valid", VerifyHostname, rootPEM, "mqtt.example.com", nil, []*x509.Certificate{broker}, false, false},
+		{"hostname-mismatch", VerifyHostname, rootPEM, "10.0.0.1", nil, []*x509.Certificate{broker}, false, true},
+		{"hostname-unknown-root", VerifyHostname, rootPEM, "mqtt.example.com", nil, []*x509.Certificate{rogue}, false, true},
+		{"hostname-no-chain", VerifyHostname, rootPEM, "mqtt.example.com", nil, nil, false, true},
+		{"spki-no-pins", VerifySPKI, rootPEM, "10.0.0.1", []string{" ", ""}, nil, true, false},
+		{"spki-root-pin", VerifySPKI, rootPEM, "10.0.0.1", []string{spkiHash(root)}, []*x509.Certificate{broker}, false, false},
+		{"spki-broker-pin", VerifySPKI, rootPEM, "10.0.0.1", []string{spkiHash(broker)}, []*x509.Certificate{broker}, false, false},
+		{"spki-pin-mismatch", VerifySPKI, rootPEM, "10.0.0.1", []string{spkiHash(other)}, []*x509.Certificate{broker}, false, true},
+		{"spki-unknown-root", VerifySPKI, rootPEM, "10.0.0.1", []string{spkiHash(rogue)}, []*x509.Certificate{rogue}, false, true},
+		{"none", VerifyNone, nil, "", nil, nil, false, false},
+		{"no-root-cert", VerifyHostname, []byte("invalid"), "mqtt.example.com", nil, nil, true, false},
+		{"invalid-mode", "invalid", rootPEM, "mqtt.example.com", nil, nil, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newCertVerifier(tt.mode, tt.rootCert, tt.pins)
+			if (err != nil) != tt.newErr {
+				t.Fatalf("newCertVerifier: got error %v, want error %v", err, tt.newErr)
+			}
+			if tt.newErr || tt.mode == VerifyNone {
+				return
+			}
+
+			err = v.verifyConnection(tt.serverName)(tls.ConnectionState{PeerCertificates: tt.chain})
+			if (err != nil) != tt.verifyErr {
+				t.Fatalf("verifyConnection: got error %v, want error %v", err, tt.verifyErr)
+			}
+			if last := v.lastError(); last != err {
+				t.Errorf("lastError: got %v, want %v", last, err)
+			}
+			if v.lastError() != nil {
+				t.Error("lastError: expected the error to be cleared")
+			}
+			if err == nil {
+				return
+			}
+			if _, ok := err.(*CertificateError); !ok {
+				t.Errorf("verifyConnection: got %T, want *CertificateError", err)
+			}
+		})
+	}
+}
+
+func TestEndpointTLSConfig(t *testing.T) {
+	root, rootKey := generateCert(t, "root", nil, nil)
+	broker, _ := generateCert(t, "mqtt.example.com", root, rootKey)
+	v, err := newCertVerifier(VerifyHostname, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), nil)
+	if err != nil {
+		t.Fatalf("newCertVerifier: %v", err)
+	}
+
+	// The first broker presents a certificate for another hostname
+	first := endpointTLSConfig(&tls.Config{}, v, &Endpoint{Host: "10.0.0.1", Port: "8883"})
+	if first.ServerName != "10.0.0.1" {
+		t.Errorf("endpointTLSConfig: got server name %s", first.ServerName)
+	}
+	if err := first.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{broker}}); err == nil {
+		t.Fatal("VerifyConnection: expected a hostname mismatch")
+	}
+
+	// ...which is not reported for the next broker, whose connection fails before the handshake
+	endpointTLSConfig(&tls.Config{}, v, &Endpoint{Host: "mqtt.example.com", Port: "8883"})
+	if err := v.lastError(); err != nil {
+		t.Errorf("lastError: got %v for the next broker, want none", err)
+	}
+}
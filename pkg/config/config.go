@@ -13,11 +13,96 @@ const envPrefix = "iotagent"
 const (
 	NATSConnectionRetryIntervalKey = "nats.connection.retry.interval"
 	NATSSnapdPasswordKey           = "nats.snapd.password"
+	InventoryIntervalKey           = "inventory.interval"
+	InventoryRefreshCandidatesKey  = "inventory.refresh.candidates"
+	LogsFollowMaxDurationKey       = "logs.follow.max.duration"
+	LogsMaxBytesKey                = "logs.max.bytes"
+	MQTTProtocolVersionKey         = "mqtt.protocol.version"
+	MQTTMessageExpiryKey           = "mqtt.message.expiry"
+	MQTTQueueMaxBytesKey           = "mqtt.queue.max.bytes"
+	MQTTQueueMaxAgeKey             = "mqtt.queue.max.age"
+	MQTTTLSVerifyKey               = "mqtt.tls.verify"
+	MQTTTLSServerNameKey           = "mqtt.tls.server.name"
+	MQTTTLSPinsKey                 = "mqtt.tls.pins"
+	MQTTBrokersKey                 = "mqtt.brokers"
+	MQTTFailbackIntervalKey        = "mqtt.failback.interval"
+	MQTTReconnectMaxDelayKey       = "mqtt.reconnect.max.delay"
+	MQTTSessionCleanKey            = "mqtt.session.clean"
+	MQTTSessionExpiryKey           = "mqtt.session.expiry"
+	MQTTEncodingKey                = "mqtt.encoding"
+	MQTTTransferChunkSizeKey       = "mqtt.transfer.chunk.size"
+	MQTTTransferWindowKey          = "mqtt.transfer.window"
+	MQTTTransferAckTimeoutKey      = "mqtt.transfer.ack.timeout"
+	MQTTTransferRetriesKey         = "mqtt.transfer.retries"
+	MQTTProxyKey                   = "mqtt.proxy"
+	EnrollmentRetryMaxDelayKey     = "enrollment.retry.max.delay"
+	EnrollmentMethodKey            = "enrollment.method"
+	EnrollmentBootstrapTokenKey    = "enrollment.bootstrap.token"
+	EnrollmentBootstrapFileKey     = "enrollment.bootstrap.token.file"
+	IdentityTimeoutKey             = "identity.timeout"
+	IdentityTLSCAKey               = "identity.tls.ca"
+	IdentityTLSCertKey             = "identity.tls.cert"
+	IdentityTLSKeyKey              = "identity.tls.key"
+	IdentityProxyKey               = "identity.proxy"
+	IdentityRetriesKey             = "identity.retries"
+	ProvisioningKeyKey             = "provisioning.key"
+	ProvisioningPathsKey           = "provisioning.paths"
+	CredentialsRenewBeforeKey      = "credentials.renew.before"
+	CredentialsRenewIntervalKey    = "credentials.renew.interval"
+	CredentialsAuthFailuresKey     = "credentials.auth.failures"
+	UsageBudgetDailyKey            = "usage.budget.daily"
+	UsageBudgetMonthlyKey          = "usage.budget.monthly"
+	UsageDegradedIntervalKey       = "usage.degraded.interval"
+	UsageDeferredMaxKey            = "usage.deferred.max"
+)
+
+// Configuration key prefixes for the settings of each MQTT message type, e.g. "mqtt.topic.health"
+const (
+	MQTTTopicKeyPrefix  = "mqtt.topic."
+	MQTTQoSKeyPrefix    = "mqtt.qos."
+	MQTTRetainKeyPrefix = "mqtt.retain."
 )
 
 // nolint:mnd
 var DefaultConfig = map[string]interface{}{
 	NATSConnectionRetryIntervalKey: 10 * time.Second,
+	InventoryIntervalKey:           time.Hour,
+	InventoryRefreshCandidatesKey:  false,
+	LogsFollowMaxDurationKey:       10 * time.Minute,
+	LogsMaxBytesKey:                10 * 1024 * 1024,
+	MQTTProtocolVersionKey:         "3.1.1",
+	MQTTMessageExpiryKey:           10 * time.Minute,
+	MQTTQueueMaxBytesKey:           10 * 1024 * 1024,
+	MQTTQueueMaxAgeKey:             24 * time.Hour,
+	MQTTTLSVerifyKey:               "hostname",
+	// MQTTTLSServerNameKey defaults to the broker hostname from enrollment
+	// MQTTTLSPinsKey defaults to the public keys of the root certificate
+	// MQTTBrokersKey defaults to the broker from enrollment
+	MQTTFailbackIntervalKey:   5 * time.Minute,
+	MQTTReconnectMaxDelayKey:  2 * time.Minute,
+	MQTTSessionCleanKey:       true,
+	MQTTSessionExpiryKey:      time.Hour,
+	MQTTEncodingKey:           "json",
+	MQTTTransferChunkSizeKey:  64 * 1024,
+	MQTTTransferWindowKey:     8,
+	MQTTTransferAckTimeoutKey: 30 * time.Second,
+	MQTTTransferRetriesKey:    5,
+	// MQTTProxyKey defaults to the snapd system proxy settings
+	EnrollmentRetryMaxDelayKey: 10 * time.Minute,
+	EnrollmentMethodKey:        "assertion",
+	// EnrollmentBootstrapFileKey defaults to bootstrap-token in $SNAP_COMMON
+	IdentityTimeoutKey: 30 * time.Second,
+	IdentityRetriesKey: 3,
+	// IdentityProxyKey defaults to the proxy environment variables
+	// ProvisioningKeyKey defaults to unset, so no provisioning bundle is imported
+	// ProvisioningPathsKey defaults to identity.DefaultProvisioningPaths
+	CredentialsRenewBeforeKey:   30 * 24 * time.Hour,
+	CredentialsRenewIntervalKey: time.Hour,
+	CredentialsAuthFailuresKey:  5,
+	// The usage budgets default to unlimited
+	UsageDegradedIntervalKey: time.Hour,
+	UsageDeferredMaxKey:      4,
+	// The MQTT topic, QoS and retain settings default to mqtt.DefaultTopics
 	// NATSSnapdPassword defaults to unset
 }
 
@@ -29,6 +114,7 @@ func InitializeConfig() {
 
 	viper.SetEnvPrefix(envPrefix)
 	viper.AutomaticEnv()
-	replacer := strings.NewReplacer(".", "_")
+	// Snap config keys can have hyphens, which environment variables cannot
+	replacer := strings.NewReplacer(".", "_", "-", "_")
 	viper.SetEnvKeyReplacer(replacer)
 }
@@ -0,0 +1,27 @@
+package legacy
+
+// Actions handled by the agent in addition to those defined by the device twin
+const (
+	// ActionRefreshCandidates is the action for listing snaps with pending updates
+	ActionRefreshCandidates = "refresh-candidates"
+	// ActionFind is the action for searching the store for snaps
+	ActionFind = "find"
+	// ActionAssertions is the action for retrieving assertions of any type from the device
+	ActionAssertions = "assertions"
+	// ActionQuotaCreate is the action for creating a quota group
+	ActionQuotaCreate = "quota-create"
+	// ActionQuotaUpdate is the action for changing the limits or adding snaps to a quota group
+	ActionQuotaUpdate = "quota-update"
+	// ActionQuotaRemove is the action for removing a quota group
+	ActionQuotaRemove = "quota-remove"
+	// ActionQuotaList is the action for listing the quota groups and their usage
+	ActionQuotaList = "quota-list"
+	// ActionComponentInstall is the action for installing components of a snap
+	ActionComponentInstall = "component-install"
+	// ActionComponentRemove is the action for removing components of a snap
+	ActionComponentRemove = "component-remove"
+	// ActionComponentList is the action for listing the components of a snap
+	ActionComponentList = "component-list"
+	// ActionDeviceData is the action for updating the device data that is shared with local snaps
+	ActionDeviceData = "device-data"
+)
@@ -0,0 +1,97 @@
+package legacy
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/everactive/iot-devicetwin/pkg/messages"
+
+	"github.com/everactive/iot-agent/snapdapi"
+)
+
+// ComponentInstall installs components, such as kernel modules, of an installed snap
+func (act *SubscribeAction) ComponentInstall() messages.PublishSnapTask {
+	if len(act.Snap) == 0 {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: "No snap name provided for component install"}
+	}
+
+	data, err := act.componentsRequest()
+	if err != nil {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	// Call the snapd API
+	result, err := snapd.InstallComponents(act.Snap, data.Components)
+	if err != nil {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: err.Error()}
+	}
+	return messages.PublishSnapTask{Id: act.Id, Success: true, Result: result}
+}
+
+// ComponentRemove removes components of an installed snap
+func (act *SubscribeAction) ComponentRemove() messages.PublishSnapTask {
+	if len(act.Snap) == 0 {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: "No snap name provided for component remove"}
+	}
+
+	data, err := act.componentsRequest()
+	if err != nil {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	// Call the snapd API
+	result, err := snapd.RemoveComponents(act.Snap, data.Components)
+	if err != nil {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: err.Error()}
+	}
+	return messages.PublishSnapTask{Id: act.Id, Success: true, Result: result}
+}
+
+// ComponentList lists the installed and available components of a snap
+func (act *SubscribeAction) ComponentList() PublishComponents {
+	if len(act.Snap) == 0 {
+		return PublishComponents{Id: act.Id, Success: false, Message: "No snap name provided for component list"}
+	}
+
+	// Call the snapd API
+	components, err := snapd.ListComponents([]string{act.Snap})
+	if err != nil {
+		return PublishComponents{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	return PublishComponents{Id: act.Id, Success: true, Result: snapComponents(components[act.Snap])}
+}
+
+func (act *SubscribeAction) componentsRequest() (*ComponentsRequest, error) {
+	var data ComponentsRequest
+	if err := json.Unmarshal([]byte(act.Data), &data); err != nil {
+		return nil, err
+	}
+
+	if len(data.Components) == 0 {
+		return nil, fmt.Errorf("no components provided for snap %s", act.Snap)
+	}
+	return &data, nil
+}
+
+// snapComponents converts the snapd components into the device twin format
+func snapComponents(components []*snapdapi.Component) []*SnapComponent {
+	if len(components) == 0 {
+		return nil
+	}
+
+	result := []*SnapComponent{}
+	for _, c := range components {
+		result = append(result, &SnapComponent{
+			Installed:     c.InstallDate != nil,
+			InstalledDate: c.InstallDate,
+			InstalledSize: c.InstalledSize,
+			Name:          c.Name,
+			Revision:      c.Revision.N,
+			Summary:       c.Summary,
+			Type:          c.Type,
+			Version:       c.Version,
+		})
+	}
+	return result
+}
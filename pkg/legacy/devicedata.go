@@ -0,0 +1,54 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package legacy
+
+import (
+	"encoding/json"
+
+	"github.com/everactive/iot-devicetwin/pkg/messages"
+)
+
+// DeviceDataStore stores the device data from the management service and shares it with local snaps
+type DeviceDataStore interface {
+	UpdateDeviceData(dataBase64 string) error
+}
+
+var deviceDataStore DeviceDataStore
+
+// SetDeviceDataStore sets the store for the device data of the device-data action
+func SetDeviceDataStore(store DeviceDataStore) {
+	deviceDataStore = store
+}
+
+// DeviceData replaces the device data that is shared with local snaps
+func (act *SubscribeAction) DeviceData() messages.PublishResponse {
+	var data DeviceDataRequest
+	if err := json.Unmarshal([]byte(act.Data), &data); err != nil {
+		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	if deviceDataStore == nil {
+		return messages.PublishResponse{Id: act.Id, Success: false, Message: "the device data cannot be stored"}
+	}
+	if err := deviceDataStore.UpdateDeviceData(data.DeviceData); err != nil {
+		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
+	}
+	return messages.PublishResponse{Id: act.Id, Success: true, Message: "Updated the device data"}
+}
@@ -0,0 +1,98 @@
+package legacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+// Payload encodings of the responses
+const (
+	EncodingJSON = "json"
+	EncodingCBOR = "cbor"
+)
+
+// contentTypeCBOR is the content type of the binary encoding
+const contentTypeCBOR = "application/cbor"
+
+// cborSelfDescribeTag marks a payload as CBOR, so it can be told apart from JSON without MQTT 5 properties
+const cborSelfDescribeTag = 55799
+
+// payloadEncoding returns the encoding requested by an action, or else the configured encoding
+func payloadEncoding(requested string) string {
+	encoding := requested
+	if len(encoding) == 0 {
+		encoding = viper.GetString(config.MQTTEncodingKey)
+	}
+
+	switch encoding {
+	case EncodingJSON, EncodingCBOR:
+		return encoding
+	case "":
+		return EncodingJSON
+	default:
+		log.Printf("Unsupported payload encoding `%s`, using JSON", encoding)
+		return EncodingJSON
+	}
+}
+
+// encodePayload transcodes a JSON payload to the encoding, keeping the field names. It
+// returns the payload and its content type. CBOR payloads carry the self-describe tag
+func encodePayload(data []byte, encoding string) ([]byte, string, error) {
+	if encoding == EncodingJSON {
+		return data, contentTypeJSON, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, "", fmt.Errorf("cannot decode the JSON payload: %v", err)
+	}
+
+	switch encoding {
+	case EncodingCBOR:
+		payload, err := cbor.Marshal(cbor.Tag{Number: cborSelfDescribeTag, Content: jsonNumbers(v)})
+		return payload, contentTypeCBOR, err
+	default:
+		return nil, "", fmt.Errorf("unsupported payload encoding: %s", encoding)
+	}
+}
+
+// encodeOrJSON encodes a JSON payload, falling back to JSON if that fails
+func encodeOrJSON(data []byte, encoding string) ([]byte, string) {
+	payload, contentType, err := encodePayload(data, encoding)
+	if err != nil {
+		log.Printf("Error encoding the payload as %s, using JSON: %v", encoding, err)
+		return data, contentTypeJSON
+	}
+	return payload, contentType
+}
+
+// jsonNumbers converts the decoded JSON numbers, to integers where possible as CBOR
+// encodes them more compactly
+func jsonNumbers(v interface{}) interface{} {
+	switch value := v.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range value {
+			value[k] = jsonNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = jsonNumbers(item)
+		}
+	}
+	return v
+}
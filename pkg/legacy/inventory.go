@@ -0,0 +1,55 @@
+package legacy
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/mqtt"
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+// Inventory publishes the installed snaps and, when enabled, the snaps with pending updates
+func (h *Handler) Inventory() {
+	snaps, err := deviceSnaps(h.clientID)
+	if err != nil {
+		log.Printf("Error getting the installed snaps: %v", err)
+		return
+	}
+
+	inventory := Inventory{
+		OrgId:    h.organizationID,
+		DeviceId: h.clientID,
+		Refresh:  time.Now(),
+		Snaps:    snaps,
+	}
+
+	if viper.GetBool(config.InventoryRefreshCandidatesKey) {
+		// A store outage should not prevent the rest of the inventory being reported
+		candidates, err := refreshCandidates()
+		if err != nil {
+			log.Printf("Error getting the refresh candidates: %v", err)
+		} else {
+			inventory.RefreshCandidates = candidates
+		}
+	}
+
+	// Older snapd versions do not support quota groups
+	quotas, err := quotaGroups()
+	if err != nil {
+		log.Printf("Error getting the quota groups: %v", err)
+	} else {
+		inventory.Quotas = quotas
+	}
+
+	data, err := json.Marshal(&inventory)
+	if err != nil {
+		log.Printf("Error serializing the inventory: %v", err)
+		return
+	}
+
+	t := h.topics.Get(mqtt.TopicInventory)
+	h.mqttConn.Publish(mqtt.ClassTelemetry, t.Name, t.QoS, t.Retained, data, messageProperties(contentTypeJSON, false))
+}
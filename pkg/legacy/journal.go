@@ -0,0 +1,129 @@
+package legacy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snapcore/snapd/client"
+)
+
+const journalctlPath = "journalctl"
+
+// syslogPriorities are the priority names understood by the journal
+var syslogPriorities = map[string]bool{
+	"emerg": true, "alert": true, "crit": true, "err": true,
+	"warning": true, "notice": true, "info": true, "debug": true,
+	"0": true, "1": true, "2": true, "3": true, "4": true, "5": true, "6": true, "7": true,
+}
+
+func validPriority(priority string) bool {
+	return syslogPriorities[priority]
+}
+
+// journalArgs returns the journalctl arguments. The number of lines is only passed when
+// it is limited, as journalctl reads no lines at all with --lines=0
+func journalArgs(names []string, priority string, since time.Time, n int, follow bool) []string {
+	args := []string{"--output=json", "--no-pager", "--priority=" + priority}
+	if n > 0 {
+		args = append(args, fmt.Sprintf("--lines=%d", n))
+	}
+	if !since.IsZero() {
+		args = append(args, "--since=@"+strconv.FormatInt(since.Unix(), 10))
+	}
+	if follow {
+		args = append(args, "--follow")
+	}
+	for _, name := range names {
+		args = append(args, "--unit="+journalUnit(name))
+	}
+	return args
+}
+
+// journalLogs reads logs from the journal, which needs the log-observe interface.
+// The snapd logs API does not report the priority of the log lines.
+var journalLogs = func(ctx context.Context, names []string, priority string, since time.Time, n int, follow bool) (<-chan client.Log, error) {
+	cmd := exec.CommandContext(ctx, journalctlPath, journalArgs(names, priority, since, n, follow)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot read the journal: %v", err)
+	}
+
+	ch := make(chan client.Log, 20)
+	go func() {
+		defer close(ch)
+		defer func() { _ = cmd.Wait() }()
+
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			l, err := parseJournalEntry(scanner.Bytes())
+			if err != nil {
+				continue
+			}
+
+			select {
+			case ch <- l:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// journalUnit converts a snap or snap service name to a systemd unit pattern
+func journalUnit(name string) string {
+	if strings.Contains(name, ".") {
+		return fmt.Sprintf("snap.%s.service", name)
+	}
+	return fmt.Sprintf("snap.%s.*", name)
+}
+
+func parseJournalEntry(data []byte) (client.Log, error) {
+	var entry map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return client.Log{}, err
+	}
+
+	var realtime string
+	if err := json.Unmarshal(entry["__REALTIME_TIMESTAMP"], &realtime); err != nil {
+		return client.Log{}, err
+	}
+	usec, err := strconv.ParseInt(realtime, 10, 64)
+	if err != nil {
+		return client.Log{}, err
+	}
+
+	return client.Log{
+		Timestamp: time.Unix(0, usec*int64(time.Microsecond)).UTC(),
+		Message:   journalField(entry["MESSAGE"]),
+		SID:       journalField(entry["SYSLOG_IDENTIFIER"]),
+		PID:       journalField(entry["_PID"]),
+	}, nil
+}
+
+// journalField decodes a journal field, which is a byte array when it is not valid UTF-8
+func journalField(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+
+	var b []byte
+	var ints []int
+	if err := json.Unmarshal(raw, &ints); err == nil {
+		for _, i := range ints {
+			b = append(b, byte(i))
+		}
+	}
+	return string(b)
+}
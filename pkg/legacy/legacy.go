@@ -20,6 +20,7 @@ package legacy
  */
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -38,7 +39,8 @@ import (
 )
 
 const (
-	quiesce = 250
+	quiesce         = 250
+	presenceTimeout = 5 * time.Second
 )
 
 var snapd snapdapi.SnapdClient = snapdapi.NewClientAdapter()
@@ -51,6 +53,7 @@ type HandlerIFace interface {
 	SubscribeToActions() error
 	Health()
 	Metrics()
+	Inventory()
 	Close()
 	IsConnected() bool
 }
@@ -61,26 +64,37 @@ type Handler struct {
 	organizationID string
 	enrollment     *identity.Enrollment
 	snapdClient    snapdapi.SnapdClient
+	topics         *mqtt.Topics
+	upload         *uploader
 }
 
 func New(mqttConn *mqtt.Connection, enrollment *identity.Enrollment) *Handler {
-	return &Handler{
-		mqttConn,
-		enrollment.ID,
-		enrollment.Organization.ID,
-		enrollment,
-		snapdapi.NewClientAdapter(),
+	topics := mqtt.NewTopics(enrollment)
+	h := &Handler{
+		mqttConn:       mqttConn,
+		clientID:       enrollment.ID,
+		organizationID: enrollment.Organization.ID,
+		enrollment:     enrollment,
+		snapdClient:    snapdapi.NewClientAdapter(),
+		topics:         topics,
 	}
+	h.upload = &uploader{
+		transfers: mqtt.NewTransfers(mqttConn.Client, topics.Get(mqtt.TopicTransfer), topics.Get(mqtt.TopicTransferAcks)),
+		respond:   h.publishResponse,
+		meter:     mqttConn.Meter(),
+	}
+	h.upload.ctx, h.upload.cancel = context.WithCancel(context.Background())
+	return h
 }
 
 // SubscribeToActions subscribes to the action topic
 func (h *Handler) SubscribeToActions() error {
-	t := fmt.Sprintf("devices/sub/%s", h.clientID)
-	token := h.mqttConn.Client.Subscribe(t, mqtt.QOSAtLeastOnce, h.subscribeHandler)
+	t := h.topics.Get(mqtt.TopicActions)
+	token := h.mqttConn.Client.Subscribe(t.Name, t.QoS, h.subscribeHandler)
 	token.Wait()
 	if token.Error() != nil {
-		log.Printf("Error subscribing to topic `%s`: %v", t, token.Error())
-		return fmt.Errorf("error subscribing to topic `%s`: %v", t, token.Error())
+		log.Printf("Error subscribing to topic `%s`: %v", t.Name, token.Error())
+		return fmt.Errorf("error subscribing to topic `%s`: %v", t.Name, token.Error())
 	}
 	return nil
 }
@@ -92,8 +106,20 @@ func (h *Handler) subscribeHandler(client MQTT.Client, msg MQTT.Message) {
 		return
 	}
 
-	// The topic to publish the response to the specific action
-	t := fmt.Sprintf("devices/pub/%s", h.clientID)
+	// An MQTT 5 action can ask for the response on its own topic, with correlation data
+	if req := mqtt.GetProperties(msg); req != nil {
+		if len(req.ResponseTopic) > 0 {
+			if h.topics.ResponseTopicAllowed(req.ResponseTopic) {
+				s.responseTopic = req.ResponseTopic
+			} else {
+				log.Printf("Ignoring the response topic `%s`, which is not below `%s`", req.ResponseTopic, h.topics.Get(mqtt.TopicResponses).Name)
+			}
+		}
+		s.correlationData = req.CorrelationData
+		if len(s.Encoding) == 0 {
+			s.Encoding = req.UserProperties[propertyEncoding]
+		}
+	}
 
 	// Perform the action
 	response, err := h.performAction(s)
@@ -102,7 +128,7 @@ func (h *Handler) subscribeHandler(client MQTT.Client, msg MQTT.Message) {
 	}
 
 	// Publish the response to the action to the broker
-	client.Publish(t, mqtt.QOSAtLeastOnce, false, response)
+	h.publishResponse(s, response)
 
 	// Handle the special case that this action was an unregister.
 	// This lives here, so that the response can be sent to the broker before
@@ -190,11 +216,55 @@ func (h *Handler) performAction(s *SubscribeAction) ([]byte, error) {
 		result.Action = s.Action
 		return serializeResponse(result)
 	case actions.Logs:
-		result := s.RetrieveLogs(h.snapdClient)
+		result := s.RetrieveLogs(h.snapdClient, h.publishLogs, h.upload)
 		result.Action = s.Action
 		return serializeResponse(result)
 	case actions.Snapshot:
-		result := s.SnapSnapshot(h.snapdClient)
+		result := s.SnapSnapshot(h.snapdClient, h.upload)
+		result.Action = s.Action
+		return serializeResponse(result)
+	case ActionRefreshCandidates:
+		result := s.SnapRefreshCandidates()
+		result.Action = s.Action
+		return serializeResponse(result)
+	case ActionFind:
+		result := s.SnapFind()
+		result.Action = s.Action
+		return serializeResponse(result)
+	case ActionAssertions:
+		result := s.SnapAssertions()
+		result.Action = s.Action
+		return serializeResponse(result)
+	case ActionQuotaCreate:
+		result := s.QuotaCreate()
+		result.Action = s.Action
+		return serializeResponse(result)
+	case ActionQuotaUpdate:
+		result := s.QuotaUpdate()
+		result.Action = s.Action
+		return serializeResponse(result)
+	case ActionQuotaRemove:
+		result := s.QuotaRemove()
+		result.Action = s.Action
+		return serializeResponse(result)
+	case ActionQuotaList:
+		result := s.QuotaList()
+		result.Action = s.Action
+		return serializeResponse(result)
+	case ActionComponentInstall:
+		result := s.ComponentInstall()
+		result.Action = s.Action
+		return serializeResponse(result)
+	case ActionComponentRemove:
+		result := s.ComponentRemove()
+		result.Action = s.Action
+		return serializeResponse(result)
+	case ActionComponentList:
+		result := s.ComponentList()
+		result.Action = s.Action
+		return serializeResponse(result)
+	case ActionDeviceData:
+		result := s.DeviceData()
 		result.Action = s.Action
 		return serializeResponse(result)
 	default:
@@ -205,10 +275,15 @@ func (h *Handler) performAction(s *SubscribeAction) ([]byte, error) {
 // Health publishes a health message to indicate that the device is still active
 func (h *Handler) Health() {
 	// Serialize the device health details
-	health := messages.Health{
-		OrgId:    h.organizationID,
-		DeviceId: h.clientID,
-		Refresh:  time.Now(),
+	health := Health{
+		Health: messages.Health{
+			OrgId:    h.organizationID,
+			DeviceId: h.clientID,
+			Refresh:  time.Now(),
+		},
+		Broker: h.mqttConn.Broker(),
+		Queue:  h.mqttConn.QueueStats(),
+		Usage:  h.mqttConn.Usage(),
 	}
 
 	data, err := json.Marshal(&health)
@@ -218,13 +293,45 @@ func (h *Handler) Health() {
 	}
 
 	// The topic to publish the response to the specific action
-	t := fmt.Sprintf("devices/health/%s", h.clientID)
-	h.mqttConn.Client.Publish(t, mqtt.QOSAtMostOnce, false, data)
+	t := h.topics.Get(mqtt.TopicHealth)
+	h.mqttConn.Publish(mqtt.ClassTelemetry, t.Name, t.QoS, t.Retained, data, messageProperties(contentTypeJSON, true))
+}
+
+// publishResponse publishes a response to an action, in the encoding and on the topic that the
+// action asked for. It also publishes the responses after an action returned, e.g. when a transfer ends
+func (h *Handler) publishResponse(act *SubscribeAction, payload []byte) {
+	t := h.topics.Get(mqtt.TopicResponses)
+	if len(act.responseTopic) > 0 {
+		t.Name = act.responseTopic
+	}
+
+	// The action can ask for a binary encoding of the response
+	payload, contentType := encodeOrJSON(payload, payloadEncoding(act.Encoding))
+	props := messageProperties(contentType, false)
+	props.CorrelationData = act.correlationData
+
+	h.mqttConn.Publish(mqtt.ClassResponse, t.Name, t.QoS, t.Retained, payload, props)
+}
+
+// publishLogs publishes log lines retrieved by a logs action
+func (h *Handler) publishLogs(payload []byte) {
+	t := h.topics.Get(mqtt.TopicLogs)
+	h.mqttConn.Publish(mqtt.ClassResponse, t.Name, t.QoS, t.Retained, payload, messageProperties(contentTypeJSON, false))
 }
 
-// Close closes the connection to the MQTT broker
+// Close cancels the deferred transfers, publishes the offline presence message and closes the connection to the MQTT broker
 func (h *Handler) Close() {
+	h.upload.close()
 	if h.mqttConn != nil {
+		// A clean disconnect does not trigger the last will, so report that the device is offline first
+		if h.mqttConn.Client.IsConnectionOpen() {
+			token := mqtt.PublishPresence(h.mqttConn.Client, h.topics.Get(mqtt.TopicPresence), h.organizationID, h.clientID, mqtt.PresenceOffline)
+			if !token.WaitTimeout(presenceTimeout) {
+				log.Printf("Timed out publishing the offline presence message")
+			} else if token.Error() != nil {
+				log.Printf("Error publishing the offline presence message: %v", token.Error())
+			}
+		}
 		h.mqttConn.Client.Disconnect(quiesce)
 	}
 }
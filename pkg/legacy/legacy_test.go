@@ -19,15 +19,28 @@
 package legacy
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/everactive/iot-devicetwin/pkg/messages"
 	"github.com/everactive/iot-identity/domain"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/spf13/viper"
 
 	"github.com/everactive/iot-agent/mqtt"
+	"github.com/everactive/iot-agent/pkg/config"
 	"github.com/everactive/iot-agent/snapdapi"
 )
 
@@ -71,6 +84,31 @@ func TestConnection_Workflow(t *testing.T) {
 	m16a := `{"id": "abc123", "action":"switch", "snap":"helloworld", "data": "latest/stable"}`
 	m16b := `{"id": "abc123", "action":"switch", "snap":"helloworld", "data": ""}`
 	m16c := `{"id": "abc123", "action":"switch", "snap":"invalid", "data": ""}`
+	m17a := `{"id": "abc123", "action":"refresh-candidates"}`
+	m18a := `{"id": "abc123", "action":"find", "snap":"helloworld"}`
+	m18b := `{"id": "abc123", "action":"find", "data":"{\"query\": \"hello\"}"}`
+	m18c := `{"id": "abc123", "action":"find", "data":"{}"}`
+	m18d := `{"id": "abc123", "action":"find", "snap":"invalid"}`
+	m18e := `{"id": "abc123", "action":"find", "data":"{\"query\": \"invalid\"}"}`
+	m19a := `{"id": "abc123", "action":"assertions", "data":"{\"type\": \"serial\", \"headers\": {\"brand-id\": \"canonical\"}}"}`
+	m19b := `{"id": "abc123", "action":"assertions", "data":"{}"}`
+	m19c := `{"id": "abc123", "action":"assertions", "data":"{\"type\": \"invalid\"}"}`
+	m20a := `{"id": "abc123", "action":"quota-create", "data":"{\"name\": \"group1\", \"memory\": 1073741824, \"cpuCount\": 2, \"snaps\": [\"helloworld\"]}"}`
+	m20b := `{"id": "abc123", "action":"quota-create", "data":"{\"name\": \"existing\", \"memory\": 1073741824}"}`
+	m20c := `{"id": "abc123", "action":"quota-create", "data":"{}"}`
+	m21a := `{"id": "abc123", "action":"quota-update", "data":"{\"name\": \"existing\", \"threads\": 32, \"snaps\": [\"helloworld\"]}"}`
+	m21b := `{"id": "abc123", "action":"quota-update", "data":"{\"name\": \"group1\", \"threads\": 32}"}`
+	m22a := `{"id": "abc123", "action":"quota-remove", "data":"{\"name\": \"existing\"}"}`
+	m22b := `{"id": "abc123", "action":"quota-remove", "data":"{\"name\": \"invalid\"}"}`
+	m23a := `{"id": "abc123", "action":"quota-list"}`
+	m24a := `{"id": "abc123", "action":"component-install", "snap":"helloworld", "data":"{\"components\": [\"wifi-driver\"]}"}`
+	m24b := `{"id": "abc123", "action":"component-install", "data":"{\"components\": [\"wifi-driver\"]}"}`
+	m24c := `{"id": "abc123", "action":"component-install", "snap":"helloworld", "data":"{}"}`
+	m24d := `{"id": "abc123", "action":"component-install", "snap":"invalid", "data":"{\"components\": [\"wifi-driver\"]}"}`
+	m25a := `{"id": "abc123", "action":"component-remove", "snap":"helloworld", "data":"{\"components\": [\"wifi-driver\"]}"}`
+	m25b := `{"id": "abc123", "action":"component-remove", "snap":"helloworld", "data":"\u1000"}`
+	m26a := `{"id": "abc123", "action":"component-list", "snap":"helloworld"}`
+	m26b := `{"id": "abc123", "action":"component-list"}`
 
 	snapStartValid := `{"id": "abc123", "action":"start", "snap":"helloworld", "data":"{}"}`
 	snapStopValid := `{"id": "abc123", "action":"stop", "snap":"helloworld", "data":"{}"}`
@@ -182,6 +220,41 @@ func TestConnection_Workflow(t *testing.T) {
 		{"valid-switch", true, &MockMessage{[]byte(m16a)}, false, false, false},
 		{"no-channel-switch", true, &MockMessage{[]byte(m16b)}, false, false, true},
 		{"invalid-switch", true, &MockMessage{[]byte(m16c)}, false, false, true},
+
+		{"valid-refresh-candidates", true, &MockMessage{[]byte(m17a)}, false, false, false},
+		{"snapd-error-refresh-candidates", true, &MockMessage{[]byte(m17a)}, true, false, true},
+
+		{"valid-find-name", true, &MockMessage{[]byte(m18a)}, false, false, false},
+		{"valid-find-query", true, &MockMessage{[]byte(m18b)}, false, false, false},
+		{"no-query-find", true, &MockMessage{[]byte(m18c)}, false, false, true},
+		{"invalid-find-name", true, &MockMessage{[]byte(m18d)}, false, false, true},
+		{"invalid-find-query", true, &MockMessage{[]byte(m18e)}, false, false, true},
+
+		{"valid-assertions", true, &MockMessage{[]byte(m19a)}, false, false, false},
+		{"no-type-assertions", true, &MockMessage{[]byte(m19b)}, false, false, true},
+		{"invalid-type-assertions", true, &MockMessage{[]byte(m19c)}, false, false, true},
+		{"snapd-error-assertions", true, &MockMessage{[]byte(m19a)}, true, false, true},
+
+		{"valid-quota-create", true, &MockMessage{[]byte(m20a)}, false, false, false},
+		{"exists-quota-create", true, &MockMessage{[]byte(m20b)}, false, false, true},
+		{"no-name-quota-create", true, &MockMessage{[]byte(m20c)}, false, false, true},
+		{"snapd-error-quota-create", true, &MockMessage{[]byte(m20a)}, true, false, true},
+		{"valid-quota-update", true, &MockMessage{[]byte(m21a)}, false, false, false},
+		{"missing-quota-update", true, &MockMessage{[]byte(m21b)}, false, false, true},
+		{"valid-quota-remove", true, &MockMessage{[]byte(m22a)}, false, false, false},
+		{"invalid-quota-remove", true, &MockMessage{[]byte(m22b)}, false, false, true},
+		{"valid-quota-list", true, &MockMessage{[]byte(m23a)}, false, false, false},
+		{"snapd-error-quota-list", true, &MockMessage{[]byte(m23a)}, true, false, true},
+		{"valid-component-install", true, &MockMessage{[]byte(m24a)}, false, false, false},
+		{"no-snap-component-install", true, &MockMessage{[]byte(m24b)}, false, false, true},
+		{"no-components-component-install", true, &MockMessage{[]byte(m24c)}, false, false, true},
+		{"invalid-component-install", true, &MockMessage{[]byte(m24d)}, false, false, true},
+		{"valid-component-remove", true, &MockMessage{[]byte(m25a)}, false, false, false},
+		{"bad-data-component-remove", true, &MockMessage{[]byte(m25b)}, false, false, true},
+		{"snapd-error-component-remove", true, &MockMessage{[]byte(m25a)}, true, false, true},
+		{"valid-component-list", true, &MockMessage{[]byte(m26a)}, false, false, false},
+		{"no-snap-component-list", true, &MockMessage{[]byte(m26b)}, false, false, true},
+		{"snapd-error-component-list", true, &MockMessage{[]byte(m26a)}, true, false, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -225,3 +298,525 @@ func deserializePublishResponse(data []byte) (*messages.PublishResponse, error)
 	}
 	return &s, err
 }
+
+func TestHandler_subscribeHandler(t *testing.T) {
+	m1 := `{"id": "abc123", "action":"server"}`
+	m2 := `{"id": "abc123", "action":"server", "encoding":"cbor"}`
+	enroll := &domain.Enrollment{
+		ID:           "c333",
+		Organization: domain.Organization{ID: "abc"},
+	}
+
+	tests := []struct {
+		name        string
+		message     MQTT.Message
+		topic       string
+		correlation string
+		contentType string
+	}{
+		{"mqtt311", &MockMessage{[]byte(m1)}, "devices/pub/c333", "", contentTypeJSON},
+		{"mqtt5-no-properties", &MockMessageV5{MockMessage{[]byte(m1)}, &mqtt.MessageProperties{}}, "devices/pub/c333", "", contentTypeJSON},
+		{"mqtt5-response-topic", &MockMessageV5{MockMessage{[]byte(m1)}, &mqtt.MessageProperties{ResponseTopic: "devices/pub/c333/req1", CorrelationData: []byte("req1")}}, "devices/pub/c333/req1", "req1", contentTypeJSON},
+		{"mqtt5-response-topic-other-device", &MockMessageV5{MockMessage{[]byte(m1)}, &mqtt.MessageProperties{ResponseTopic: "devices/pub/c444", CorrelationData: []byte("req1")}}, "devices/pub/c333", "req1", contentTypeJSON},
+		{"mqtt5-correlation", &MockMessageV5{MockMessage{[]byte(m1)}, &mqtt.MessageProperties{CorrelationData: []byte("req2")}}, "devices/pub/c333", "req2", contentTypeJSON},
+		{"mqtt5-encoding-payload", &MockMessageV5{MockMessage{[]byte(m2)}, &mqtt.MessageProperties{}}, "devices/pub/c333", "", contentTypeCBOR},
+		{"mqtt5-encoding-property", &MockMessageV5{MockMessage{[]byte(m1)}, &mqtt.MessageProperties{UserProperties: map[string]string{propertyEncoding: EncodingCBOR}}}, "devices/pub/c333", "", contentTypeCBOR},
+		{"mqtt5-encoding-unsupported", &MockMessageV5{MockMessage{[]byte(m1)}, &mqtt.MessageProperties{UserProperties: map[string]string{propertyEncoding: "protobuf"}}}, "devices/pub/c333", "", contentTypeJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MockSnapdClient(&snapdapi.MockClient{})
+			client := &MockClientV5{}
+			handler := New(&mqtt.Connection{Client: client}, enroll)
+
+			handler.subscribeHandler(client, tt.message)
+
+			if client.lastTopic != tt.topic {
+				t.Errorf("subscribeHandler: topic = %s, want %s", client.lastTopic, tt.topic)
+			}
+			if client.lastProperties == nil {
+				t.Fatal("subscribeHandler: no properties published")
+			}
+			if string(client.lastProperties.CorrelationData) != tt.correlation {
+				t.Errorf("subscribeHandler: correlation data = %s, want %s", client.lastProperties.CorrelationData, tt.correlation)
+			}
+			if client.lastProperties.UserProperties[propertySchemaVersion] != SchemaVersion {
+				t.Errorf("subscribeHandler: schema version = %s, want %s", client.lastProperties.UserProperties[propertySchemaVersion], SchemaVersion)
+			}
+			if client.lastProperties.UserProperties[propertyContentType] != tt.contentType {
+				t.Errorf("subscribeHandler: content type = %s, want %s", client.lastProperties.UserProperties[propertyContentType], tt.contentType)
+			}
+		})
+	}
+}
+
+func TestHandler_publishResult(t *testing.T) {
+	enroll := &domain.Enrollment{
+		ID:           "c333",
+		Organization: domain.Organization{ID: "abc"},
+	}
+	client := &MockClientV5{}
+	handler := New(&mqtt.Connection{Client: client}, enroll)
+
+	// A response after the action returned uses the action's topic, correlation data and encoding
+	act := &SubscribeAction{Encoding: EncodingCBOR, responseTopic: "devices/pub/c333/req1", correlationData: []byte("req1")}
+	act.Id = "abc123"
+	act.Action = "logs"
+	handler.upload.publishResult(act, "Transferred logs", nil)
+
+	if client.lastTopic != "devices/pub/c333/req1" {
+		t.Errorf("publishResult: topic = %s, want devices/pub/c333/req1", client.lastTopic)
+	}
+	if client.lastProperties == nil {
+		t.Fatal("publishResult: no properties published")
+	}
+	if string(client.lastProperties.CorrelationData) != "req1" {
+		t.Errorf("publishResult: correlation data = %s, want req1", client.lastProperties.CorrelationData)
+	}
+	if client.lastProperties.ContentType != contentTypeCBOR {
+		t.Errorf("publishResult: content type = %s, want %s", client.lastProperties.ContentType, contentTypeCBOR)
+	}
+}
+
+func TestEncodePayload(t *testing.T) {
+	data := []byte(`{"id":"abc123","result":[{"name":"core","revision":11993,"size":1.5}],"success":true}`)
+
+	tests := []struct {
+		name        string
+		encoding    string
+		contentType string
+		wantErr     bool
+	}{
+		{"json", EncodingJSON, contentTypeJSON, false},
+		{"cbor", EncodingCBOR, contentTypeCBOR, false},
+		{"invalid", "xml", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, contentType, err := encodePayload(data, tt.encoding)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("encodePayload: error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if contentType != tt.contentType {
+				t.Errorf("encodePayload: content type = %s, want %s", contentType, tt.contentType)
+			}
+
+			// The decoded payload matches the JSON
+			var got interface{}
+			switch tt.encoding {
+			case EncodingJSON:
+				err = json.Unmarshal(payload, &got)
+			case EncodingCBOR:
+				if !bytes.HasPrefix(payload, []byte{0xd9, 0xd9, 0xf7}) {
+					t.Errorf("encodePayload: no CBOR self-describe tag: %x", payload[:3])
+				}
+				dm, _ := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}{})}.DecMode()
+				err = dm.Unmarshal(payload, &got)
+			}
+			if err != nil {
+				t.Fatalf("decoding the payload: %v", err)
+			}
+
+			var want interface{}
+			_ = json.Unmarshal(data, &want)
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("encodePayload: decoded %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestHandler_EncodeMetrics(t *testing.T) {
+	h := &Handler{clientID: "a111"}
+	fields := []metricField{{"total", uint64(2048)}, {"used", uint64(1024)}, {"usedpc", 50.0}}
+
+	// JSON keeps the line protocol
+	payload, contentType := h.encodeMetrics("memory", fields, EncodingJSON)
+	if want := "memory,device=a111 total=2048,used=1024,usedpc=50.000000"; string(payload) != want || contentType != contentTypeLineProtocol {
+		t.Errorf("encodeMetrics: got %s (%s), want %s", payload, contentType, want)
+	}
+
+	// CBOR is an object with the field names
+	payload, contentType = h.encodeMetrics("memory", fields, EncodingCBOR)
+	if contentType != contentTypeCBOR {
+		t.Errorf("encodeMetrics: content type = %s, want %s", contentType, contentTypeCBOR)
+	}
+	var got interface{}
+	dm, _ := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}{})}.DecMode()
+	if err := dm.Unmarshal(payload, &got); err != nil {
+		t.Fatalf("decoding the payload: %v", err)
+	}
+	gotJSON, _ := json.Marshal(got)
+	if want := `{"device":"a111","fields":{"total":2048,"used":1024,"usedpc":50},"measurement":"memory"}`; string(gotJSON) != want {
+		t.Errorf("encodeMetrics: decoded %s, want %s", gotJSON, want)
+	}
+}
+
+func TestHandler_Close(t *testing.T) {
+	enroll := &domain.Enrollment{
+		ID:           "c333",
+		Organization: domain.Organization{ID: "abc"},
+	}
+
+	tests := []struct {
+		name  string
+		open  bool
+		topic string
+	}{
+		{"open", true, "devices/presence/c333"},
+		{"closed", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &MockClient{open: tt.open}
+			handler := New(&mqtt.Connection{Client: client}, enroll)
+
+			handler.Close()
+
+			if client.lastTopic != tt.topic {
+				t.Errorf("Close: topic = %s, want %s", client.lastTopic, tt.topic)
+			}
+			if client.IsConnectionOpen() {
+				t.Error("Close: connection is still open")
+			}
+		})
+	}
+}
+
+type fakeDeviceDataStore struct {
+	err  error
+	data string
+}
+
+func (s *fakeDeviceDataStore) UpdateDeviceData(dataBase64 string) error {
+	s.data = dataBase64
+	return s.err
+}
+
+func TestSubscribeAction_DeviceData(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		store   *fakeDeviceDataStore
+		want    string
+		success bool
+	}{
+		{"valid", `{"deviceData": "aGVsbG8="}`, &fakeDeviceDataStore{}, "aGVsbG8=", true},
+		{"store-error", `{"deviceData": "aGVsbG8="}`, &fakeDeviceDataStore{err: fmt.Errorf("MOCK error")}, "aGVsbG8=", false},
+		{"bad-data", `{`, &fakeDeviceDataStore{}, "", false},
+		{"no-store", `{"deviceData": "aGVsbG8="}`, nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.store != nil {
+				SetDeviceDataStore(tt.store)
+			}
+			defer SetDeviceDataStore(nil)
+
+			act := &SubscribeAction{SubscribeAction: messages.SubscribeAction{Id: "abc123", Action: ActionDeviceData, Data: tt.data}}
+			resp := act.DeviceData()
+
+			if resp.Success != tt.success {
+				t.Errorf("DeviceData: success = %v, want %v: %s", resp.Success, tt.success, resp.Message)
+			}
+			if tt.store != nil && tt.store.data != tt.want {
+				t.Errorf("DeviceData: stored = %q, want %q", tt.store.data, tt.want)
+			}
+		})
+	}
+}
+
+func TestJournalArgs(t *testing.T) {
+	since := time.Unix(1600000000, 0)
+	tests := []struct {
+		name   string
+		n      int
+		since  time.Time
+		follow bool
+		want   string
+	}{
+		{"no-limit", 0, time.Time{}, false, "--output=json --no-pager --priority=err --unit=snap.helloworld.*"},
+		{"limit", 20, time.Time{}, false, "--output=json --no-pager --priority=err --lines=20 --unit=snap.helloworld.*"},
+		{"since-follow", -1, since, true, "--output=json --no-pager --priority=err --since=@1600000000 --follow --unit=snap.helloworld.*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(journalArgs([]string{"helloworld"}, "err", tt.since, tt.n, tt.follow), " "); got != tt.want {
+				t.Errorf("journalArgs() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscribeAction_RetrieveLogs(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		snapdErr  bool
+		respErr   bool
+		lines     int
+		truncated bool
+	}{
+		{"valid", `{"limit": 10}`, false, false, 3, false},
+		{"valid-snaps", `{"snaps": ["helloworld"]}`, false, false, 3, false},
+		{"valid-since", `{"since": "2000-01-01T00:00:00Z"}`, false, false, 3, false},
+		{"valid-until", `{"until": "2000-01-01T00:00:00Z"}`, false, false, 0, false},
+		{"valid-max-bytes", `{"maxBytes": 100}`, false, false, 1, true},
+		{"valid-follow", `{"follow": true, "followSeconds": 5}`, false, false, 3, false},
+		{"invalid-priority", `{"priority": "loud"}`, false, true, 0, false},
+		{"bad-data", `{`, false, true, 0, false},
+		{"snapd-error", `{}`, true, true, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			published := make(chan PublishLogs, 10)
+			publish := func(payload []byte) {
+				msg := PublishLogs{}
+				if err := json.Unmarshal(payload, &msg); err != nil {
+					t.Errorf("RetrieveLogs: published logs: %v", err)
+				}
+				published <- msg
+			}
+
+			act := SubscribeAction{}
+			act.Id = "abc123"
+			act.Action = "logs"
+			act.Data = tt.data
+
+			resp := act.RetrieveLogs(&snapdapi.MockClient{WithError: tt.snapdErr}, publish, nil)
+			if resp.Success == tt.respErr {
+				t.Errorf("RetrieveLogs: response unexpected: %s", resp.Message)
+			}
+			if tt.respErr {
+				return
+			}
+
+			// Wait for the final batch, which is published in the background when following
+			var logs string
+			for msg := range published {
+				logs += msg.Result
+				if msg.Final {
+					if msg.Truncated != tt.truncated {
+						t.Errorf("RetrieveLogs: truncated = %v, want %v", msg.Truncated, tt.truncated)
+					}
+					break
+				}
+			}
+
+			if got := strings.Count(logs, "\n"); got != tt.lines {
+				t.Errorf("RetrieveLogs: got %d lines, want %d", got, tt.lines)
+			}
+		})
+	}
+}
+
+// mockTransfers records the payloads sent over MQTT
+type mockTransfers struct {
+	payloads chan string
+	err      error
+}
+
+func (m *mockTransfers) Send(id, name string, r io.ReaderAt, size int64) error {
+	data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return err
+	}
+	m.payloads <- string(data)
+	return m.err
+}
+
+func TestSubscribeAction_Transfer(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      string
+		data        string
+		transferErr error
+		respErr     bool
+		payload     string
+		success     bool
+	}{
+		{"logs", "logs", `{"destination": "mqtt"}`, nil, false, "helloworld log line 2", true},
+		{"logs-follow", "logs", `{"destination": "mqtt", "follow": true, "followSeconds": 5}`, nil, false, "helloworld log line 2", true},
+		{"logs-transfer-error", "logs", `{"destination": "mqtt"}`, fmt.Errorf("MOCK transfer error"), false, "helloworld log line 2", false},
+		{"logs-no-url", "logs", `{"destination": "url"}`, nil, true, "", false},
+		{"logs-invalid-destination", "logs", `{"destination": "ftp"}`, nil, true, "", false},
+		{"snapshot", "snapshot", `{}`, nil, false, "mock archive stream", true},
+		{"snapshot-mqtt", "snapshot", `{"url": "https://example.com/upload", "destination": "mqtt"}`, nil, false, "mock archive stream", true},
+		{"snapshot-invalid-destination", "snapshot", `{"destination": "ftp"}`, nil, true, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transfers := &mockTransfers{payloads: make(chan string, 1), err: tt.transferErr}
+			responses := make(chan messages.PublishResponse, 1)
+			upload := &uploader{transfers: transfers, respond: func(_ *SubscribeAction, payload []byte) {
+				resp := messages.PublishResponse{}
+				if err := json.Unmarshal(payload, &resp); err != nil {
+					t.Errorf("transfer: response: %v", err)
+				}
+				responses <- resp
+			}}
+
+			act := SubscribeAction{}
+			act.Id = "abc123"
+			act.Action = tt.action
+			act.Snap = "helloworld"
+			act.Data = tt.data
+
+			var resp messages.PublishResponse
+			if tt.action == "logs" {
+				resp = act.RetrieveLogs(&snapdapi.MockClient{}, func([]byte) {}, upload)
+			} else {
+				resp = act.SnapSnapshot(&snapdapi.MockClient{}, upload)
+			}
+			if resp.Success == tt.respErr {
+				t.Errorf("transfer: response unexpected: %s", resp.Message)
+			}
+			if tt.respErr {
+				return
+			}
+
+			// The transfer runs in the background, then publishes the final response
+			payload := <-transfers.payloads
+			final := <-responses
+			if !strings.Contains(payload, tt.payload) {
+				t.Errorf("transfer: payload = %q, want %q", payload, tt.payload)
+			}
+			if final.Success != tt.success || final.Id != act.Id {
+				t.Errorf("transfer: final response = %+v, want success %v", final, tt.success)
+			}
+		})
+	}
+}
+
+func TestSubscribeAction_UploadOverBudget(t *testing.T) {
+	defer viper.Set(config.UsageBudgetDailyKey, "")
+	viper.Set(config.UsageBudgetDailyKey, "1KB")
+
+	uploaded := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploaded <- r.URL.Path
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		action     string
+		overBudget bool
+	}{
+		{"logs", "logs", false},
+		{"logs-over-budget", "logs", true},
+		{"snapshot", "snapshot", false},
+		{"snapshot-over-budget", "snapshot", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meter := mqtt.OpenMeter("")
+			if tt.overBudget {
+				meter.Count(mqtt.TrafficMetrics, mqtt.Outbound, 2048)
+			}
+			upload := &uploader{respond: func(*SubscribeAction, []byte) {}, meter: meter}
+
+			act := SubscribeAction{}
+			act.Id = "abc123"
+			act.Action = tt.action
+			act.Snap = "helloworld"
+			act.Data = fmt.Sprintf(`{"url": "%s/%s"}`, srv.URL, tt.name)
+
+			var resp messages.PublishResponse
+			if tt.action == "logs" {
+				resp = act.RetrieveLogs(&snapdapi.MockClient{}, func([]byte) {}, upload)
+			} else {
+				resp = act.SnapSnapshot(&snapdapi.MockClient{}, upload)
+			}
+
+			// The presigned url would expire before the budget resets, so the upload is refused
+			if resp.Success == tt.overBudget {
+				t.Fatalf("upload: response unexpected: %s", resp.Message)
+			}
+			if tt.overBudget && resp.Message != errBudgetExceeded.Error() {
+				t.Errorf("upload: response = %s, want %s", resp.Message, errBudgetExceeded)
+			}
+
+			select {
+			case path := <-uploaded:
+				if tt.overBudget {
+					t.Errorf("upload: uploaded %s over the budget", path)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if !tt.overBudget {
+					t.Error("upload: expected an upload")
+				}
+			}
+
+			usage := meter.Stats().Daily.Classes[mqtt.TrafficUploads]
+			if counted := usage != nil && usage.Out > 0; counted == tt.overBudget {
+				t.Errorf("upload: uploads usage = %+v", usage)
+			}
+		})
+	}
+}
+
+func TestUploader_DeferredTransfers(t *testing.T) {
+	defer viper.Set(config.UsageBudgetDailyKey, "")
+	viper.Set(config.UsageBudgetDailyKey, "1KB")
+	defer viper.Set(config.UsageDeferredMaxKey, viper.Get(config.UsageDeferredMaxKey))
+	viper.Set(config.UsageDeferredMaxKey, 1)
+
+	meter := mqtt.OpenMeter("")
+	meter.Count(mqtt.TrafficMetrics, mqtt.Outbound, 2048)
+	responses := make(chan messages.PublishResponse, 2)
+	upload := &uploader{transfers: &mockTransfers{payloads: make(chan string, 1)}, meter: meter, respond: func(_ *SubscribeAction, payload []byte) {
+		resp := messages.PublishResponse{}
+		_ = json.Unmarshal(payload, &resp)
+		responses <- resp
+	}}
+	upload.ctx, upload.cancel = context.WithCancel(context.Background())
+
+	act := &SubscribeAction{}
+	act.Id = "abc123"
+	act.Action = "logs"
+
+	// The first transfer waits for the budget, and the next one is refused
+	cleaned := make(chan bool, 1)
+	go upload.transfer(act, "logs", strings.NewReader("log line 1"), 10, func() { cleaned <- true })
+	for waiting := 0; waiting == 0; {
+		time.Sleep(10 * time.Millisecond)
+		upload.mu.Lock()
+		waiting = upload.deferred
+		upload.mu.Unlock()
+	}
+	upload.transfer(act, "logs", strings.NewReader("log line 2"), 10, nil)
+
+	select {
+	case resp := <-responses:
+		if resp.Success || resp.Message != errTooManyDeferred.Error() {
+			t.Errorf("transfer: response = %+v, want %s", resp, errTooManyDeferred)
+		}
+	case <-time.After(time.Second):
+		t.Error("transfer: expected the transfer to be refused")
+	}
+
+	// Closing cancels the waiting transfer, which removes its payload
+	upload.close()
+	select {
+	case resp := <-responses:
+		if resp.Success || !strings.Contains(resp.Message, "cancelled") {
+			t.Errorf("transfer: response = %+v, want the transfer cancelled", resp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("transfer: expected the waiting transfer to be cancelled")
+	}
+	select {
+	case <-cleaned:
+	case <-time.After(time.Second):
+		t.Error("transfer: expected the cancelled transfer to clean up")
+	}
+}
@@ -0,0 +1,276 @@
+package legacy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/everactive/iot-devicetwin/pkg/messages"
+	log "github.com/sirupsen/logrus"
+	"github.com/snapcore/snapd/client"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/pkg/config"
+	"github.com/everactive/iot-agent/snapdapi"
+)
+
+const (
+	defaultFollowSeconds = 60
+	logBatchInterval     = 5 * time.Second
+	logBatchBytes        = 16 * 1024
+)
+
+// logPublisher publishes a serialized PublishLogs message
+type logPublisher func(payload []byte)
+
+// RetrieveLogs pulls syslog logs from the snapd api and uploads them to an accessible S3 url,
+// or publishes them over MQTT when no url is provided. Followed logs are streamed in the
+// background until the follow duration ends.
+func (act *SubscribeAction) RetrieveLogs(snapd snapdapi.SnapdClient, publish logPublisher, upload *uploader) messages.PublishResponse {
+	var data DeviceLogs
+	if err := json.Unmarshal([]byte(act.Data), &data); err != nil {
+		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	// Without a destination, the logs are uploaded to the url or else published
+	if len(data.Destination) > 0 {
+		destination, err := uploadDestination(data.Destination, data.Url)
+		if err != nil {
+			return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
+		}
+		data.Destination = destination
+	}
+
+	if len(data.Priority) > 0 && !validPriority(data.Priority) {
+		return messages.PublishResponse{Id: act.Id, Success: false, Message: fmt.Sprintf("invalid log priority: %s", data.Priority)}
+	}
+
+	filter := &logFilter{since: data.Since, until: data.Until, maxBytes: maxLogBytes(data.MaxBytes)}
+
+	// Followed logs are read until the follow duration ends
+	duration := followDuration(data.FollowSeconds)
+	ctx, cancel := logsContext(data.Follow, duration)
+
+	ch, err := openLogs(ctx, snapd, data)
+	if err != nil {
+		cancel()
+		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	if data.Follow {
+		go act.followLogs(cancel, ch, filter, data, publish, upload)
+		return messages.PublishResponse{Id: act.Id, Success: true, Message: fmt.Sprintf("Following logs for %s", duration)}
+	}
+
+	logs := filter.collect(ch)
+	cancel()
+
+	if data.Destination == DestinationMQTT {
+		go upload.transfer(act, "logs", strings.NewReader(logs), int64(len(logs)), nil)
+		return messages.PublishResponse{Id: act.Id, Action: act.Action, Success: true, Message: fmt.Sprintf("Transferring %d bytes of logs", len(logs))}
+	}
+
+	if len(data.Url) > 0 {
+		if upload.overBudget() {
+			return messages.PublishResponse{Id: act.Id, Success: false, Message: errBudgetExceeded.Error()}
+		}
+		err = upload.put(data.Url, strings.NewReader(logs), int64(len(logs)))
+		if err != nil {
+			return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
+		}
+	} else {
+		act.publishLogs(publish, PublishLogs{Success: true, Result: logs, Final: true, Truncated: filter.truncated})
+	}
+
+	return messages.PublishResponse{
+		Id:      act.Id,
+		Action:  act.Action,
+		Success: true,
+	}
+}
+
+// logsContext returns the context of reading the logs, which times out after the duration when following them
+func logsContext(follow bool, duration time.Duration) (context.Context, context.CancelFunc) {
+	if follow {
+		return context.WithTimeout(context.Background(), duration)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// followLogs streams the followed logs until the stream ends, then uploads them to the url
+// or over MQTT or, without either, publishes them in batches as they arrive
+func (act *SubscribeAction) followLogs(cancel context.CancelFunc, ch <-chan client.Log, filter *logFilter, data DeviceLogs, publish logPublisher, upload *uploader) {
+	defer cancel()
+
+	if data.Destination == DestinationMQTT {
+		logs := filter.collect(ch)
+		upload.transfer(act, "logs", strings.NewReader(logs), int64(len(logs)), nil)
+		return
+	}
+
+	if url := data.Url; len(url) > 0 {
+		// A presigned url needs the content length up front, so the logs are uploaded at the end
+		logs := filter.collect(ch)
+		if upload.overBudget() {
+			act.publishLogs(publish, PublishLogs{Success: false, Message: errBudgetExceeded.Error(), Final: true})
+			return
+		}
+		if err := upload.put(url, strings.NewReader(logs), int64(len(logs))); err != nil {
+			log.Printf("Error uploading followed logs: %v", err)
+			act.publishLogs(publish, PublishLogs{Success: false, Message: err.Error(), Final: true})
+		}
+		return
+	}
+
+	ticker := time.NewTicker(logBatchInterval)
+	defer ticker.Stop()
+
+	var sb strings.Builder
+	sequence := 0
+	flush := func(final bool) {
+		act.publishLogs(publish, PublishLogs{
+			Success:   true,
+			Result:    sb.String(),
+			Sequence:  sequence,
+			Final:     final,
+			Truncated: filter.truncated,
+		})
+		sequence++
+		sb.Reset()
+	}
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				flush(true)
+				return
+			}
+
+			line, accepted, done := filter.accept(msg)
+			if accepted {
+				sb.WriteString(line)
+			}
+			if done {
+				flush(true)
+				return
+			}
+			if sb.Len() >= logBatchBytes {
+				flush(false)
+			}
+		case <-ticker.C:
+			if sb.Len() > 0 {
+				flush(false)
+			}
+		}
+	}
+}
+
+func (act *SubscribeAction) publishLogs(publish logPublisher, msg PublishLogs) {
+	msg.Id = act.Id
+	msg.Action = act.Action
+
+	data, err := serializeResponse(msg)
+	if err != nil {
+		log.Printf("Error serializing the logs: %v", err)
+		return
+	}
+	publish(data)
+}
+
+// openLogs requests the logs from snapd, or from the journal when filtering by
+// priority as snapd does not provide it
+func openLogs(ctx context.Context, snapd snapdapi.SnapdClient, data DeviceLogs) (<-chan client.Log, error) {
+	n := data.Limit
+	if n == 0 && !data.Since.IsZero() {
+		// Filtering by time needs all the lines
+		n = -1
+	}
+
+	if len(data.Priority) > 0 {
+		return journalLogs(ctx, data.Snaps, data.Priority, data.Since, n, data.Follow)
+	}
+
+	return snapd.Logs(ctx, data.Snaps, client.LogOptions{N: n, Follow: data.Follow})
+}
+
+// logFilter applies the time window and the size cap to a log stream
+type logFilter struct {
+	since     time.Time
+	until     time.Time
+	maxBytes  int64
+	size      int64
+	truncated bool
+}
+
+// accept formats a log line that passes the filters. Done is true when no
+// further lines will be accepted.
+func (f *logFilter) accept(msg client.Log) (line string, accepted bool, done bool) {
+	if !f.since.IsZero() && msg.Timestamp.Before(f.since) {
+		return "", false, false
+	}
+	// The logs are in chronological order, so nothing more can match
+	if !f.until.IsZero() && msg.Timestamp.After(f.until) {
+		return "", false, true
+	}
+
+	line = fmt.Sprintf(
+		"[%s] %s %s %s\n",
+		msg.Timestamp.String(),
+		msg.PID,
+		msg.SID,
+		msg.Message,
+	)
+
+	if f.size+int64(len(line)) > f.maxBytes {
+		f.truncated = true
+		return "", false, true
+	}
+	f.size += int64(len(line))
+
+	return line, true, false
+}
+
+// collect accumulates the log lines that pass the filters
+func (f *logFilter) collect(ch <-chan client.Log) string {
+	var sb strings.Builder
+	for msg := range ch {
+		line, accepted, done := f.accept(msg)
+		if accepted {
+			sb.WriteString(line)
+		}
+		if done {
+			break
+		}
+	}
+	return sb.String()
+}
+
+func maxLogBytes(requested int64) int64 {
+	limit := viper.GetInt64(config.LogsMaxBytesKey)
+	if limit <= 0 {
+		limit = int64(config.DefaultConfig[config.LogsMaxBytesKey].(int))
+	}
+	if requested > 0 && requested < limit {
+		return requested
+	}
+	return limit
+}
+
+func followDuration(seconds int) time.Duration {
+	limit := viper.GetDuration(config.LogsFollowMaxDurationKey)
+	if limit <= 0 {
+		limit = config.DefaultConfig[config.LogsFollowMaxDurationKey].(time.Duration)
+	}
+
+	d := time.Duration(seconds) * time.Second
+	if seconds <= 0 {
+		d = defaultFollowSeconds * time.Second
+	}
+	if d > limit {
+		return limit
+	}
+	return d
+}
@@ -20,8 +20,10 @@
 package legacy
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/mem"
@@ -36,10 +38,59 @@ func (h *Handler) Metrics() {
 	h.cpu()
 }
 
-func (h *Handler) publishMetrics(payload string) {
+// metricField is a field of a measurement, an integer or a float
+type metricField struct {
+	name  string
+	value interface{}
+}
+
+// publishMetrics publishes a measurement in the configured encoding. The default JSON encoding
+// keeps the line protocol, which is more compact than a JSON object with the field names, while
+// CBOR publishes an object with the measurement, the device and the fields
+func (h *Handler) publishMetrics(measurement string, fields []metricField) {
+	payload, contentType := h.encodeMetrics(measurement, fields, payloadEncoding(""))
+
 	// The topic to publish the response to the specific action
-	t := fmt.Sprintf("metrics/%s", h.organizationID)
-	h.mqttConn.Client.Publish(t, mqtt.QOSAtMostOnce, false, []byte(payload))
+	t := h.topics.Get(mqtt.TopicMetrics)
+	h.mqttConn.Publish(mqtt.ClassTelemetry, t.Name, t.QoS, t.Retained, payload, messageProperties(contentType, true))
+}
+
+// encodeMetrics serializes a measurement, returning the payload and its content type
+func (h *Handler) encodeMetrics(measurement string, fields []metricField, encoding string) ([]byte, string) {
+	if encoding == EncodingJSON {
+		return []byte(lineProtocol(measurement, h.clientID, fields)), contentTypeLineProtocol
+	}
+
+	values := map[string]interface{}{}
+	for _, f := range fields {
+		values[f.name] = f.value
+	}
+	data, err := json.Marshal(map[string]interface{}{"measurement": measurement, "device": h.clientID, "fields": values})
+	if err != nil {
+		log.Printf("Error serializing the %s metrics, using line protocol: %v", measurement, err)
+		return []byte(lineProtocol(measurement, h.clientID, fields)), contentTypeLineProtocol
+	}
+
+	payload, contentType, err := encodePayload(data, encoding)
+	if err != nil {
+		log.Printf("Error encoding the %s metrics as %s, using line protocol: %v", measurement, encoding, err)
+		return []byte(lineProtocol(measurement, h.clientID, fields)), contentTypeLineProtocol
+	}
+	return payload, contentType
+}
+
+// lineProtocol formats a measurement in line protocol, e.g. `cpu,device=a111 user=1.000000`
+func lineProtocol(measurement, device string, fields []metricField) string {
+	values := make([]string, 0, len(fields))
+	for _, f := range fields {
+		switch v := f.value.(type) {
+		case float64:
+			values = append(values, fmt.Sprintf("%s=%f", f.name, v))
+		default:
+			values = append(values, fmt.Sprintf("%s=%d", f.name, v))
+		}
+	}
+	return fmt.Sprintf("%s,device=%s %s", measurement, device, strings.Join(values, ","))
 }
 
 func (h *Handler) memory() {
@@ -49,8 +100,7 @@ func (h *Handler) memory() {
 		return
 	}
 
-	payload := fmt.Sprintf("memory,device=%s total=%d,used=%d,usedpc=%f", h.clientID, v.Total, v.Used, v.UsedPercent)
-	h.publishMetrics(payload)
+	h.publishMetrics("memory", []metricField{{"total", v.Total}, {"used", v.Used}, {"usedpc", v.UsedPercent}})
 }
 
 func (h *Handler) cpu() {
@@ -67,6 +117,5 @@ func (h *Handler) cpu() {
 		total += v.Total()
 	}
 
-	payload := fmt.Sprintf("cpu,device=%s user=%f,system=%f,total=%f", h.clientID, user, system, total)
-	h.publishMetrics(payload)
+	h.publishMetrics("cpu", []metricField{{"user", user}, {"system", system}, {"total", total}})
 }
@@ -0,0 +1,41 @@
+package legacy
+
+import (
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/mqtt"
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+// SchemaVersion is the version of the published message formats
+const SchemaVersion = "1"
+
+// Content types of the published messages
+const (
+	contentTypeJSON         = "application/json"
+	contentTypeLineProtocol = "text/plain"
+)
+
+// User property names of the published messages
+const (
+	propertyContentType   = "content-type"
+	propertyEncoding      = "encoding"
+	propertySchemaVersion = "schema-version"
+)
+
+// messageProperties returns the MQTT 5 properties of a published message. Telemetry
+// expires, as the broker should not deliver stale health and metrics to the cloud
+func messageProperties(contentType string, telemetry bool) *mqtt.MessageProperties {
+	props := &mqtt.MessageProperties{
+		ContentType: contentType,
+		UserProperties: map[string]string{
+			propertyContentType:   contentType,
+			propertySchemaVersion: SchemaVersion,
+		},
+	}
+
+	if telemetry {
+		props.MessageExpiry = viper.GetDuration(config.MQTTMessageExpiryKey)
+	}
+	return props
+}
@@ -0,0 +1,137 @@
+package legacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/everactive/iot-devicetwin/pkg/messages"
+	"github.com/snapcore/snapd/client"
+
+	"github.com/everactive/iot-agent/snapdapi"
+)
+
+// QuotaCreate creates a quota group, optionally with snaps in it
+func (act *SubscribeAction) QuotaCreate() messages.PublishSnapTask {
+	data, err := act.quotaRequest()
+	if err != nil {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	_, err = snapd.GetQuotaGroup(data.Name)
+	if err == nil {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: fmt.Sprintf("quota group %s already exists", data.Name)}
+	}
+	if !isNotFound(err) {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	return act.ensureQuota(data)
+}
+
+// QuotaUpdate changes the limits of an existing quota group and adds snaps to it
+func (act *SubscribeAction) QuotaUpdate() messages.PublishSnapTask {
+	data, err := act.quotaRequest()
+	if err != nil {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	if _, err = snapd.GetQuotaGroup(data.Name); err != nil {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	return act.ensureQuota(data)
+}
+
+// QuotaRemove removes a quota group, leaving its snaps installed
+func (act *SubscribeAction) QuotaRemove() messages.PublishSnapTask {
+	data, err := act.quotaRequest()
+	if err != nil {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	// Call the snapd API
+	result, err := snapd.RemoveQuota(data.Name)
+	if err != nil {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: err.Error()}
+	}
+	return messages.PublishSnapTask{Id: act.Id, Success: true, Result: result}
+}
+
+// QuotaList lists the quota groups with their limits and current usage
+func (act *SubscribeAction) QuotaList() PublishQuotaGroups {
+	groups, err := quotaGroups()
+	if err != nil {
+		return PublishQuotaGroups{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	return PublishQuotaGroups{Id: act.Id, Success: true, Result: groups}
+}
+
+func (act *SubscribeAction) quotaRequest() (*QuotaRequest, error) {
+	var data QuotaRequest
+	if err := json.Unmarshal([]byte(act.Data), &data); err != nil {
+		return nil, err
+	}
+
+	if len(data.Name) == 0 {
+		return nil, fmt.Errorf("no quota group name provided for %s", act.Action)
+	}
+	return &data, nil
+}
+
+func (act *SubscribeAction) ensureQuota(data *QuotaRequest) messages.PublishSnapTask {
+	constraints := &snapdapi.QuotaValues{
+		Memory:  data.Memory,
+		Threads: data.Threads,
+	}
+	if data.CpuCount > 0 || data.CpuPercentage > 0 {
+		constraints.CPU = &snapdapi.QuotaCPU{Count: data.CpuCount, Percentage: data.CpuPercentage}
+	}
+
+	// Call the snapd API
+	result, err := snapd.EnsureQuota(data.Name, data.Parent, data.Snaps, constraints)
+	if err != nil {
+		return messages.PublishSnapTask{Id: act.Id, Success: false, Message: err.Error()}
+	}
+	return messages.PublishSnapTask{Id: act.Id, Success: true, Result: result}
+}
+
+// quotaGroups lists the quota groups in the device twin format
+func quotaGroups() ([]*QuotaGroup, error) {
+	// Call the snapd API
+	groups, err := snapd.Quotas()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*QuotaGroup{}
+	for _, g := range groups {
+		group := &QuotaGroup{
+			Name:      g.GroupName,
+			Parent:    g.Parent,
+			Snaps:     g.Snaps,
+			Subgroups: g.Subgroups,
+		}
+		if g.Constraints != nil {
+			group.Memory = g.Constraints.Memory
+			group.Threads = g.Constraints.Threads
+			if g.Constraints.CPU != nil {
+				group.CpuCount = g.Constraints.CPU.Count
+				group.CpuPercentage = g.Constraints.CPU.Percentage
+			}
+		}
+		if g.Current != nil {
+			group.MemoryUsage = g.Current.Memory
+			group.ThreadsUsage = g.Current.Threads
+		}
+		result = append(result, group)
+	}
+
+	return result, nil
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*client.Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
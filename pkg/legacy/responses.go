@@ -0,0 +1,242 @@
+package legacy
+
+import (
+	"time"
+
+	"github.com/everactive/iot-devicetwin/pkg/messages"
+
+	"github.com/everactive/iot-agent/mqtt"
+)
+
+// RefreshCandidate is an installed snap with an update available in its tracking channel
+type RefreshCandidate struct {
+	AvailableRevision int    `json:"availableRevision,omitempty"`
+	AvailableVersion  string `json:"availableVersion,omitempty"`
+	Channel           string `json:"channel,omitempty"`
+	CurrentRevision   int    `json:"currentRevision,omitempty"`
+	CurrentVersion    string `json:"currentVersion,omitempty"`
+	Name              string `json:"name,omitempty"`
+}
+
+// PublishRefreshCandidates is the response to a refresh-candidates action
+type PublishRefreshCandidates struct {
+	Action  string              `json:"action,omitempty"`
+	Id      string              `json:"id,omitempty"`
+	Message string              `json:"message,omitempty"`
+	Result  []*RefreshCandidate `json:"result,omitempty"`
+	Success bool                `json:"success,omitempty"`
+}
+
+// FindRequest is the data of a find action
+type FindRequest struct {
+	Prefix  bool   `json:"prefix,omitempty"`
+	Query   string `json:"query,omitempty"`
+	Scope   string `json:"scope,omitempty"`
+	Section string `json:"section,omitempty"`
+}
+
+// StoreChannel is a single entry of a store snap's channel map
+type StoreChannel struct {
+	Channel     string    `json:"channel,omitempty"`
+	Confinement string    `json:"confinement,omitempty"`
+	ReleasedAt  time.Time `json:"releasedAt,omitempty"`
+	Revision    int       `json:"revision,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Version     string    `json:"version,omitempty"`
+}
+
+// StoreSnap is a snap as published in the store
+type StoreSnap struct {
+	Channels    map[string]*StoreChannel `json:"channels,omitempty"`
+	Confinement string                   `json:"confinement,omitempty"`
+	Id          string                   `json:"id,omitempty"`
+	Name        string                   `json:"name,omitempty"`
+	Publisher   string                   `json:"publisher,omitempty"`
+	Revision    int                      `json:"revision,omitempty"`
+	Summary     string                   `json:"summary,omitempty"`
+	Title       string                   `json:"title,omitempty"`
+	Tracks      []string                 `json:"tracks,omitempty"`
+	Type        string                   `json:"type,omitempty"`
+	Version     string                   `json:"version,omitempty"`
+}
+
+// PublishStoreSnaps is the response to a find action
+type PublishStoreSnaps struct {
+	Action  string       `json:"action,omitempty"`
+	Id      string       `json:"id,omitempty"`
+	Message string       `json:"message,omitempty"`
+	Result  []*StoreSnap `json:"result,omitempty"`
+	Success bool         `json:"success,omitempty"`
+}
+
+// AssertionsRequest is the data of an assertions action
+type AssertionsRequest struct {
+	Headers map[string]string `json:"headers,omitempty"`
+	Type    string            `json:"type,omitempty"`
+}
+
+// PublishAssertions is the response to an assertions action, the result is a
+// stream of assertions separated by double newlines
+type PublishAssertions struct {
+	Action  string `json:"action,omitempty"`
+	Id      string `json:"id,omitempty"`
+	Message string `json:"message,omitempty"`
+	Result  string `json:"result,omitempty"`
+	Success bool   `json:"success,omitempty"`
+}
+
+// DeviceLogs is the data of a logs action, extending the device twin request
+// with filters and a follow mode
+type DeviceLogs struct {
+	messages.DeviceLogs
+
+	// Follow keeps streaming new log lines for FollowSeconds
+	Follow        bool `json:"follow,omitempty"`
+	FollowSeconds int  `json:"followSeconds,omitempty"`
+
+	// MaxBytes caps the size of the retrieved logs
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+
+	// Priority is a syslog priority name or number, only lines of this
+	// priority or more important are retrieved
+	Priority string `json:"priority,omitempty"`
+
+	Since time.Time `json:"since,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+
+	// Snaps are the snaps or fully qualified services to retrieve logs for,
+	// system-wide logs are retrieved if empty
+	Snaps []string `json:"snaps,omitempty"`
+
+	// Destination is `url` or `mqtt` to send the logs in chunks over MQTT. Without
+	// either, the logs are published as PublishLogs messages
+	Destination string `json:"destination,omitempty"`
+}
+
+// SnapSnapshot is the request to upload a snapshot of a snap
+type SnapSnapshot struct {
+	messages.SnapSnapshot
+
+	// Destination is `url` or `mqtt`, and defaults to the url when there is one
+	Destination string `json:"destination,omitempty"`
+}
+
+// PublishLogs carries log lines over MQTT when no upload url is provided.
+// Logs that are followed are published in sequenced batches until Final.
+type PublishLogs struct {
+	Action    string `json:"action,omitempty"`
+	Final     bool   `json:"final,omitempty"`
+	Id        string `json:"id,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Result    string `json:"result,omitempty"`
+	Sequence  int    `json:"sequence,omitempty"`
+	Success   bool   `json:"success,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// QuotaRequest is the data of the quota group actions
+type QuotaRequest struct {
+	CpuCount      int      `json:"cpuCount,omitempty"`
+	CpuPercentage int      `json:"cpuPercentage,omitempty"`
+	Memory        uint64   `json:"memory,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	Parent        string   `json:"parent,omitempty"`
+	Snaps         []string `json:"snaps,omitempty"`
+	Threads       int      `json:"threads,omitempty"`
+}
+
+// QuotaGroup is a quota group with its limits and current usage
+type QuotaGroup struct {
+	CpuCount      int      `json:"cpuCount,omitempty"`
+	CpuPercentage int      `json:"cpuPercentage,omitempty"`
+	Memory        uint64   `json:"memory,omitempty"`
+	MemoryUsage   uint64   `json:"memoryUsage,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	Parent        string   `json:"parent,omitempty"`
+	Snaps         []string `json:"snaps,omitempty"`
+	Subgroups     []string `json:"subgroups,omitempty"`
+	Threads       int      `json:"threads,omitempty"`
+	ThreadsUsage  int      `json:"threadsUsage,omitempty"`
+}
+
+// PublishQuotaGroups is the response to a quota-list action
+type PublishQuotaGroups struct {
+	Action  string        `json:"action,omitempty"`
+	Id      string        `json:"id,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Result  []*QuotaGroup `json:"result,omitempty"`
+	Success bool          `json:"success,omitempty"`
+}
+
+// SnapComponent is a component of a snap, such as a kernel module or a plugin
+type SnapComponent struct {
+	Installed     bool       `json:"installed,omitempty"`
+	InstalledDate *time.Time `json:"installedDate,omitempty"`
+	InstalledSize int64      `json:"installedSize,omitempty"`
+	Name          string     `json:"name,omitempty"`
+	Revision      int        `json:"revision,omitempty"`
+	Summary       string     `json:"summary,omitempty"`
+	Type          string     `json:"type,omitempty"`
+	Version       string     `json:"version,omitempty"`
+}
+
+// DeviceSnap extends the device twin snap details with the snap components
+type DeviceSnap struct {
+	messages.DeviceSnap
+	Components []*SnapComponent `json:"components,omitempty"`
+}
+
+// PublishSnaps is the response to a list action
+type PublishSnaps struct {
+	Action  string        `json:"action,omitempty"`
+	Id      string        `json:"id,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Result  []*DeviceSnap `json:"result,omitempty"`
+	Success bool          `json:"success,omitempty"`
+}
+
+// PublishSnap is the response to an info action
+type PublishSnap struct {
+	Action  string      `json:"action,omitempty"`
+	Id      string      `json:"id,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Result  *DeviceSnap `json:"result,omitempty"`
+	Success bool        `json:"success,omitempty"`
+}
+
+// ComponentsRequest is the data of the component install and remove actions
+type ComponentsRequest struct {
+	Components []string `json:"components,omitempty"`
+}
+
+// DeviceDataRequest is the data of the device-data action, with the base64 encoded device data
+type DeviceDataRequest struct {
+	DeviceData string `json:"deviceData"`
+}
+
+// PublishComponents is the response to a component-list action
+type PublishComponents struct {
+	Action  string           `json:"action,omitempty"`
+	Id      string           `json:"id,omitempty"`
+	Message string           `json:"message,omitempty"`
+	Result  []*SnapComponent `json:"result,omitempty"`
+	Success bool             `json:"success,omitempty"`
+}
+
+// Health is the device health message, with the current broker and the state of the outbound message queue
+type Health struct {
+	messages.Health
+	Broker string           `json:"broker,omitempty"`
+	Queue  *mqtt.QueueStats `json:"queue,omitempty"`
+	Usage  *mqtt.UsageStats `json:"usage,omitempty"`
+}
+
+// Inventory is the periodic report of the software installed on the device
+type Inventory struct {
+	DeviceId          string              `json:"deviceId,omitempty"`
+	OrgId             string              `json:"orgId,omitempty"`
+	Quotas            []*QuotaGroup       `json:"quotas,omitempty"`
+	Refresh           time.Time           `json:"refresh,omitempty"`
+	RefreshCandidates []*RefreshCandidate `json:"refreshCandidates,omitempty"`
+	Snaps             []*DeviceSnap       `json:"snaps,omitempty"`
+}
@@ -0,0 +1,125 @@
+package legacy
+
+import (
+	"encoding/json"
+
+	"github.com/snapcore/snapd/client"
+)
+
+// SnapRefreshCandidates lists the installed snaps that have an update available
+func (act *SubscribeAction) SnapRefreshCandidates() PublishRefreshCandidates {
+	candidates, err := refreshCandidates()
+	if err != nil {
+		return PublishRefreshCandidates{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	return PublishRefreshCandidates{Id: act.Id, Success: true, Result: candidates}
+}
+
+// SnapFind searches the store for snaps by name or by query
+func (act *SubscribeAction) SnapFind() PublishStoreSnaps {
+	// An exact name search returns the full channel map of the snap
+	if len(act.Snap) > 0 {
+		s, _, err := snapd.FindOne(act.Snap)
+		if err != nil {
+			return PublishStoreSnaps{Id: act.Id, Success: false, Message: err.Error()}
+		}
+		return PublishStoreSnaps{Id: act.Id, Success: true, Result: []*StoreSnap{storeSnap(s)}}
+	}
+
+	var data FindRequest
+	if err := json.Unmarshal([]byte(act.Data), &data); err != nil {
+		return PublishStoreSnaps{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	if len(data.Query) == 0 && len(data.Section) == 0 {
+		return PublishStoreSnaps{Id: act.Id, Success: false, Message: "No snap name or query provided for find"}
+	}
+
+	// Call the snapd API
+	snaps, _, err := snapd.Find(&client.FindOptions{
+		Query:   data.Query,
+		Prefix:  data.Prefix,
+		Section: data.Section,
+		Scope:   data.Scope,
+	})
+	if err != nil {
+		return PublishStoreSnaps{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	ss := []*StoreSnap{}
+	for _, s := range snaps {
+		ss = append(ss, storeSnap(s))
+	}
+
+	return PublishStoreSnaps{Id: act.Id, Success: true, Result: ss}
+}
+
+// refreshCandidates matches the snaps with pending updates to the installed revisions
+func refreshCandidates() ([]*RefreshCandidate, error) {
+	// Call the snapd API
+	available, err := snapd.RefreshCandidates()
+	if err != nil {
+		return nil, err
+	}
+
+	installed, err := snapd.List([]string{}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	current := map[string]*client.Snap{}
+	for _, s := range installed {
+		current[s.Name] = s
+	}
+
+	candidates := []*RefreshCandidate{}
+	for _, s := range available {
+		c := &RefreshCandidate{
+			Name:              s.Name,
+			AvailableRevision: s.Revision.N,
+			AvailableVersion:  s.Version,
+		}
+		if inst, ok := current[s.Name]; ok {
+			c.Channel = inst.TrackingChannel
+			c.CurrentRevision = inst.Revision.N
+			c.CurrentVersion = inst.Version
+		}
+		candidates = append(candidates, c)
+	}
+
+	return candidates, nil
+}
+
+func storeSnap(s *client.Snap) *StoreSnap {
+	result := &StoreSnap{
+		Confinement: s.Confinement,
+		Id:          s.ID,
+		Name:        s.Name,
+		Revision:    s.Revision.N,
+		Summary:     s.Summary,
+		Title:       s.Title,
+		Tracks:      s.Tracks,
+		Type:        s.Type,
+		Version:     s.Version,
+	}
+	if s.Publisher != nil {
+		result.Publisher = s.Publisher.Username
+	}
+
+	if len(s.Channels) > 0 {
+		result.Channels = map[string]*StoreChannel{}
+		for name, ch := range s.Channels {
+			result.Channels[name] = &StoreChannel{
+				Channel:     ch.Channel,
+				Confinement: string(ch.Confinement),
+				ReleasedAt:  ch.ReleasedAt,
+				Revision:    ch.Revision.N,
+				Size:        ch.Size,
+				Version:     ch.Version,
+			}
+		}
+	}
+
+	return result
+}
@@ -27,6 +27,7 @@ import (
 
 	"github.com/avast/retry-go"
 	"github.com/everactive/iot-devicetwin/pkg/messages"
+	log "github.com/sirupsen/logrus"
 	"github.com/snapcore/snapd/client"
 
 	"github.com/everactive/iot-agent/config"
@@ -36,6 +37,13 @@ import (
 // SubscribeAction is the message format for the action topic
 type SubscribeAction struct {
 	messages.SubscribeAction
+	// Encoding is the payload encoding requested for the response, e.g. cbor
+	Encoding string `json:"encoding,omitempty"`
+
+	// The MQTT 5 response topic and correlation data of the action, which also
+	// apply to the responses published after the action returned
+	responseTopic   string
+	correlationData []byte
 }
 
 // Device gets details of the device
@@ -94,15 +102,31 @@ func (act *SubscribeAction) SnapRemove() messages.PublishSnapTask {
 }
 
 // SnapList lists installed snaps
-func (act *SubscribeAction) SnapList(deviceId string) messages.PublishSnaps {
+func (act *SubscribeAction) SnapList(deviceId string) PublishSnaps {
+	ss, err := deviceSnaps(deviceId)
+	if err != nil {
+		return PublishSnaps{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	return PublishSnaps{Id: act.Id, Success: true, Result: ss}
+}
+
+// deviceSnaps lists the installed snaps in the device twin format
+func deviceSnaps(deviceId string) ([]*DeviceSnap, error) {
 	// Call the snapd API
 	snaps, err := snapd.List([]string{}, nil)
 	if err != nil {
-		return messages.PublishSnaps{Id: act.Id, Success: false, Message: err.Error()}
+		return nil, err
+	}
+
+	// Get the components of all the snaps in one go (ignore errors)
+	components, err := snapd.ListComponents([]string{})
+	if err != nil {
+		log.Printf("Error getting the snap components: %v", err)
 	}
 
 	// Convert the snaps into the device twin format
-	ss := []*messages.DeviceSnap{}
+	ss := []*DeviceSnap{}
 
 	for _, s := range snaps {
 		// Get the config for the snap (ignore errors)
@@ -115,22 +139,25 @@ func (act *SubscribeAction) SnapList(deviceId string) messages.PublishSnaps {
 			}
 		}
 
-		ss = append(ss, &messages.DeviceSnap{
-			DeviceId:      deviceId,
-			Name:          s.Name,
-			InstalledSize: s.InstalledSize,
-			InstalledDate: s.InstallDate,
-			Status:        s.Status,
-			Channel:       s.Channel,
-			Confinement:   s.Confinement,
-			Version:       s.Version,
-			Revision:      s.Revision.N,
-			Devmode:       s.DevMode,
-			Config:        conf,
+		ss = append(ss, &DeviceSnap{
+			DeviceSnap: messages.DeviceSnap{
+				DeviceId:      deviceId,
+				Name:          s.Name,
+				InstalledSize: s.InstalledSize,
+				InstalledDate: s.InstallDate,
+				Status:        s.Status,
+				Channel:       s.Channel,
+				Confinement:   s.Confinement,
+				Version:       s.Version,
+				Revision:      s.Revision.N,
+				Devmode:       s.DevMode,
+				Config:        conf,
+			},
+			Components: snapComponents(components[s.Name]),
 		})
 	}
 
-	return messages.PublishSnaps{Id: act.Id, Success: true, Result: ss}
+	return ss, nil
 }
 
 func (act *SubscribeAction) refreshSnap(name string, opts *client.SnapOptions) messages.PublishSnapTask {
@@ -325,32 +352,40 @@ func (act *SubscribeAction) SnapSetConf() messages.PublishSnapTask {
 }
 
 // SnapInfo gets the info for a snap
-func (act *SubscribeAction) SnapInfo() messages.PublishSnap {
+func (act *SubscribeAction) SnapInfo() PublishSnap {
 	if len(act.Snap) == 0 {
-		return messages.PublishSnap{Id: act.Id, Success: false, Message: "No snap name provIded for snap info"}
+		return PublishSnap{Id: act.Id, Success: false, Message: "No snap name provIded for snap info"}
 	}
 
 	// Call the snapd API
 	result, _, err := snapd.Snap(act.Snap)
 	if err != nil {
-		return messages.PublishSnap{Id: act.Id, Success: false, Message: err.Error()}
-	}
-
-	deviceSnap := messages.DeviceSnap{
-		Channel:       result.Channel,
-		Config:        "",
-		Confinement:   result.Confinement,
-		DeviceId:      result.ID,
-		Devmode:       result.DevMode,
-		InstalledDate: result.InstallDate,
-		InstalledSize: result.InstalledSize,
-		Name:          result.Name,
-		Revision:      result.Revision.N,
-		Status:        result.Status,
-		Version:       result.Version,
+		return PublishSnap{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	deviceSnap := DeviceSnap{
+		DeviceSnap: messages.DeviceSnap{
+			Channel:       result.Channel,
+			Config:        "",
+			Confinement:   result.Confinement,
+			DeviceId:      result.ID,
+			Devmode:       result.DevMode,
+			InstalledDate: result.InstallDate,
+			InstalledSize: result.InstalledSize,
+			Name:          result.Name,
+			Revision:      result.Revision.N,
+			Status:        result.Status,
+			Version:       result.Version,
+		},
+	}
+
+	// Get the components of the snap (ignore errors)
+	components, err := snapd.ListComponents([]string{act.Snap})
+	if err == nil {
+		deviceSnap.Components = snapComponents(components[act.Snap])
 	}
 
-	return messages.PublishSnap{Id: act.Id, Success: true, Result: &deviceSnap}
+	return PublishSnap{Id: act.Id, Success: true, Result: &deviceSnap}
 }
 
 // SnapAck adds an assertion to the device
@@ -364,6 +399,26 @@ func (act *SubscribeAction) SnapAck() messages.PublishResponse {
 	return messages.PublishResponse{Id: act.Id, Success: true}
 }
 
+// SnapAssertions gets the assertions of a type from the device, filtered by headers
+func (act *SubscribeAction) SnapAssertions() PublishAssertions {
+	var data AssertionsRequest
+	if err := json.Unmarshal([]byte(act.Data), &data); err != nil {
+		return PublishAssertions{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	if len(data.Type) == 0 {
+		return PublishAssertions{Id: act.Id, Success: false, Message: "No assertion type provided for assertions"}
+	}
+
+	// Call the snapd API
+	result, err := snapd.GetEncodedAssertions(data.Type, data.Headers)
+	if err != nil {
+		return PublishAssertions{Id: act.Id, Success: false, Message: err.Error()}
+	}
+
+	return PublishAssertions{Id: act.Id, Success: true, Result: string(result)}
+}
+
 // SnapServerVersion gets details of the device
 func (act *SubscribeAction) SnapServerVersion(deviceId string) messages.PublishDeviceVersion {
 	// Call the snapd API
@@ -425,71 +480,20 @@ func (act *SubscribeAction) Unregister(orgId, deviceId string) messages.PublishD
 	return messages.PublishDevice{Id: act.Id, Success: true, Result: &result}
 }
 
-// RetrieveLogs pulls syslog logs from the snapd api and uploads them to an accessible S3 url
-func (act *SubscribeAction) RetrieveLogs(snapd snapdapi.SnapdClient) messages.PublishResponse {
+// SnapSnapshot creates a snapshot of a snap and uploads it to an S3 url or over MQTT
+func (act *SubscribeAction) SnapSnapshot(snapd snapdapi.SnapdClient, upload *uploader) messages.PublishResponse {
 
-	var data messages.DeviceLogs
+	var data SnapSnapshot
 	if err := json.Unmarshal([]byte(act.Data), &data); err != nil {
 		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
 	}
 
-	options := client.LogOptions{
-		N:      data.Limit,
-		Follow: false,
-	}
-
-	// call snapd api
-	ch, err := snapd.Logs(options)
-	if err != nil {
-		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
-	}
-
-	//accumulate and format log strings to upload to S3 url
-	var sb strings.Builder
-	for msg := range ch {
-		sb.WriteString(fmt.Sprintf(
-			"[%s] %s %s %s\n",
-			msg.Timestamp.String(),
-			msg.PID,
-			msg.SID,
-			msg.Message,
-		))
-	}
-	logs := sb.String()
-
-	req, err := http.NewRequest(http.MethodPut, data.Url, strings.NewReader(logs))
-	req.ContentLength = int64(len(logs))
+	destination, err := uploadDestination(data.Destination, data.Url)
 	if err != nil {
 		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
 	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
-	}
-
-	if resp.StatusCode != 200 {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
-		}
-		resp_err := fmt.Sprintf("PUT response was non-200 code. code = %d, body = %s", resp.StatusCode, string(body))
-		return messages.PublishResponse{Id: act.Id, Success: false, Message: resp_err}
-	}
-
-	return messages.PublishResponse{
-		Id:      act.Id,
-		Action:  act.Action,
-		Success: true,
-	}
-}
-
-// SnapSnapshot creates a snapshot of a snap and uploads it to an S3 url
-func (act *SubscribeAction) SnapSnapshot(snapd snapdapi.SnapdClient) messages.PublishResponse {
-
-	var data messages.SnapSnapshot
-	if err := json.Unmarshal([]byte(act.Data), &data); err != nil {
-		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
+	if destination == DestinationURL && upload.overBudget() {
+		return messages.PublishResponse{Id: act.Id, Success: false, Message: errBudgetExceeded.Error()}
 	}
 
 	snaps := []string{act.Snap}
@@ -514,30 +518,49 @@ func (act *SubscribeAction) SnapSnapshot(snapd snapdapi.SnapdClient) messages.Pu
 		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
 	}
 
-	// upload to url
-	req, err := http.NewRequest(http.MethodPut, data.Url, body)
-	req.ContentLength = length
+	if destination == DestinationMQTT {
+		// The snapshot is spooled to disk, so chunks can be sent again
+		f, size, err := spool(body)
+		if err != nil {
+			return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
+		}
+		go upload.transfer(act, fmt.Sprintf("snapshot-%s-%d.zip", act.Snap, setID), f, size, func() { removeSpool(f) })
+		return messages.PublishResponse{Id: act.Id, Action: act.Action, Success: true, Message: fmt.Sprintf("Transferring %d bytes of snapshot", size)}
+	}
+
+	err = upload.put(data.Url, body, length)
 	if err != nil {
 		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
 	}
 
+	return messages.PublishResponse{
+		Id:      act.Id,
+		Action:  act.Action,
+		Success: true,
+	}
+}
+
+// uploadContent PUTs the content to a presigned S3 url
+func uploadContent(url string, body io.Reader, length int64) error {
+	req, err := http.NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
+		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return messages.PublishResponse{Id: act.Id, Success: false, Message: err.Error()}
+			return err
 		}
-		resp_err := fmt.Sprintf("PUT response was non-200 code. code = %d, body = %s", resp.StatusCode, string(body))
-		return messages.PublishResponse{Id: act.Id, Success: false, Message: resp_err}
+		return fmt.Errorf("PUT response was non-200 code. code = %d, body = %s", resp.StatusCode, string(body))
 	}
 
-	return messages.PublishResponse{
-		Id:      act.Id,
-		Action:  act.Action,
-		Success: true,
-	}
+	return nil
 }
@@ -4,11 +4,14 @@ import (
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/everactive/iot-agent/mqtt"
 )
 
 // MockClient mocks the MQTT client
 type MockClient struct {
-	open bool
+	open      bool
+	lastTopic string
 }
 
 // IsConnected mocks the connect status
@@ -34,9 +37,22 @@ func (cli *MockClient) Disconnect(quiesce uint) {
 
 // Publish mocks a publish message
 func (cli *MockClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	cli.lastTopic = topic
 	return &MockToken{}
 }
 
+// MockClientV5 mocks an MQTT 5 client
+type MockClientV5 struct {
+	MockClient
+	lastProperties *mqtt.MessageProperties
+}
+
+// PublishWithProperties mocks a publish message with MQTT 5 properties
+func (cli *MockClientV5) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *mqtt.MessageProperties) MQTT.Token {
+	cli.lastProperties = props
+	return cli.Publish(topic, qos, retained, payload)
+}
+
 // Subscribe mocks a subscribe message
 func (cli *MockClient) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
 	return &MockToken{}
@@ -74,6 +90,13 @@ func (t *MockToken) WaitTimeout(time.Duration) bool {
 	return true
 }
 
+// Done mocks the token completion
+func (t *MockToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
 // Error mocks a token error check
 func (t *MockToken) Error() error {
 	return nil
@@ -118,3 +141,14 @@ func (m *MockMessage) Payload() []byte {
 func (m *MockMessage) Ack() {
 	panic("implement me")
 }
+
+// MockMessageV5 implements an MQTT 5 message
+type MockMessageV5 struct {
+	MockMessage
+	properties *mqtt.MessageProperties
+}
+
+// Properties mocks the MQTT 5 properties
+func (m *MockMessageV5) Properties() *mqtt.MessageProperties {
+	return m.properties
+}
@@ -0,0 +1,187 @@
+package legacy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/everactive/iot-devicetwin/pkg/messages"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/mqtt"
+	"github.com/everactive/iot-agent/pkg/config"
+)
+
+// Upload destinations of the logs and snapshots
+const (
+	// DestinationURL uploads to a presigned S3 url
+	DestinationURL = "url"
+	// DestinationMQTT sends the payload over MQTT in chunks, for deployments without S3
+	DestinationMQTT = "mqtt"
+)
+
+// errBudgetExceeded is the error for an upload to a url while the data budget is exceeded. A
+// presigned url expires long before the budget resets, so the upload has to be requested again
+var errBudgetExceeded = fmt.Errorf("data budget exceeded, retry the upload later")
+
+// errTooManyDeferred is the error for a transfer over MQTT when too many transfers wait for the data budget
+var errTooManyDeferred = fmt.Errorf("data budget exceeded and too many transfers are waiting, retry the transfer later")
+
+// transferrer sends a payload over MQTT in chunks, returning when the receiver has verified it
+type transferrer interface {
+	Send(id, name string, r io.ReaderAt, size int64) error
+}
+
+// uploader sends the payload of an action to its destination. Chunked transfers are
+// driven by acknowledgements, which arrive on the MQTT client's message handler, so
+// they run in the background and publish the action response when done. Transfers
+// wait while the data budget of the meter is exceeded, until the context is cancelled
+// when the handler closes, and uploads to a url are refused
+type uploader struct {
+	transfers transferrer
+	respond   func(act *SubscribeAction, payload []byte)
+	meter     *mqtt.Meter
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu       sync.Mutex
+	deferred int
+}
+
+// uploadDestination returns the requested destination, which defaults to the url when there is one
+func uploadDestination(destination, url string) (string, error) {
+	switch destination {
+	case "":
+		if len(url) > 0 {
+			return DestinationURL, nil
+		}
+		return DestinationMQTT, nil
+	case DestinationURL:
+		if len(url) == 0 {
+			return "", fmt.Errorf("no url provided for the upload")
+		}
+		return destination, nil
+	case DestinationMQTT:
+		return destination, nil
+	default:
+		return "", fmt.Errorf("invalid upload destination: %s", destination)
+	}
+}
+
+// transfer sends the payload over MQTT and then publishes the action response. Cleanup,
+// if set, runs when the transfer ends
+func (u *uploader) transfer(act *SubscribeAction, name string, r io.ReaderAt, size int64, cleanup func()) {
+	if cleanup != nil {
+		defer cleanup()
+	}
+
+	if err := u.waitForBudget(name); err != nil {
+		u.publishResult(act, "", err)
+		return
+	}
+	err := u.transfers.Send(act.Id, name, r, size)
+	if err != nil {
+		log.Printf("Error transferring %s: %v", name, err)
+	}
+	u.publishResult(act, fmt.Sprintf("Transferred %s", name), err)
+}
+
+// overBudget returns whether the data budget is exceeded, so uploads to a url are refused
+func (u *uploader) overBudget() bool {
+	return u != nil && u.meter.Exceeded()
+}
+
+// waitForBudget blocks while the data budget is exceeded. The number of waiting transfers
+// is limited, as each can hold a spooled payload on disk
+func (u *uploader) waitForBudget(name string) error {
+	if !u.overBudget() {
+		return nil
+	}
+
+	maxDeferred := viper.GetInt(config.UsageDeferredMaxKey)
+	if maxDeferred <= 0 {
+		maxDeferred = config.DefaultConfig[config.UsageDeferredMaxKey].(int)
+	}
+
+	u.mu.Lock()
+	if u.deferred >= maxDeferred {
+		u.mu.Unlock()
+		log.Printf("Data budget exceeded, refusing the transfer of %s as %d transfers are waiting", name, maxDeferred)
+		return errTooManyDeferred
+	}
+	u.deferred++
+	u.mu.Unlock()
+
+	defer func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.deferred--
+	}()
+
+	log.Printf("Data budget exceeded, deferring the transfer of %s", name)
+	if err := u.meter.WaitForBudget(u.ctx); err != nil {
+		log.Printf("Cancelled the deferred transfer of %s: %v", name, err)
+		return fmt.Errorf("the transfer of %s was cancelled: %v", name, err)
+	}
+	return nil
+}
+
+// close cancels the transfers that wait for the data budget, so their spooled payloads are removed
+func (u *uploader) close() {
+	if u != nil && u.cancel != nil {
+		u.cancel()
+	}
+}
+
+// put uploads the content to a presigned S3 url, counting the data usage
+func (u *uploader) put(url string, r io.Reader, length int64) error {
+	if err := uploadContent(url, r, length); err != nil {
+		return err
+	}
+	if u != nil {
+		u.meter.Count(mqtt.TrafficUploads, mqtt.Outbound, length)
+	}
+	return nil
+}
+
+// publishResult publishes the response of an action that completed in the background
+func (u *uploader) publishResult(act *SubscribeAction, message string, err error) {
+	response := messages.PublishResponse{Id: act.Id, Action: act.Action, Success: true, Message: message}
+	if err != nil {
+		response.Success = false
+		response.Message = err.Error()
+	}
+
+	data, err := serializeResponse(response)
+	if err != nil {
+		log.Printf("Error serializing the upload response: %v", err)
+		return
+	}
+	u.respond(act, data)
+}
+
+// spool copies a stream to a temporary file, so chunks can be sent again when they are not acknowledged
+func spool(body io.ReadCloser) (*os.File, int64, error) {
+	defer body.Close()
+
+	f, err := ioutil.TempFile("", "transfer")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := io.Copy(f, body)
+	if err != nil {
+		removeSpool(f)
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+func removeSpool(f *os.File) {
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
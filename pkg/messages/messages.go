@@ -26,11 +26,13 @@ type AppsResponse struct {
 
 // AssertionsRequest
 type AssertionsRequest struct {
+  Headers map[string]string `json:"headers,omitempty"`
   Type string `json:"type,omitempty"`
 }
 
 // AssertionsResponse
 type AssertionsResponse struct {
+  Error string `json:"error,omitempty"`
   Stream string `json:"stream,omitempty"`
 }
 
@@ -40,11 +42,61 @@ type AsyncResponse struct {
   Error string `json:"error,omitempty"`
 }
 
+// Component
+type Component struct {
+  InstallDate time.Time `json:"installDate,omitempty"`
+  InstalledSize int64 `json:"installedSize,omitempty"`
+  Name string `json:"name,omitempty"`
+  Revision string `json:"revision,omitempty"`
+  Summary string `json:"summary,omitempty"`
+  Type string `json:"type,omitempty"`
+  Version string `json:"version,omitempty"`
+}
+
+// DeviceData
+type DeviceData struct {
+  Brand string `json:"brand,omitempty"`
+  Data string `json:"data,omitempty"`
+  DeviceId string `json:"deviceId,omitempty"`
+  ErrorInfo *ErrorInfo `json:"errorInfo,omitempty"`
+  Model string `json:"model,omitempty"`
+  OrgId string `json:"orgId,omitempty"`
+  OrgName string `json:"orgName,omitempty"`
+  Serial string `json:"serial,omitempty"`
+  Updated time.Time `json:"updated,omitempty"`
+}
+
+// DeviceDataRequest
+type DeviceDataRequest struct {
+}
+
+// EnrollmentState
+type EnrollmentState struct {
+  Attempts int `json:"attempts,omitempty"`
+  ErrorInfo *ErrorInfo `json:"errorInfo,omitempty"`
+  NextAttempt time.Time `json:"nextAttempt,omitempty"`
+  Permanent bool `json:"permanent,omitempty"`
+  State string `json:"state"`
+  Timestamp time.Time `json:"timestamp,omitempty"`
+}
+
+// EnrollmentStatusRequest
+type EnrollmentStatusRequest struct {
+}
+
 // ErrorInfo
 type ErrorInfo struct {
   Message string `json:"message,omitempty"`
 }
 
+// MqttConnectionState
+type MqttConnectionState struct {
+  Broker string `json:"broker,omitempty"`
+  ErrorInfo *ErrorInfo `json:"errorInfo,omitempty"`
+  State string `json:"state"`
+  Timestamp time.Time `json:"timestamp,omitempty"`
+}
+
 // MqttConnectionStatus
 type MqttConnectionStatus struct {
   Connected bool `json:"connected"`
@@ -59,6 +111,7 @@ type MqttConnectionStatusRequest struct {
 type Snap struct {
   Apps []*AppInfo `json:"apps,omitempty"`
   Channel string `json:"channel,omitempty"`
+  Components []*Component `json:"components,omitempty"`
   Id string `json:"id,omitempty"`
   InstallDate time.Time `json:"installDate,omitempty"`
   InstalledSize int64 `json:"installedSize,omitempty"`
@@ -17,14 +17,21 @@ const (
 	AppsPostSubjectv1      = "v1.snapd.v2.apps.post"
 
 	IotAgentMqttBrokerConnected = "iot.agent.mqtt.connection.status"
+	IotAgentMqttConnectionState = "iot.agent.mqtt.connection.state"
+	IotAgentEnrollmentStatus    = "iot.agent.enrollment.status"
+	IotAgentEnrollmentState     = "iot.agent.enrollment.state"
+	IotAgentDeviceData          = "iot.agent.device.data"
+	IotAgentDeviceDataUpdated   = "iot.agent.device.data.updated"
 )
 
 type emptyMessage struct{}
 
-// AssertionsRequest is the request for an assertions stream based on the type specified.
+// AssertionsRequest is the request for an assertions stream based on the type specified, optionally
+// filtered by assertion headers.
 // Reference: https://snapcraft.io/docs/snapd-api#heading--assertions for types
 type AssertionsRequest struct {
-	Type string `json:"type"`
+	Type    string            `json:"type"`
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 // AssertionsResponse is a response containing the assertions based on the type requested as
@@ -32,7 +39,8 @@ type AssertionsRequest struct {
 // multiple assertions. The are separated by double new lines.
 // Reference: https://snapcraft.io/docs/snapd-api#heading--assertions
 type AssertionsResponse struct {
-	Stream string `json:"stream"`
+	Stream string  `json:"stream"`
+	Error  *string `json:"error,omitempty"`
 }
 
 // SnapsResponse is the response for getting a list of snaps. A request is made with the empty message.
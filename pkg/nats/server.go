@@ -1,8 +1,8 @@
 package nats
 
 import (
+	"encoding/base64"
 	"errors"
-	"fmt"
 	"os"
 	"os/signal"
 	"strings"
@@ -13,6 +13,8 @@ import (
 
 	natsgo "github.com/nats-io/nats.go"
 
+	"github.com/everactive/iot-agent/identity"
+	"github.com/everactive/iot-agent/mqtt"
 	"github.com/everactive/iot-agent/pkg/legacy"
 
 	"github.com/sirupsen/logrus"
@@ -45,13 +47,21 @@ type natsConnInterface interface {
 	Subscribe(subject string, cb natsgo.Handler) (*natsgo.Subscription, error)
 }
 
+// ConnectionStates passes the state changes of the MQTT connections to handlers
+type ConnectionStates interface {
+	AddStateHandler(handler mqtt.StateHandler) (remove func())
+}
+
 type Server struct {
 	encodedConn     natsConnInterface
 	LegacyInterface *legacy.HandlerIFace
+	connections     ConnectionStates
+	removeHandlers  []func()
 }
 
-func NewServer() *Server {
-	return &Server{}
+// NewServer creates the NATS server, which publishes the state changes of the connections
+func NewServer(connections ConnectionStates) *Server {
+	return &Server{connections: connections}
 }
 
 func (s *Server) SetLegacy(face *legacy.HandlerIFace) {
@@ -74,14 +84,34 @@ func (s *Server) Start() error {
 	s.encodedConn = c
 
 	s.setupSubscriptions()
+	s.addHandlers()
 
 	return nil
 }
 
 func (s *Server) Stop() error {
+	s.removeAllHandlers()
 	return nil
 }
 
+// addHandlers publishes the state changes, replacing the handlers from an earlier start
+func (s *Server) addHandlers() {
+	s.removeAllHandlers()
+	if s.connections != nil {
+		s.removeHandlers = append(s.removeHandlers, s.connections.AddStateHandler(s.publishConnectionState))
+	}
+	s.removeHandlers = append(s.removeHandlers,
+		identity.AddStateHandler(s.publishEnrollmentState),
+		identity.AddDeviceDataHandler(s.publishDeviceData))
+}
+
+func (s *Server) removeAllHandlers() {
+	for _, remove := range s.removeHandlers {
+		remove()
+	}
+	s.removeHandlers = nil
+}
+
 func (s *Server) getInitialNATSConnection(natsURL, clientName string) *natsgo.Conn {
 	quitSignals := createQuitSignalChannel()
 
@@ -127,16 +157,17 @@ func (s *Server) getInitialNATSConnection(natsURL, clientName string) *natsgo.Co
 }
 
 func (s *Server) handleAssertionsGet(_ string, reply string, message AssertionsRequest) {
-	fmt.Printf("%+v\n", message)
+	response := &AssertionsResponse{}
 
-	assertions, err := snapd.GetEncodedAssertions(message.Type)
+	assertions, err := snapd.GetEncodedAssertions(message.Type, message.Headers)
 	if err != nil {
 		logrus.Error(err)
-		return
+		errorMessage := err.Error()
+		response.Error = &errorMessage
+	} else {
+		response.Stream = string(assertions)
 	}
 
-	response := &AssertionsResponse{Stream: string(assertions)}
-
 	err = s.encodedConn.Publish(reply, response)
 	if err != nil {
 		logrus.Error(err)
@@ -144,16 +175,16 @@ func (s *Server) handleAssertionsGet(_ string, reply string, message AssertionsR
 }
 
 func (s *Server) handleAssertionsGetv1(_ string, reply string, message messages.AssertionsRequest) {
-	fmt.Printf("%+v\n", message)
+	response := &messages.AssertionsResponse{}
 
-	assertions, err := snapd.GetEncodedAssertions(message.Type)
+	assertions, err := snapd.GetEncodedAssertions(message.Type, message.Headers)
 	if err != nil {
 		logrus.Error(err)
-		return
+		response.Error = err.Error()
+	} else {
+		response.Stream = string(assertions)
 	}
 
-	response := &messages.AssertionsResponse{Stream: string(assertions)}
-
 	err = s.encodedConn.Publish(reply, response)
 	if err != nil {
 		logrus.Error(err)
@@ -167,9 +198,15 @@ func (s *Server) handleSnapsGet(_ string, reply string, _ emptyMessage) {
 		return
 	}
 
+	// Components are optional, so a failure to get them is not fatal
+	components, err := snapd.ListComponents([]string{})
+	if err != nil {
+		logrus.Error(err)
+	}
+
 	response := &messages.SnapsResponse{}
 	for _, sn := range snaps {
-		snap := makeSnapsResponseSnap(sn)
+		snap := makeSnapsResponseSnap(sn, components[sn.Name])
 		response.Snaps = append(response.Snaps, &snap)
 	}
 
@@ -186,9 +223,15 @@ func (s *Server) handleSnapsGetv1(_ string, reply string, _ emptyMessage) {
 		return
 	}
 
+	// Components are optional, so a failure to get them is not fatal
+	components, err := snapd.ListComponents([]string{})
+	if err != nil {
+		logrus.Error(err)
+	}
+
 	response := &messages.SnapsResponse{}
 	for _, sn := range snaps {
-		snap := makeSnapsResponseSnap(sn)
+		snap := makeSnapsResponseSnap(sn, components[sn.Name])
 		response.Snaps = append(response.Snaps, &snap)
 	}
 
@@ -302,6 +345,91 @@ func (s *Server) handleMqttConnectionStatus(_ string, reply string, message *mes
 	}
 }
 
+// publishConnectionState publishes a change of the state of the MQTT connection to local snaps
+func (s *Server) publishConnectionState(event mqtt.StateEvent) {
+	message := &messages.MqttConnectionState{
+		Broker:    event.Broker,
+		State:     string(event.State),
+		Timestamp: event.Timestamp,
+	}
+	if event.Error != nil {
+		message.ErrorInfo = &messages.ErrorInfo{Message: event.Error.Error()}
+	}
+
+	err := s.encodedConn.Publish(IotAgentMqttConnectionState, message)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// handleEnrollmentStatus responds with the current enrollment state
+func (s *Server) handleEnrollmentStatus(_ string, reply string, _ *messages.EnrollmentStatusRequest) {
+	err := s.encodedConn.Publish(reply, enrollmentState(identity.CurrentState()))
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// publishEnrollmentState publishes a change of the enrollment state to local snaps
+func (s *Server) publishEnrollmentState(event identity.StateEvent) {
+	err := s.encodedConn.Publish(IotAgentEnrollmentState, enrollmentState(event))
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func enrollmentState(event identity.StateEvent) *messages.EnrollmentState {
+	message := &messages.EnrollmentState{
+		Attempts:  event.Attempts,
+		Permanent: event.Permanent,
+		State:     string(event.State),
+		Timestamp: event.Timestamp,
+	}
+	if event.Error != nil {
+		message.ErrorInfo = &messages.ErrorInfo{Message: event.Error.Error()}
+	}
+	if !event.NextAttempt.IsZero() {
+		message.NextAttempt = event.NextAttempt.UTC()
+	}
+	return message
+}
+
+// handleDeviceData responds with the device data and enrollment metadata
+func (s *Server) handleDeviceData(_ string, reply string, _ *messages.DeviceDataRequest) {
+	response := &messages.DeviceData{}
+	if data := identity.CurrentDeviceData(); data != nil {
+		response = deviceData(*data)
+	} else {
+		response.ErrorInfo = &messages.ErrorInfo{Message: "the device is not enrolled"}
+	}
+
+	err := s.encodedConn.Publish(reply, response)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// publishDeviceData publishes a change of the device data to local snaps
+func (s *Server) publishDeviceData(data identity.DeviceData) {
+	err := s.encodedConn.Publish(IotAgentDeviceDataUpdated, deviceData(data))
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func deviceData(data identity.DeviceData) *messages.DeviceData {
+	return &messages.DeviceData{
+		Brand:    data.Brand,
+		Data:     base64.StdEncoding.EncodeToString(data.Data),
+		DeviceId: data.DeviceID,
+		Model:    data.Model,
+		OrgId:    data.OrganizationID,
+		OrgName:  data.OrganizationName,
+		Serial:   data.Serial,
+		Updated:  data.Updated,
+	}
+}
+
 func (s *Server) handleSnapsSnapPostv1(subject string, reply string, message *messages.SnapsSnapRequest) {
 	response := messages.AsyncResponse{
 		ChangeId: "-1",
@@ -356,6 +484,8 @@ func (s *Server) setupSubscriptions() {
 		AppsPostSubjectv1:           s.handleAppsPostv1,
 		SnapsSnapPostSubjectv1:      s.handleSnapsSnapPostv1,
 		IotAgentMqttBrokerConnected: s.handleMqttConnectionStatus,
+		IotAgentEnrollmentStatus:    s.handleEnrollmentStatus,
+		IotAgentDeviceData:          s.handleDeviceData,
 	}
 
 	for subject, handlerFn := range subscriptions {
@@ -382,11 +512,31 @@ func makeSnapsResponseApps(snap *client.Snap) []*messages.AppInfo {
 	return apps
 }
 
-func makeSnapsResponseSnap(snap *client.Snap) messages.Snap {
+func makeSnapsResponseComponents(components []*snapdapi.Component) []*messages.Component {
+	var result []*messages.Component
+	for _, c := range components {
+		component := &messages.Component{
+			InstalledSize: c.InstalledSize,
+			Name:          c.Name,
+			Revision:      c.Revision.String(),
+			Summary:       c.Summary,
+			Type:          c.Type,
+			Version:       c.Version,
+		}
+		if c.InstallDate != nil {
+			component.InstallDate = *c.InstallDate
+		}
+		result = append(result, component)
+	}
+	return result
+}
+
+func makeSnapsResponseSnap(snap *client.Snap, components []*snapdapi.Component) messages.Snap {
 	apps := makeSnapsResponseApps(snap)
 	s := messages.Snap{
 		Apps:            apps,
 		Channel:         snap.Channel,
+		Components:      makeSnapsResponseComponents(components),
 		Id:              snap.ID,
 		InstallDate:     snap.InstallDate,
 		InstalledSize:   snap.InstalledSize,
@@ -1,17 +1,24 @@
 package nats
 
 import (
+	"errors"
+	"os"
 	"reflect"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/everactive/iot-agent/pkg/messages"
+	"github.com/everactive/iot-identity/domain"
 
+	"github.com/everactive/iot-agent/identity"
 	"github.com/everactive/iot-agent/mocks"
+	"github.com/everactive/iot-agent/mqtt"
 
 	"github.com/stretchr/testify/mock"
 
 	"github.com/everactive/iot-agent/pkg/legacy"
+	"github.com/everactive/iot-agent/snapdapi"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -72,3 +79,165 @@ func TestServer_handleMqttConnectionStatus(t *testing.T) {
 	assert.True(t, responseSuccess)
 	leg.AssertCalled(t, "IsConnected")
 }
+
+type fakeConnectionStates struct {
+	handlers int
+}
+
+func (f *fakeConnectionStates) AddStateHandler(handler mqtt.StateHandler) func() {
+	f.handlers++
+	return func() { f.handlers-- }
+}
+
+func TestServer_addHandlers(t *testing.T) {
+	connections := &fakeConnectionStates{}
+	natsServer := NewServer(connections)
+
+	// Starting again replaces the handlers instead of adding them twice
+	natsServer.addHandlers()
+	natsServer.addHandlers()
+	assert.Equal(t, 1, connections.handlers)
+	assert.Len(t, natsServer.removeHandlers, 3)
+
+	assert.NoError(t, natsServer.Stop())
+	assert.Equal(t, 0, connections.handlers)
+	assert.Empty(t, natsServer.removeHandlers)
+}
+
+func TestServer_publishConnectionState(t *testing.T) {
+	conn := mockNatsConnInterface{}
+	natsServer := Server{}
+	natsServer.encodedConn = &conn
+
+	var published *messages.MqttConnectionState
+	conn.On("Publish", IotAgentMqttConnectionState, mock.AnythingOfType("*messages.MqttConnectionState")).Run(func(args mock.Arguments) {
+		published = args[1].(*messages.MqttConnectionState)
+	}).Return(nil)
+
+	natsServer.publishConnectionState(mqtt.StateEvent{Broker: "mqtt.example.com:8883", Error: errors.New("MOCK connection reset"), State: mqtt.StateConnectionLost})
+
+	assert.NotNil(t, published)
+	assert.Equal(t, "connection-lost", published.State)
+	assert.Equal(t, "mqtt.example.com:8883", published.Broker)
+	assert.Equal(t, "MOCK connection reset", published.ErrorInfo.Message)
+}
+
+func TestServer_publishEnrollmentState(t *testing.T) {
+	conn := mockNatsConnInterface{}
+	natsServer := Server{}
+	natsServer.encodedConn = &conn
+
+	var published *messages.EnrollmentState
+	conn.On("Publish", IotAgentEnrollmentState, mock.AnythingOfType("*messages.EnrollmentState")).Run(func(args mock.Arguments) {
+		published = args[1].(*messages.EnrollmentState)
+	}).Return(nil)
+
+	next := time.Date(2021, 6, 30, 12, 0, 0, 0, time.UTC)
+	natsServer.publishEnrollmentState(identity.StateEvent{State: identity.StateFailed, Attempts: 3, Error: errors.New("MOCK not registered"), Permanent: true, NextAttempt: next})
+
+	assert.NotNil(t, published)
+	assert.Equal(t, "failed", published.State)
+	assert.Equal(t, 3, published.Attempts)
+	assert.True(t, published.Permanent)
+	assert.Equal(t, next, published.NextAttempt)
+	assert.Equal(t, "MOCK not registered", published.ErrorInfo.Message)
+}
+
+func TestServer_handleEnrollmentStatus(t *testing.T) {
+	conn := mockNatsConnInterface{}
+	natsServer := Server{}
+	natsServer.encodedConn = &conn
+
+	var published *messages.EnrollmentState
+	conn.On("Publish", "reply", mock.AnythingOfType("*messages.EnrollmentState")).Run(func(args mock.Arguments) {
+		published = args[1].(*messages.EnrollmentState)
+	}).Return(nil)
+
+	natsServer.handleEnrollmentStatus(IotAgentEnrollmentStatus, "reply", &messages.EnrollmentStatusRequest{})
+
+	assert.NotNil(t, published)
+	assert.Equal(t, string(identity.CurrentState().State), published.State)
+	assert.True(t, published.NextAttempt.IsZero())
+}
+
+func TestServer_handleDeviceData(t *testing.T) {
+	conn := mockNatsConnInterface{}
+	natsServer := Server{}
+	natsServer.encodedConn = &conn
+
+	var published []*messages.DeviceData
+	conn.On("Publish", "reply", mock.AnythingOfType("*messages.DeviceData")).Run(func(args mock.Arguments) {
+		published = append(published, args[1].(*messages.DeviceData))
+	}).Return(nil)
+
+	// Nothing to share before the device is enrolled
+	natsServer.handleDeviceData(IotAgentDeviceData, "reply", &messages.DeviceDataRequest{})
+	assert.NotNil(t, published[0].ErrorInfo)
+
+	defer os.Setenv("OVERRIDE_SNAP_COMMON", os.Getenv("OVERRIDE_SNAP_COMMON"))
+	os.Setenv("OVERRIDE_SNAP_COMMON", t.TempDir())
+	enroll := &domain.Enrollment{ID: "a111", Organization: domain.Organization{ID: "abc"}, DeviceData: "SGVsbG8="}
+	enroll.Credentials.PrivateKey = []byte("MOCK key")
+	assert.Nil(t, identity.PublishDeviceData(enroll))
+
+	natsServer.handleDeviceData(IotAgentDeviceData, "reply", &messages.DeviceDataRequest{})
+	assert.Nil(t, published[1].ErrorInfo)
+	assert.Equal(t, "a111", published[1].DeviceId)
+	assert.Equal(t, "abc", published[1].OrgId)
+	assert.Equal(t, "SGVsbG8=", published[1].Data)
+}
+
+func TestServer_publishDeviceData(t *testing.T) {
+	conn := mockNatsConnInterface{}
+	natsServer := Server{}
+	natsServer.encodedConn = &conn
+
+	var published *messages.DeviceData
+	conn.On("Publish", IotAgentDeviceDataUpdated, mock.AnythingOfType("*messages.DeviceData")).Run(func(args mock.Arguments) {
+		published = args[1].(*messages.DeviceData)
+	}).Return(nil)
+
+	updated := time.Date(2021, 6, 30, 12, 0, 0, 0, time.UTC)
+	natsServer.publishDeviceData(identity.DeviceData{DeviceID: "a111", OrganizationID: "abc", Serial: "A1234", Data: []byte("Hello"), Updated: updated})
+
+	assert.NotNil(t, published)
+	assert.Equal(t, "a111", published.DeviceId)
+	assert.Equal(t, "A1234", published.Serial)
+	assert.Equal(t, "SGVsbG8=", published.Data)
+	assert.Equal(t, updated, published.Updated)
+}
+
+func TestServer_handleAssertionsGetv1(t *testing.T) {
+	tests := []struct {
+		name      string
+		request   messages.AssertionsRequest
+		snapdErr  bool
+		wantError bool
+	}{
+		{"valid", messages.AssertionsRequest{Type: "serial", Headers: map[string]string{"brand-id": "canonical"}}, false, false},
+		{"unknown-type", messages.AssertionsRequest{Type: "invalid"}, false, true},
+		{"snapd-error", messages.AssertionsRequest{Type: "model"}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapd = &snapdapi.MockClient{WithError: tt.snapdErr}
+
+			conn := mockNatsConnInterface{}
+			natsServer := Server{}
+			natsServer.encodedConn = &conn
+
+			var response *messages.AssertionsResponse
+			conn.On("Publish", "reply", mock.AnythingOfType("*messages.AssertionsResponse")).Run(func(args mock.Arguments) {
+				response = args[1].(*messages.AssertionsResponse)
+			}).Return(nil)
+
+			natsServer.handleAssertionsGetv1("", "reply", tt.request)
+
+			// A reply must always be sent, even on failure
+			assert.NotNil(t, response)
+			assert.Equal(t, tt.wantError, len(response.Error) > 0)
+			assert.Equal(t, tt.wantError, len(response.Stream) == 0)
+		})
+	}
+}
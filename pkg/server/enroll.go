@@ -0,0 +1,116 @@
+package server
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/identity"
+	agentconfig "github.com/everactive/iot-agent/pkg/config"
+)
+
+// enrollWithBackoff enrolls the device, retrying with exponential backoff from the enroll
+// tick interval up to the configured maximum delay. After a permanent error, e.g. a device
+// that is not registered, it waits the maximum delay, as it needs a change on the identity service.
+// It returns at once when the device is already enrolling
+func (s *Server) enrollWithBackoff() {
+	s.enrollLock.Lock()
+	if s.enrolling {
+		s.enrollLock.Unlock()
+		return
+	}
+	s.enrolling = true
+	s.enrollLock.Unlock()
+	defer func() {
+		s.enrollLock.Lock()
+		s.enrolling = false
+		s.enrollLock.Unlock()
+	}()
+
+	minDelay := time.Duration(enrollTickInterval) * time.Second
+	maxDelay := viper.GetDuration(agentconfig.EnrollmentRetryMaxDelayKey)
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+
+	s.wait(minDelay)
+
+	delay := minDelay
+	for attempts := 1; ; attempts++ {
+		identity.SetState(identity.StateEvent{State: identity.StateEnrolling, Attempts: attempts})
+		s.importProvisioning()
+		err := s.Enroll()
+		if err == nil {
+			identity.SetState(identity.StateEvent{State: identity.StateEnrolled, Attempts: attempts})
+			return
+		}
+
+		permanent := identity.IsPermanent(err)
+		wait := jitter(delay)
+		if permanent {
+			wait = maxDelay
+		}
+		identity.SetState(identity.StateEvent{
+			State:       identity.StateFailed,
+			Attempts:    attempts,
+			Error:       err,
+			Permanent:   permanent,
+			NextAttempt: s.now().Add(wait),
+		})
+		s.wait(wait)
+
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// configureEnrollment sets up the configured enrollment method. Enrolling with the assertions
+// is the default
+func configureEnrollment(idSrv *identity.Service) {
+	switch method := viper.GetString(agentconfig.EnrollmentMethodKey); method {
+	case identity.EnrollmentMethodBootstrapToken:
+		log.Println("Enrolling with a bootstrap token")
+		idSrv.Provider = identity.NewBootstrapTokenProvider(viper.GetString(agentconfig.EnrollmentBootstrapTokenKey), viper.GetString(agentconfig.EnrollmentBootstrapFileKey))
+	case identity.EnrollmentMethodAssertion, "":
+	default:
+		log.Printf("Unknown enrollment method `%s`, enrolling with the assertions", method)
+	}
+}
+
+// configureIdentityClient sets up the client for the identity service. While the client cannot be set
+// up, e.g. because the CA file is missing, enrolling fails with a permanent error
+func configureIdentityClient() {
+	err := identity.ConfigureHTTPClient(identity.HTTPClientConfig{
+		Timeout:  viper.GetDuration(agentconfig.IdentityTimeoutKey),
+		CAFile:   viper.GetString(agentconfig.IdentityTLSCAKey),
+		CertFile: viper.GetString(agentconfig.IdentityTLSCertKey),
+		KeyFile:  viper.GetString(agentconfig.IdentityTLSKeyKey),
+		Proxy:    viper.GetString(agentconfig.IdentityProxyKey),
+		Retries:  viper.GetInt(agentconfig.IdentityRetriesKey),
+	})
+	if err != nil {
+		log.Printf("Error setting up the identity service client, enrolling fails until it is fixed: %v", err)
+	}
+}
+
+func (s *Server) wait(d time.Duration) {
+	s.serversLock.Lock()
+	c := Clock.After(d)
+	s.serversLock.Unlock()
+	<-c
+}
+
+func (s *Server) now() time.Time {
+	s.serversLock.Lock()
+	defer s.serversLock.Unlock()
+	return Clock.Now()
+}
+
+// jitter spreads the retries of many devices, returning a random delay from half to all of the delay
+func jitter(delay time.Duration) time.Duration {
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/identity"
+	agentconfig "github.com/everactive/iot-agent/pkg/config"
+)
+
+// importedSuffix is added to a provisioning bundle that was applied, when its directory is writable
+const importedSuffix = ".imported"
+
+// importProvisioning applies the first valid provisioning bundle in the configured paths, e.g. on a
+// USB drive, so a device installed without connectivity enrolls later. Bundles are only imported
+// when the provisioning key that signs them is configured. It is called before each enrollment
+// attempt, which is never concurrent, so the applied bundles are not locked
+func (s *Server) importProvisioning() {
+	keyPath := viper.GetString(agentconfig.ProvisioningKeyKey)
+	if len(keyPath) == 0 {
+		return
+	}
+
+	patterns := identity.DefaultProvisioningPaths()
+	if paths := viper.GetString(agentconfig.ProvisioningPathsKey); len(paths) > 0 {
+		patterns = strings.Split(paths, ",")
+	}
+	files := identity.FindProvisioningBundles(patterns)
+	if len(files) == 0 {
+		return
+	}
+
+	key, err := identity.ReadProvisioningKey(keyPath)
+	if err != nil {
+		log.Printf("Error importing the provisioning bundles: %v", err)
+		return
+	}
+
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			log.Printf("Error reading the provisioning bundle `%s`: %v", f, err)
+			continue
+		}
+		digest := sha256.Sum256(data)
+		if s.provisioned[digest] {
+			continue
+		}
+
+		bundle, err := identity.ReadProvisioningBundle(data, key, s.now())
+		if err != nil {
+			log.Printf("Error with the provisioning bundle `%s`: %v", f, err)
+			continue
+		}
+
+		err = s.identity.ApplyProvisioning(bundle)
+		// The bundles are for devices that are not enrolled yet
+		if errors.Is(err, identity.ErrAlreadyEnrolled) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error applying the provisioning bundle `%s`: %v", f, err)
+			continue
+		}
+
+		log.Printf("Applied the provisioning bundle `%s` for the identity service %s", f, bundle.IdentityURL)
+		if s.provisioned == nil {
+			s.provisioned = map[[sha256.Size]byte]bool{}
+		}
+		s.provisioned[digest] = true
+		_ = os.Rename(f, f+importedSuffix)
+		return
+	}
+}
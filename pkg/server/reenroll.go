@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/identity"
+	"github.com/everactive/iot-agent/mqtt"
+	agentconfig "github.com/everactive/iot-agent/pkg/config"
+)
+
+// connectionStateChanged counts the consecutive connection attempts that the broker refused because
+// of the credentials, e.g. after the certificate was revoked, and enrolls again at the threshold
+func (s *Server) connectionStateChanged(event mqtt.StateEvent) {
+	switch event.State {
+	case mqtt.StateConnected:
+		s.enrollLock.Lock()
+		s.authFailures = 0
+		s.enrollLock.Unlock()
+	case mqtt.StateAuthFailed:
+		threshold := viper.GetInt(agentconfig.CredentialsAuthFailuresKey)
+		if threshold <= 0 {
+			threshold = agentconfig.DefaultConfig[agentconfig.CredentialsAuthFailuresKey].(int)
+		}
+
+		s.enrollLock.Lock()
+		s.authFailures++
+		reached := s.authFailures >= threshold
+		if reached {
+			s.authFailures = 0
+		}
+		s.enrollLock.Unlock()
+
+		if reached {
+			go s.Reenroll(event.Error)
+		}
+	}
+}
+
+// Reenroll enrolls the device again, as the broker rejects its credentials, and reconnects with
+// the new credentials. The stored credentials are kept when the enrollment fails, and the
+// connections keep retrying with them, so enrolling is retried when the broker rejects them again
+func (s *Server) Reenroll(reason error) {
+	log.Printf("The MQTT broker keeps rejecting the credentials, so enroll again: %v", reason)
+	identity.SetState(identity.StateEvent{
+		State: identity.StateUnenrolled,
+		Error: fmt.Errorf("the MQTT broker rejected the credentials: %v", reason),
+	})
+
+	if _, err := s.identity.Reenroll(); err != nil {
+		log.Printf("Error enrolling again, keeping the stored credentials: %v", err)
+		identity.SetState(identity.StateEvent{
+			State:     identity.StateFailed,
+			Error:     err,
+			Permanent: identity.IsPermanent(err),
+		})
+		return
+	}
+
+	if err := s.Reconnect(); err != nil {
+		log.Printf("Error reconnecting with the new credentials: %v", err)
+		s.enrollWithBackoff()
+		return
+	}
+	identity.SetState(identity.StateEvent{State: identity.StateEnrolled})
+}
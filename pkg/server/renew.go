@@ -0,0 +1,46 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/everactive/iot-agent/identity"
+	agentconfig "github.com/everactive/iot-agent/pkg/config"
+)
+
+// RenewCredentials renews the credentials when the client certificate expires within the
+// configured time, then reconnects to the MQTT broker with them
+func (s *Server) RenewCredentials() {
+	s.legacyLock.Lock()
+	enroll := s.enrollment
+	s.legacyLock.Unlock()
+	if enroll == nil {
+		return
+	}
+
+	expiry, err := identity.CertificateExpiry(enroll)
+	if err != nil {
+		log.Printf("Cannot check the expiry of the client certificate: %v", err)
+		return
+	}
+	renewBefore := viper.GetDuration(agentconfig.CredentialsRenewBeforeKey)
+	if renewBefore <= 0 {
+		renewBefore = agentconfig.DefaultConfig[agentconfig.CredentialsRenewBeforeKey].(time.Duration)
+	}
+	if s.now().Add(renewBefore).Before(expiry) {
+		return
+	}
+
+	log.Printf("The client certificate expires at %s, so renew the credentials", expiry.Format(time.RFC3339))
+	if _, err := s.identity.RenewCredentials(); err != nil {
+		log.Printf("Error renewing the credentials: %v", err)
+		return
+	}
+
+	if err := s.Reconnect(); err != nil {
+		log.Printf("Error reconnecting with the renewed credentials: %v", err)
+		s.enrollWithBackoff()
+	}
+}
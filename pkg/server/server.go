@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"log"
 	"os"
@@ -12,10 +13,12 @@ import (
 	"github.com/benbjohnson/clock"
 	"github.com/everactive/iot-identity/domain"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
 	"github.com/everactive/iot-agent/config"
 	"github.com/everactive/iot-agent/identity"
 	"github.com/everactive/iot-agent/mqtt"
+	agentconfig "github.com/everactive/iot-agent/pkg/config"
 	"github.com/everactive/iot-agent/pkg/legacy"
 	"github.com/everactive/iot-agent/pkg/nats"
 	"github.com/everactive/iot-agent/snapdapi"
@@ -24,8 +27,8 @@ import (
 var tickInterval = 60
 var enrollTickInterval = 2
 
-var createNATSServer = func() AddOnServer {
-	server := nats.NewServer()
+var createNATSServer = func(connections ConnectionManager) AddOnServer {
+	server := nats.NewServer(connections)
 	return server
 }
 
@@ -35,6 +38,14 @@ type AddOnServer interface {
 	SetLegacy(*legacy.HandlerIFace)
 }
 
+// ConnectionManager creates and closes the MQTT connections for the enrollments
+type ConnectionManager interface {
+	Connect(enrollment *domain.Enrollment) (*mqtt.Connection, error)
+	Close(id string)
+	CloseAll()
+	AddStateHandler(handler mqtt.StateHandler) (remove func())
+}
+
 type Server struct {
 	settings           *config.Settings
 	snapdClientAdapter *snapdapi.ClientAdapter
@@ -45,6 +56,12 @@ type Server struct {
 	isRunning          bool
 	otherServers       []AddOnServer
 	identity           identity.Identity
+	connections        ConnectionManager
+	enrollment         *domain.Enrollment
+	enrollLock         sync.Mutex
+	enrolling          bool
+	authFailures       int
+	provisioned        map[[sha256.Size]byte]bool
 }
 
 var Clock clock.Clock
@@ -57,13 +74,17 @@ func New() *Server {
 	snap := snapdapi.NewClientAdapter()
 
 	// Check that we are enrolled with the identity service
+	configureIdentityClient()
 	idSrv := identity.NewService(settings, snap)
+	configureEnrollment(idSrv)
+	legacy.SetDeviceDataStore(idSrv)
 
 	return &Server{
 		settings:           settings,
 		snapdClientAdapter: snap,
 		otherServers:       []AddOnServer{},
 		identity:           idSrv,
+		connections:        mqtt.NewManager(nil, mqtt.NewDialer(snap)),
 	}
 }
 
@@ -79,25 +100,14 @@ func (s *Server) Run() {
 	s.runningLock.Unlock()
 
 	// Server NATS responses whether we are enrolled or not
-	natsServer := createNATSServer() // nats.NewServer()
-	err := natsServer.Start()
-	if err != nil {
-		logrus.Error(err)
-	}
+	natsServer := createNATSServer(s.connections) // nats.NewServer()
 	s.AddServer(natsServer)
 
-	d := time.Duration(enrollTickInterval) * time.Second
-	s.serversLock.Lock()
-	enrollTicker := Clock.Ticker(d)
-	s.serversLock.Unlock()
+	// The device enrolls again when the broker keeps rejecting its credentials
+	removeStateHandler := s.connections.AddStateHandler(s.connectionStateChanged)
+	defer removeStateHandler()
 
-	for range enrollTicker.C {
-		errEnroll := s.Enroll()
-		if errEnroll == nil {
-			enrollTicker.Stop()
-			break
-		}
-	}
+	s.enrollWithBackoff()
 
 	natsServer.SetLegacy(&s.legacy)
 
@@ -117,10 +127,42 @@ func (s *Server) Run() {
 		serviceTicker.Stop()
 	}()
 
+	// The inventory is much larger than the health check, so it is published less often
+	inventoryInterval := viper.GetDuration(agentconfig.InventoryIntervalKey)
+	if inventoryInterval <= 0 {
+		inventoryInterval = agentconfig.DefaultConfig[agentconfig.InventoryIntervalKey].(time.Duration)
+	}
+	s.serversLock.Lock()
+	inventoryTicker := Clock.Ticker(inventoryInterval)
+	s.serversLock.Unlock()
+	go func() {
+		for range inventoryTicker.C {
+			s.Inventory()
+		}
+		inventoryTicker.Stop()
+	}()
+
+	// The credentials are renewed before the client certificate expires
+	renewInterval := viper.GetDuration(agentconfig.CredentialsRenewIntervalKey)
+	if renewInterval <= 0 {
+		renewInterval = agentconfig.DefaultConfig[agentconfig.CredentialsRenewIntervalKey].(time.Duration)
+	}
+	s.serversLock.Lock()
+	renewTicker := Clock.Ticker(renewInterval)
+	s.serversLock.Unlock()
+	go func() {
+		s.RenewCredentials()
+		for range renewTicker.C {
+			s.RenewCredentials()
+		}
+	}()
+
 	// This will block until SIGINT or SIGTERM
 	sig := <-quitSignals
 
 	serviceTicker.Stop()
+	inventoryTicker.Stop()
+	renewTicker.Stop()
 
 	// SIGINT is expected from systemd and should not result in an error exit
 	if sig == syscall.SIGINT {
@@ -134,9 +176,9 @@ func (s *Server) Run() {
 
 var createLegacySubscriberVar = createLegacySubscriber
 
-func createLegacySubscriber(enrollment *domain.Enrollment) (legacy.HandlerIFace, error) {
+func createLegacySubscriber(connections ConnectionManager, enrollment *domain.Enrollment) (legacy.HandlerIFace, error) {
 	// Create/get the MQTT connection
-	mqttConn, err := mqtt.GetConnection(enrollment)
+	mqttConn, err := connections.Connect(enrollment)
 	if err != nil {
 		log.Printf("Error with MQTT connection: %v", err)
 		return nil, err
@@ -162,10 +204,16 @@ func (s *Server) Enroll() error {
 		return err
 	}
 
-	legacy, err := createLegacySubscriberVar(enroll)
+	// Local snaps can read the device data of the enrollment
+	if err := identity.PublishDeviceData(enroll); err != nil {
+		log.Printf("Error sharing the device data: %v", err)
+	}
+
+	legacy, err := createLegacySubscriberVar(s.connections, enroll)
 	s.legacyLock.Lock()
 	defer s.legacyLock.Unlock()
 	s.legacy = legacy
+	s.enrollment = enroll
 	if err != nil {
 		return err
 	}
@@ -173,6 +221,19 @@ func (s *Server) Enroll() error {
 	return nil
 }
 
+// Reconnect closes the MQTT connections and connects again with the current enrollment,
+// e.g. after the credentials changed
+func (s *Server) Reconnect() error {
+	s.legacyLock.Lock()
+	if s.legacy != nil {
+		s.legacy.Close()
+	}
+	s.connections.CloseAll()
+	s.legacyLock.Unlock()
+
+	return s.Enroll()
+}
+
 func (s *Server) Stop() {
 	s.serversLock.Lock()
 	defer s.serversLock.Unlock()
@@ -186,12 +247,32 @@ func (s *Server) Stop() {
 	if s.legacy != nil {
 		s.legacy.Close()
 	}
+	s.connections.CloseAll()
 }
 
 func (s *Server) Service() {
+	legacy := s.currentLegacy()
+	if legacy == nil {
+		return
+	}
+
 	// Publish the health check and metrics messages
-	s.legacy.Health()
-	s.legacy.Metrics()
+	legacy.Health()
+	legacy.Metrics()
+}
+
+// Inventory publishes the software inventory of the device
+func (s *Server) Inventory() {
+	if legacy := s.currentLegacy(); legacy != nil {
+		legacy.Inventory()
+	}
+}
+
+// currentLegacy returns the handler, which is nil while reconnecting fails
+func (s *Server) currentLegacy() legacy.HandlerIFace {
+	s.legacyLock.Lock()
+	defer s.legacyLock.Unlock()
+	return s.legacy
 }
 
 func (s *Server) AddServer(server AddOnServer) {
@@ -1,7 +1,19 @@
 package server
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
 	"os"
+	"path"
 	"runtime"
 	"sync"
 	"testing"
@@ -12,11 +24,15 @@ import (
 	"github.com/benbjohnson/clock"
 	"github.com/everactive/iot-identity/domain"
 	"github.com/snapcore/snapd/osutil"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/suite"
 
 	"github.com/everactive/iot-agent/mocks"
 
 	"github.com/everactive/iot-agent/config"
+	"github.com/everactive/iot-agent/identity"
+	"github.com/everactive/iot-agent/mqtt"
+	agentconfig "github.com/everactive/iot-agent/pkg/config"
 	"github.com/everactive/iot-agent/pkg/legacy"
 )
 
@@ -24,6 +40,7 @@ type ServerTestSuite struct {
 	suite.Suite
 	serverLock sync.Mutex
 	srv        *Server
+	commonDir  string
 }
 
 var mockedClock *clock.Mock
@@ -33,11 +50,15 @@ func TestServerTestSuite(t *testing.T) {
 }
 
 func (s *ServerTestSuite) SetupTest() {
+	// The device data and the MQTT queues are written to the common data directory
+	s.commonDir = os.Getenv("OVERRIDE_SNAP_COMMON")
+	os.Setenv("OVERRIDE_SNAP_COMMON", s.T().TempDir())
+
 	if osutil.FileExists(config.GetPath("params")) {
 		os.Remove(config.GetPath("params"))
 	}
 
-	createNATSServer = func() AddOnServer {
+	createNATSServer = func(_ ConnectionManager) AddOnServer {
 		m := mocks.AddOnServer{}
 		m.On("Start").Return(nil)
 		m.On("Stop").Return(nil)
@@ -55,6 +76,7 @@ func (s *ServerTestSuite) SetupTest() {
 
 func (s *ServerTestSuite) TearDownTest() {
 	os.Remove("./params")
+	os.Setenv("OVERRIDE_SNAP_COMMON", s.commonDir)
 }
 
 func (s *ServerTestSuite) Test_NewServer() {
@@ -64,8 +86,10 @@ func (s *ServerTestSuite) Test_NewServer() {
 
 func (s *ServerTestSuite) Test_NewServerRun() {
 	s.serverLock.Lock()
+	// The goroutine may start after the next test replaced s.srv
+	srv := s.srv
 	go func() {
-		s.srv.Run()
+		srv.Run()
 	}()
 
 	for s.srv.IsRunning() == false {
@@ -81,7 +105,7 @@ func (s *ServerTestSuite) Test_NewServerRun() {
 
 func (s *ServerTestSuite) Test_NewServerRun_WithEnroll() {
 	m := mocks.AddOnServer{}
-	createNATSServer = func() AddOnServer {
+	createNATSServer = func(_ ConnectionManager) AddOnServer {
 		m.On("Start").Return(nil)
 		m.On("Stop").Return(nil)
 		m.On("SetLegacy", mock.Anything).Return()
@@ -107,12 +131,14 @@ func (s *ServerTestSuite) Test_NewServerRun_WithEnroll() {
 	mockedLegacy.On("Metrics").Return(nil).Once()
 	mockedLegacy.On("Close").Return(nil).Once()
 
-	createLegacySubscriberVar = func(_ *domain.Enrollment) (legacy.HandlerIFace, error) {
+	createLegacySubscriberVar = func(_ ConnectionManager, _ *domain.Enrollment) (legacy.HandlerIFace, error) {
 		return mockedLegacy, nil
 	}
 
+	// The goroutine may start after the next test replaced s.srv
+	srv := s.srv
 	go func() {
-		s.srv.Run()
+		srv.Run()
 	}()
 	runtime.Gosched()
 
@@ -138,8 +164,10 @@ func (s *ServerTestSuite) Test_NewServerRun_WithEnroll() {
 
 func (s *ServerTestSuite) Test_NewServerStop() {
 	s.serverLock.Lock()
+	// The goroutine may start after the next test replaced s.srv
+	srv := s.srv
 	go func() {
-		s.srv.Run()
+		srv.Run()
 	}()
 
 	t := &mocks.AddOnServer{}
@@ -170,3 +198,257 @@ func (s *ServerTestSuite) Test_AddServer_Started() {
 
 	s.Assert().Equal(1, len(s.srv.otherServers))
 }
+
+func (s *ServerTestSuite) Test_Reconnect() {
+	enrollment := &domain.Enrollment{ID: "a111"}
+	mockedIdentity := &mocks.Identity{}
+	mockedIdentity.On("CheckEnrollment").Return(enrollment, nil).Once()
+	s.srv.identity = mockedIdentity
+
+	oldLegacy := &mocks.HandlerIFace{}
+	oldLegacy.On("Close").Return().Once()
+	s.srv.legacy = oldLegacy
+
+	connections := &mocks.ConnectionManager{}
+	connections.On("CloseAll").Return().Once()
+	s.srv.connections = connections
+
+	newLegacy := &mocks.HandlerIFace{}
+	createLegacySubscriberVar = func(c ConnectionManager, e *domain.Enrollment) (legacy.HandlerIFace, error) {
+		s.Assert().Equal(connections, c)
+		s.Assert().Equal(enrollment, e)
+		return newLegacy, nil
+	}
+
+	s.Assert().NoError(s.srv.Reconnect())
+	s.Assert().Equal(newLegacy, s.srv.legacy)
+
+	mockedIdentity.AssertExpectations(s.T())
+	oldLegacy.AssertExpectations(s.T())
+	connections.AssertExpectations(s.T())
+}
+
+func (s *ServerTestSuite) Test_EnrollWithBackoff() {
+	defer viper.Set(agentconfig.EnrollmentRetryMaxDelayKey, agentconfig.DefaultConfig[agentconfig.EnrollmentRetryMaxDelayKey])
+	viper.Set(agentconfig.EnrollmentRetryMaxDelayKey, 8*time.Second)
+
+	var eventsLock sync.Mutex
+	var events []identity.StateEvent
+	removeStateHandler := identity.AddStateHandler(func(event identity.StateEvent) {
+		eventsLock.Lock()
+		defer eventsLock.Unlock()
+		events = append(events, event)
+	})
+
+	mockedIdentity := &mocks.Identity{}
+	mockedIdentity.On("CheckEnrollment").Return(nil, errors.New("MOCK connection refused")).Twice()
+	mockedIdentity.On("CheckEnrollment").Return(nil, &identity.EnrollmentError{Err: errors.New("MOCK not registered"), Permanent: true}).Once()
+	mockedIdentity.On("CheckEnrollment").Return(&domain.Enrollment{ID: "a111"}, nil).Once()
+	s.srv.identity = mockedIdentity
+
+	createLegacySubscriberVar = func(_ ConnectionManager, _ *domain.Enrollment) (legacy.HandlerIFace, error) {
+		return &mocks.HandlerIFace{}, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.srv.enrollWithBackoff()
+		close(done)
+	}()
+
+	// The attempts wait 2s, then 1-2s, 2-4s and 8s after the permanent error
+	for enrolled := false; !enrolled; {
+		select {
+		case <-done:
+			enrolled = true
+		case <-time.After(10 * time.Millisecond):
+			mockedClock.Add(time.Second)
+		}
+	}
+
+	removeStateHandler()
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+
+	var failed []identity.StateEvent
+	for _, e := range events {
+		if e.State == identity.StateFailed {
+			failed = append(failed, e)
+		}
+	}
+	s.Require().Len(failed, 3)
+	s.Assert().False(failed[0].Permanent)
+	s.Assert().False(failed[1].Permanent)
+	s.Assert().True(failed[2].Permanent)
+	s.Assert().Equal(3, failed[2].Attempts)
+	s.Assert().Equal(identity.StateEnrolled, events[len(events)-1].State)
+	s.Assert().Equal(4, events[len(events)-1].Attempts)
+	s.Assert().Equal(identity.StateEnrolled, identity.CurrentState().State)
+	mockedIdentity.AssertExpectations(s.T())
+}
+
+func (s *ServerTestSuite) Test_RenewCredentials() {
+	expiringSoon := &domain.Enrollment{ID: "a111", Credentials: domain.Credentials{Certificate: certificate(s.T(), mockedClock.Now().Add(24*time.Hour))}}
+	renewed := &domain.Enrollment{ID: "a111", Credentials: domain.Credentials{Certificate: certificate(s.T(), mockedClock.Now().Add(365*24*time.Hour))}}
+
+	// A certificate that is valid for longer is not renewed
+	mockedIdentity := &mocks.Identity{}
+	s.srv.identity = mockedIdentity
+	s.srv.enrollment = renewed
+	s.srv.RenewCredentials()
+	mockedIdentity.AssertNotCalled(s.T(), "RenewCredentials")
+
+	// An expiring certificate is renewed, then the agent reconnects with the new credentials
+	s.srv.enrollment = expiringSoon
+	mockedIdentity.On("RenewCredentials").Return(renewed, nil).Once()
+	mockedIdentity.On("CheckEnrollment").Return(renewed, nil).Once()
+
+	oldLegacy := &mocks.HandlerIFace{}
+	oldLegacy.On("Close").Return().Once()
+	s.srv.legacy = oldLegacy
+	connections := &mocks.ConnectionManager{}
+	connections.On("CloseAll").Return().Once()
+	s.srv.connections = connections
+
+	newLegacy := &mocks.HandlerIFace{}
+	createLegacySubscriberVar = func(_ ConnectionManager, e *domain.Enrollment) (legacy.HandlerIFace, error) {
+		s.Assert().Equal(renewed, e)
+		return newLegacy, nil
+	}
+
+	s.srv.RenewCredentials()
+
+	s.Assert().Equal(newLegacy, s.srv.legacy)
+	s.Assert().Equal(renewed, s.srv.enrollment)
+	mockedIdentity.AssertExpectations(s.T())
+	oldLegacy.AssertExpectations(s.T())
+	connections.AssertExpectations(s.T())
+}
+
+func (s *ServerTestSuite) Test_Reenroll() {
+	defer viper.Set(agentconfig.CredentialsAuthFailuresKey, agentconfig.DefaultConfig[agentconfig.CredentialsAuthFailuresKey])
+	viper.Set(agentconfig.CredentialsAuthFailuresKey, 3)
+
+	rejected := &domain.Enrollment{ID: "a111"}
+	enrolled := &domain.Enrollment{ID: "a111", Credentials: domain.Credentials{Certificate: []byte("new")}}
+
+	mockedIdentity := &mocks.Identity{}
+	mockedIdentity.On("Reenroll").Return(enrolled, nil).Once()
+	mockedIdentity.On("CheckEnrollment").Return(enrolled, nil).Once()
+	s.srv.identity = mockedIdentity
+	s.srv.enrollment = rejected
+
+	oldLegacy := &mocks.HandlerIFace{}
+	oldLegacy.On("Close").Return().Once()
+	s.srv.legacy = oldLegacy
+	connections := &mocks.ConnectionManager{}
+	connections.On("CloseAll").Return().Once()
+	s.srv.connections = connections
+
+	newLegacy := &mocks.HandlerIFace{}
+	createLegacySubscriberVar = func(_ ConnectionManager, e *domain.Enrollment) (legacy.HandlerIFace, error) {
+		s.Assert().Equal(enrolled, e)
+		return newLegacy, nil
+	}
+
+	// A successful connection resets the count, so only consecutive failures are counted
+	rejectedEvent := mqtt.StateEvent{State: mqtt.StateAuthFailed, Error: errors.New("MOCK not Authorized")}
+	s.srv.connectionStateChanged(rejectedEvent)
+	s.srv.connectionStateChanged(rejectedEvent)
+	s.srv.connectionStateChanged(mqtt.StateEvent{State: mqtt.StateConnected})
+	s.srv.connectionStateChanged(rejectedEvent)
+	s.srv.connectionStateChanged(rejectedEvent)
+	mockedIdentity.AssertNotCalled(s.T(), "Reenroll")
+
+	// The threshold enrolls again and reconnects with the new credentials
+	s.srv.connectionStateChanged(rejectedEvent)
+	for i := 0; i < 100 && s.srv.currentLegacy() != newLegacy; i++ {
+		time.Sleep(10 * time.Millisecond)
+		mockedClock.Add(time.Second)
+	}
+
+	s.Assert().Equal(newLegacy, s.srv.currentLegacy())
+	s.Assert().Equal(enrolled, s.srv.enrollment)
+	mockedIdentity.AssertExpectations(s.T())
+	oldLegacy.AssertExpectations(s.T())
+	connections.AssertExpectations(s.T())
+}
+
+func (s *ServerTestSuite) Test_Reenroll_Failed() {
+	rejected := &domain.Enrollment{ID: "a111"}
+
+	mockedIdentity := &mocks.Identity{}
+	mockedIdentity.On("Reenroll").Return(nil, errors.New("MOCK enroll error")).Once()
+	s.srv.identity = mockedIdentity
+	s.srv.enrollment = rejected
+
+	oldLegacy := &mocks.HandlerIFace{}
+	s.srv.legacy = oldLegacy
+	connections := &mocks.ConnectionManager{}
+	s.srv.connections = connections
+
+	// The connections keep the stored credentials when the enrollment fails
+	s.srv.Reenroll(errors.New("MOCK not Authorized"))
+
+	s.Assert().Equal(oldLegacy, s.srv.currentLegacy())
+	s.Assert().Equal(rejected, s.srv.enrollment)
+	mockedIdentity.AssertExpectations(s.T())
+	oldLegacy.AssertNotCalled(s.T(), "Close")
+	connections.AssertNotCalled(s.T(), "CloseAll")
+}
+
+func certificate(t *testing.T, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "a111"},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func (s *ServerTestSuite) Test_ImportProvisioning() {
+	dir := s.T().TempDir()
+	defer viper.Set(agentconfig.ProvisioningKeyKey, "")
+	defer viper.Set(agentconfig.ProvisioningPathsKey, "")
+
+	signingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&signingKey.PublicKey)
+	keyPath := path.Join(dir, "provisioning.pem")
+	s.Require().NoError(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	bundle, _ := json.Marshal(&identity.ProvisioningBundle{IdentityURL: "https://id.example.com"})
+	digest := sha256.Sum256(bundle)
+	signature, _ := ecdsa.SignASN1(rand.Reader, signingKey, digest[:])
+	signed, _ := json.Marshal(map[string][]byte{"bundle": bundle, "signature": signature})
+	s.Require().NoError(ioutil.WriteFile(path.Join(dir, "a.json"), []byte(`{"bundle": "e30=", "signature": "e30="}`), 0600))
+	s.Require().NoError(ioutil.WriteFile(path.Join(dir, "b.json"), signed, 0600))
+
+	mockedIdentity := &mocks.Identity{}
+	mockedIdentity.On("ApplyProvisioning", mock.MatchedBy(func(b *identity.ProvisioningBundle) bool {
+		return b.IdentityURL == "https://id.example.com"
+	})).Return(nil).Once()
+	s.srv.identity = mockedIdentity
+
+	// No bundle is imported without the key that signs them
+	viper.Set(agentconfig.ProvisioningPathsKey, path.Join(dir, "*.json"))
+	s.srv.importProvisioning()
+	mockedIdentity.AssertNotCalled(s.T(), "ApplyProvisioning", mock.Anything)
+
+	// The bundle with an invalid signature is skipped, and the applied bundle is marked as imported
+	viper.Set(agentconfig.ProvisioningKeyKey, keyPath)
+	s.srv.importProvisioning()
+	s.srv.importProvisioning()
+
+	s.Assert().FileExists(path.Join(dir, "a.json"))
+	s.Assert().FileExists(path.Join(dir, "b.json"+importedSuffix))
+	mockedIdentity.AssertExpectations(s.T())
+}
@@ -20,7 +20,8 @@
 package snapdapi
 
 import (
-	"errors"
+	"bytes"
+	"fmt"
 	"log"
 
 	"github.com/snapcore/snapd/asserts"
@@ -35,27 +36,33 @@ type ActionDevice struct {
 	DeviceKey    string `json:"deviceKey"`
 }
 
-// GetEncodedAssertions fetches the encoded model and serial assertions
-func (a *ClientAdapter) GetEncodedAssertions(assertionType string) ([]byte, error) {
+// GetEncodedAssertions fetches the assertions of the given type that match the
+// header filters, encoded as a stream separated by double newlines
+func (a *ClientAdapter) GetEncodedAssertions(assertionType string, headers map[string]string) ([]byte, error) {
 	at := asserts.Type(assertionType)
 	if at == nil {
-		return nil, errors.New("unknown assertion type")
+		return nil, fmt.Errorf("unknown assertion type: %s", assertionType)
 	}
 
-	if at.Name != asserts.ModelType.Name {
-		return nil, errors.New("only model assertions are supported currently")
+	if headers == nil {
+		headers = map[string]string{}
 	}
 
-	// Get the model assertion
-	modelAssertions, err := a.Known(asserts.ModelType.Name, map[string]string{})
-	if err != nil || len(modelAssertions) == 0 {
-		log.Printf("error retrieving the model assertion: %v", err)
+	assertions, err := a.Known(at.Name, headers)
+	if err != nil {
+		log.Printf("error retrieving the %s assertions: %v", at.Name, err)
 		return nil, err
 	}
-	dataModel := asserts.Encode(modelAssertions[0])
 
-	data := append(dataModel, []byte("\n")...)
-	return data, nil
+	buf := &bytes.Buffer{}
+	enc := asserts.NewEncoder(buf)
+	for _, as := range assertions {
+		if err := enc.Encode(as); err != nil {
+			return nil, fmt.Errorf("error encoding the %s assertions: %v", at.Name, err)
+		}
+	}
+
+	return buf.Bytes(), nil
 }
 
 // DeviceInfo fetches the basic details of the device
@@ -20,7 +20,14 @@
 package snapdapi
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"io"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/snapcore/snapd/asserts"
@@ -46,13 +53,23 @@ type SnapdClient interface {
 	Known(assertTypeName string, headers map[string]string) ([]asserts.Assertion, error)
 	Conf(name string) (map[string]interface{}, error)
 	SetConf(name string, patch map[string]interface{}) (string, error)
-	GetEncodedAssertions(assertionType string) ([]byte, error)
+	GetEncodedAssertions(assertionType string, headers map[string]string) ([]byte, error)
 	DeviceInfo() (ActionDevice, error)
 	Snaps() ([]*client.Snap, error)
 	Switch(name string, options *client.SnapOptions) (string, error)
-	Logs(opts client.LogOptions) (<-chan client.Log, error)
+	Logs(ctx context.Context, names []string, opts client.LogOptions) (<-chan client.Log, error)
 	SnapshotMany(names []string, users []string) (setID uint64, changeID string, err error)
 	SnapshotExport(setID uint64) (stream io.ReadCloser, contentLength int64, err error)
+	Find(opts *client.FindOptions) ([]*client.Snap, *client.ResultInfo, error)
+	FindOne(name string) (*client.Snap, *client.ResultInfo, error)
+	RefreshCandidates() ([]*client.Snap, error)
+	EnsureQuota(groupName, parent string, snaps []string, constraints *QuotaValues) (string, error)
+	RemoveQuota(groupName string) (string, error)
+	GetQuotaGroup(groupName string) (*QuotaGroupResult, error)
+	Quotas() ([]*QuotaGroupResult, error)
+	ListComponents(names []string) (map[string][]*Component, error)
+	InstallComponents(name string, components []string) (string, error)
+	RemoveComponents(name string, components []string) (string, error)
 }
 
 var clientOnce sync.Once
@@ -61,6 +78,7 @@ var clientInstance *ClientAdapter
 // ClientAdapter adapts our expectations to the snapd client API.
 type ClientAdapter struct {
 	snapdClient *client.Client
+	raw         *rawClient
 }
 
 // NewClientAdapter creates a new ClientAdapter as a singleton
@@ -68,6 +86,7 @@ func NewClientAdapter() *ClientAdapter {
 	clientOnce.Do(func() {
 		clientInstance = &ClientAdapter{
 			snapdClient: client.New(nil),
+			raw:         newRawClient(),
 		}
 	})
 
@@ -167,9 +186,53 @@ func (a *ClientAdapter) Switch(name string, options *client.SnapOptions) (string
 	return a.snapdClient.Switch(name, options)
 }
 
-// Logs requests syslog logs from the snapd api
-func (a *ClientAdapter) Logs(opts client.LogOptions) (<-chan client.Log, error) {
-	return a.snapdClient.Logs([]string{}, opts)
+// Logs requests syslog logs of the given snaps or services from the snapd api,
+// or system-wide logs if names is empty. The channel is closed when the logs
+// are exhausted or the context is done, which is the only way to end a follow.
+func (a *ClientAdapter) Logs(ctx context.Context, names []string, opts client.LogOptions) (<-chan client.Log, error) {
+	query := url.Values{}
+	if len(names) > 0 {
+		query.Set("names", strings.Join(names, ","))
+	}
+	query.Set("n", strconv.Itoa(opts.N))
+	if opts.Follow {
+		query.Set("follow", "true")
+	}
+
+	body, err := a.raw.stream(ctx, "GET", "/v2/logs", query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan client.Log, 20)
+	go func() {
+		defer close(ch)
+		defer body.Close()
+
+		// The logs are a json-seq stream (RFC7464) of <RS><JSON><LF> records,
+		// invalid or truncated records are skipped
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			buf := scanner.Bytes()
+			idx := bytes.IndexByte(buf, 0x1E)
+			if idx < 0 {
+				continue
+			}
+
+			var log client.Log
+			if err := json.Unmarshal(buf[idx+1:], &log); err != nil {
+				continue
+			}
+
+			select {
+			case ch <- log:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
 }
 
 // SnapshotMany creates snapshots of the provided snaps under the provided users.
@@ -182,3 +245,21 @@ func (a *ClientAdapter) SnapshotMany(names []string, users []string) (setID uint
 func (a *ClientAdapter) SnapshotExport(setID uint64) (stream io.ReadCloser, contentLength int64, err error) {
 	return a.snapdClient.SnapshotExport(setID)
 }
+
+// Find searches the store for snaps matching the provided options
+func (a *ClientAdapter) Find(opts *client.FindOptions) ([]*client.Snap, *client.ResultInfo, error) {
+	return a.snapdClient.Find(opts)
+}
+
+// FindOne returns the store details of the snap with the provided name,
+// including its channel map
+func (a *ClientAdapter) FindOne(name string) (*client.Snap, *client.ResultInfo, error) {
+	return a.snapdClient.FindOne(name)
+}
+
+// RefreshCandidates returns the store details of the installed snaps that have
+// an update available in their tracking channel
+func (a *ClientAdapter) RefreshCandidates() ([]*client.Snap, error) {
+	snaps, _, err := a.snapdClient.Find(&client.FindOptions{Refresh: true})
+	return snaps, err
+}
@@ -0,0 +1,99 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package snapdapi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/snapcore/snapd/snap"
+)
+
+// Component is a component of a snap, such as a kernel module or a plugin.
+// Components that are available but not installed have no install date.
+type Component struct {
+	Name          string        `json:"name"`
+	Type          string        `json:"type"`
+	Version       string        `json:"version,omitempty"`
+	Summary       string        `json:"summary,omitempty"`
+	Revision      snap.Revision `json:"revision,omitempty"`
+	InstallDate   *time.Time    `json:"install-date,omitempty"`
+	InstalledSize int64         `json:"installed-size,omitempty"`
+}
+
+// snapComponents is the part of a snapd snap result that the snapd client
+// library does not decode
+type snapComponents struct {
+	Name       string       `json:"name"`
+	Components []*Component `json:"components,omitempty"`
+}
+
+type postComponentsData struct {
+	Action     string              `json:"action"`
+	Components map[string][]string `json:"components"`
+}
+
+// ListComponents returns the components of the installed snaps with names in
+// the given list, or of all installed snaps if the list is empty. Snaps
+// without components are not included.
+func (a *ClientAdapter) ListComponents(names []string) (map[string][]*Component, error) {
+	query := url.Values{}
+	if len(names) > 0 {
+		query.Set("snaps", strings.Join(names, ","))
+	}
+
+	var snaps []*snapComponents
+	if _, err := a.raw.do(context.Background(), "GET", "/v2/snaps", query, nil, &snaps); err != nil {
+		return nil, err
+	}
+
+	result := map[string][]*Component{}
+	for _, s := range snaps {
+		if len(s.Components) > 0 {
+			result[s.Name] = s.Components
+		}
+	}
+	return result, nil
+}
+
+// InstallComponents installs components of an installed snap
+func (a *ClientAdapter) InstallComponents(name string, components []string) (string, error) {
+	return a.postComponents("install", name, components)
+}
+
+// RemoveComponents removes components of an installed snap, leaving the snap installed
+func (a *ClientAdapter) RemoveComponents(name string, components []string) (string, error) {
+	return a.postComponents("remove", name, components)
+}
+
+func (a *ClientAdapter) postComponents(action, name string, components []string) (string, error) {
+	if len(name) == 0 || len(components) == 0 {
+		return "", fmt.Errorf("cannot %s components without a snap name and components", action)
+	}
+
+	data := &postComponentsData{
+		Action:     action,
+		Components: map[string][]string{name: components},
+	}
+	return a.raw.do(context.Background(), "POST", "/v2/snaps", nil, data, nil)
+}
@@ -0,0 +1,110 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package snapdapi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// QuotaCPU is the CPU limit of a quota group
+type QuotaCPU struct {
+	Count      int `json:"count,omitempty"`
+	Percentage int `json:"percentage,omitempty"`
+}
+
+// QuotaValues are the resource limits of a quota group, or its current usage
+type QuotaValues struct {
+	Memory  uint64    `json:"memory,omitempty"`
+	CPU     *QuotaCPU `json:"cpu,omitempty"`
+	Threads int       `json:"threads,omitempty"`
+}
+
+// QuotaGroupResult is a quota group as reported by snapd
+type QuotaGroupResult struct {
+	GroupName   string       `json:"group-name"`
+	Parent      string       `json:"parent,omitempty"`
+	Subgroups   []string     `json:"subgroups,omitempty"`
+	Snaps       []string     `json:"snaps,omitempty"`
+	Constraints *QuotaValues `json:"constraints,omitempty"`
+	Current     *QuotaValues `json:"current,omitempty"`
+}
+
+type postQuotaGroupData struct {
+	Action      string       `json:"action"`
+	GroupName   string       `json:"group-name"`
+	Parent      string       `json:"parent,omitempty"`
+	Snaps       []string     `json:"snaps,omitempty"`
+	Constraints *QuotaValues `json:"constraints,omitempty"`
+}
+
+// EnsureQuota creates a quota group or updates an existing one. The snaps
+// are added to the group and the constraints replace the existing limits.
+func (a *ClientAdapter) EnsureQuota(groupName, parent string, snaps []string, constraints *QuotaValues) (string, error) {
+	if groupName == "" {
+		return "", fmt.Errorf("cannot create or update quota group without a name")
+	}
+
+	data := &postQuotaGroupData{
+		Action:      "ensure",
+		GroupName:   groupName,
+		Parent:      parent,
+		Snaps:       snaps,
+		Constraints: constraints,
+	}
+	return a.raw.do(context.Background(), "POST", "/v2/quotas", nil, data, nil)
+}
+
+// RemoveQuota removes a quota group, the snaps in the group are not removed
+func (a *ClientAdapter) RemoveQuota(groupName string) (string, error) {
+	if groupName == "" {
+		return "", fmt.Errorf("cannot remove quota group without a name")
+	}
+
+	data := &postQuotaGroupData{
+		Action:    "remove",
+		GroupName: groupName,
+	}
+	return a.raw.do(context.Background(), "POST", "/v2/quotas", nil, data, nil)
+}
+
+// GetQuotaGroup fetches a quota group with its current usage
+func (a *ClientAdapter) GetQuotaGroup(groupName string) (*QuotaGroupResult, error) {
+	if groupName == "" {
+		return nil, fmt.Errorf("cannot get quota group without a name")
+	}
+
+	var group *QuotaGroupResult
+	path := fmt.Sprintf("/v2/quotas/%s", url.PathEscape(groupName))
+	if _, err := a.raw.do(context.Background(), "GET", path, nil, nil, &group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// Quotas lists the quota groups with their current usage
+func (a *ClientAdapter) Quotas() ([]*QuotaGroupResult, error) {
+	var groups []*QuotaGroupResult
+	if _, err := a.raw.do(context.Background(), "GET", "/v2/quotas", nil, nil, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
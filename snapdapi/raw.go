@@ -0,0 +1,133 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * This file is part of the IoT Agent
+ * Copyright 2021 Canonical Ltd.
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License version 3, as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranties of MERCHANTABILITY,
+ * SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR PURPOSE.
+ * See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package snapdapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/snapcore/snapd/client"
+	"github.com/snapcore/snapd/dirs"
+)
+
+// rawClient talks to the snapd REST API directly, for the endpoints and
+// options that the snapd client library does not expose
+type rawClient struct {
+	http *http.Client
+}
+
+// rawResponse is the envelope of every snapd REST API response
+type rawResponse struct {
+	Type       string          `json:"type"`
+	StatusCode int             `json:"status-code"`
+	Change     string          `json:"change"`
+	Result     json.RawMessage `json:"result"`
+}
+
+func newRawClient() *rawClient {
+	return &rawClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", dirs.SnapdSocket)
+				},
+			},
+		},
+	}
+}
+
+// stream sends a request to snapd and returns the body of a successful response
+func (r *rawClient) stream(ctx context.Context, method, path string, query url.Values, body interface{}) (io.ReadCloser, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	u := url.URL{Scheme: "http", Host: "localhost", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot communicate with snapd: %v", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		_, err = decodeRawResponse(resp.Body)
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// do sends a request to snapd, decoding a sync result into v and returning
+// the change ID of an async result
+func (r *rawClient) do(ctx context.Context, method, path string, query url.Values, body interface{}, v interface{}) (string, error) {
+	stream, err := r.stream(ctx, method, path, query, body)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	resp, err := decodeRawResponse(stream)
+	if err != nil {
+		return "", err
+	}
+
+	if v != nil && len(resp.Result) > 0 {
+		if err := json.Unmarshal(resp.Result, v); err != nil {
+			return "", fmt.Errorf("cannot decode snapd result: %v", err)
+		}
+	}
+	return resp.Change, nil
+}
+
+func decodeRawResponse(r io.Reader) (*rawResponse, error) {
+	resp := &rawResponse{}
+	if err := json.NewDecoder(r).Decode(resp); err != nil {
+		return nil, fmt.Errorf("cannot decode snapd response: %v", err)
+	}
+
+	if resp.Type == "error" {
+		e := &client.Error{}
+		if err := json.Unmarshal(resp.Result, e); err != nil {
+			return nil, fmt.Errorf("cannot decode snapd error: %v", err)
+		}
+		e.StatusCode = resp.StatusCode
+		return nil, e
+	}
+	return resp, nil
+}
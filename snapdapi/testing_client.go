@@ -21,6 +21,7 @@ package snapdapi
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -29,6 +30,7 @@ import (
 
 	"github.com/snapcore/snapd/asserts"
 	"github.com/snapcore/snapd/client"
+	"github.com/snapcore/snapd/snap"
 )
 
 const model1 = `type: model
@@ -112,9 +114,13 @@ func (c *MockClient) List(names []string, opts *client.ListOptions) ([]*client.S
 	}
 	return []*client.Snap{
 		{
-			ID:      "1",
-			Title:   "helloworld",
-			Summary: "Welcomes the world",
+			ID:              "1",
+			Name:            "helloworld",
+			Title:           "helloworld",
+			Summary:         "Welcomes the world",
+			Version:         "6.4",
+			Revision:        snap.R(29),
+			TrackingChannel: "latest/stable",
 		},
 	}, nil
 }
@@ -222,10 +228,13 @@ func (c *MockClient) SetConf(name string, patch map[string]interface{}) (string,
 }
 
 // GetEncodedAssertions returns the encoded assertions by type
-func (c *MockClient) GetEncodedAssertions(assertionType string) ([]byte, error) {
+func (c *MockClient) GetEncodedAssertions(assertionType string, headers map[string]string) ([]byte, error) {
 	if c.WithError {
 		return nil, fmt.Errorf("MOCK error known")
 	}
+	if asserts.Type(assertionType) == nil {
+		return nil, fmt.Errorf("MOCK unknown assertion type: %s", assertionType)
+	}
 	return []byte(fmt.Sprintf("%s\n%s", model1, serial1)), nil
 }
 
@@ -264,18 +273,30 @@ func (c *MockClient) Switch(name string, opts *client.SnapOptions) (changeID str
 }
 
 // Logs returns a mock channel of syslog logs from the snapd api
-func (c *MockClient) Logs(opts client.LogOptions) (<-chan client.Log, error) {
-	ch := make(chan client.Log)
-	emptyLog := client.Log{
-		Timestamp: time.Now(),
-		Message:   "",
-		SID:       "0",
-		PID:       "0",
+func (c *MockClient) Logs(ctx context.Context, names []string, opts client.LogOptions) (<-chan client.Log, error) {
+	if c.WithError {
+		return nil, fmt.Errorf("MOCK error logs")
 	}
-	go func() { ch <- emptyLog }()
 
-	return ch, nil
+	ch := make(chan client.Log)
+	go func() {
+		defer close(ch)
+		for i := 0; i < 3; i++ {
+			l := client.Log{
+				Timestamp: time.Now(),
+				Message:   fmt.Sprintf("log line %d", i),
+				SID:       "helloworld",
+				PID:       "1",
+			}
+			select {
+			case ch <- l:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
+	return ch, nil
 }
 
 // SnapshotMany creates a mock setID for a snap snapshot
@@ -288,3 +309,129 @@ func (c *MockClient) SnapshotExport(setID uint64) (stream io.ReadCloser, content
 	mockArchive := "mock archive stream"
 	return ioutil.NopCloser(strings.NewReader(mockArchive)), int64(len(mockArchive)), nil
 }
+
+// Find mocks a store search
+func (c *MockClient) Find(opts *client.FindOptions) ([]*client.Snap, *client.ResultInfo, error) {
+	if c.WithError || opts.Query == "invalid" {
+		return nil, nil, fmt.Errorf("MOCK error find")
+	}
+	return []*client.Snap{
+		{
+			ID:       "1",
+			Name:     "helloworld",
+			Title:    "helloworld",
+			Summary:  "Welcomes the world",
+			Version:  "6.4",
+			Revision: snap.R(29),
+		},
+	}, &client.ResultInfo{}, nil
+}
+
+// FindOne mocks fetching the store details of a snap
+func (c *MockClient) FindOne(name string) (*client.Snap, *client.ResultInfo, error) {
+	if c.WithError || name == "invalid" {
+		return nil, nil, fmt.Errorf("MOCK error find one")
+	}
+	return &client.Snap{
+		ID:       "1",
+		Name:     name,
+		Title:    "helloworld",
+		Summary:  "Welcomes the world",
+		Version:  "6.4",
+		Revision: snap.R(29),
+		Channels: map[string]*snap.ChannelSnapInfo{
+			"latest/stable": {Revision: snap.R(29), Version: "6.4", Channel: "stable"},
+			"latest/edge":   {Revision: snap.R(30), Version: "6.5", Channel: "edge"},
+		},
+		Tracks: []string{"latest"},
+	}, &client.ResultInfo{}, nil
+}
+
+// RefreshCandidates mocks the list of snaps with updates available
+func (c *MockClient) RefreshCandidates() ([]*client.Snap, error) {
+	if c.WithError {
+		return nil, fmt.Errorf("MOCK error refresh candidates")
+	}
+	return []*client.Snap{
+		{
+			ID:       "1",
+			Name:     "helloworld",
+			Version:  "6.5",
+			Revision: snap.R(30),
+		},
+	}, nil
+}
+
+// EnsureQuota mocks creating or updating a quota group
+func (c *MockClient) EnsureQuota(groupName, parent string, snaps []string, constraints *QuotaValues) (string, error) {
+	if c.WithError || groupName == "invalid" {
+		return "", fmt.Errorf("MOCK error ensure quota")
+	}
+	return "107", nil
+}
+
+// RemoveQuota mocks removing a quota group
+func (c *MockClient) RemoveQuota(groupName string) (string, error) {
+	if c.WithError || groupName == "invalid" {
+		return "", fmt.Errorf("MOCK error remove quota")
+	}
+	return "108", nil
+}
+
+// GetQuotaGroup mocks fetching a quota group, only the "existing" group exists
+func (c *MockClient) GetQuotaGroup(groupName string) (*QuotaGroupResult, error) {
+	if c.WithError || groupName != "existing" {
+		return nil, &client.Error{Kind: "quota-group-not-found", Message: "MOCK error quota group not found", StatusCode: 404}
+	}
+	return &QuotaGroupResult{
+		GroupName:   "existing",
+		Snaps:       []string{"helloworld"},
+		Constraints: &QuotaValues{Memory: 1 << 30},
+		Current:     &QuotaValues{Memory: 1 << 20},
+	}, nil
+}
+
+// Quotas mocks listing the quota groups
+func (c *MockClient) Quotas() ([]*QuotaGroupResult, error) {
+	if c.WithError {
+		return nil, fmt.Errorf("MOCK error quotas")
+	}
+	return []*QuotaGroupResult{
+		{
+			GroupName:   "existing",
+			Snaps:       []string{"helloworld"},
+			Constraints: &QuotaValues{Memory: 1 << 30, CPU: &QuotaCPU{Count: 2, Percentage: 50}, Threads: 64},
+			Current:     &QuotaValues{Memory: 1 << 20, Threads: 4},
+		},
+	}, nil
+}
+
+// ListComponents mocks listing the components of the installed snaps
+func (c *MockClient) ListComponents(names []string) (map[string][]*Component, error) {
+	if c.WithError {
+		return nil, fmt.Errorf("MOCK error list components")
+	}
+	installed := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	return map[string][]*Component{
+		"helloworld": {
+			{Name: "wifi-driver", Type: "kernel-modules", Version: "1.0", Revision: snap.R(3), InstallDate: &installed, InstalledSize: 4096},
+			{Name: "plugin", Type: "standard", Version: "1.0", Revision: snap.R(4)},
+		},
+	}, nil
+}
+
+// InstallComponents mocks installing components of a snap
+func (c *MockClient) InstallComponents(name string, components []string) (string, error) {
+	if c.WithError || name == "invalid" {
+		return "", fmt.Errorf("MOCK error install components")
+	}
+	return "109", nil
+}
+
+// RemoveComponents mocks removing components of a snap
+func (c *MockClient) RemoveComponents(name string, components []string) (string, error) {
+	if c.WithError || name == "invalid" {
+		return "", fmt.Errorf("MOCK error remove components")
+	}
+	return "110", nil
+}